@@ -7,10 +7,10 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
-	"sync"
 	"time"
 
 	"github.com/CiscoCloud/mantl-api/install"
+	"github.com/CiscoCloud/mantl-api/leader"
 	"github.com/CiscoCloud/mantl-api/mesos"
 	log "github.com/Sirupsen/logrus"
 	"github.com/julienschmidt/httprouter"
@@ -18,11 +18,15 @@ import (
 
 var agent string
 
+// packageVersionHeader reports the package version an install request
+// resolved to
+const packageVersionHeader = "X-Mantl-Package-Version"
+
 type Api struct {
 	listen  string
 	install *install.Install
 	mesos   *mesos.Mesos
-	wg      sync.WaitGroup
+	leader  *leader.Election
 }
 
 func init() {
@@ -33,11 +37,11 @@ func init() {
 	}
 }
 
-func NewApi(id string, listen string, install *install.Install, mesos *mesos.Mesos, wg sync.WaitGroup) *Api {
+func NewApi(id string, listen string, install *install.Install, mesos *mesos.Mesos, leader *leader.Election) *Api {
 	if id != "" {
 		agent = fmt.Sprintf("%s.%s", id, agent)
 	}
-	return &Api{listen, install, mesos, wg}
+	return &Api{listen, install, mesos, leader}
 }
 
 func logHandler(handler http.Handler) http.Handler {
@@ -57,24 +61,47 @@ func deprecate(handle httprouter.Handle, msg string) httprouter.Handle {
 	}
 }
 
-func (api *Api) Start() {
-	defer func() {
-		api.wg.Done()
-	}()
+// leaderOnly redirects requests that change the cluster to the current
+// leader when this instance is a follower.
+func (api *Api) leaderOnly(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if api.leader == nil || api.leader.IsLeader() {
+			handle(w, r, p)
+			return
+		}
+
+		current, err := api.leader.Leader()
+		if err != nil {
+			writeError(w, "Could not retrieve leader", 503, err)
+			return
+		}
+
+		if current == nil || current.Address == "" {
+			w.WriteHeader(503)
+			fmt.Fprintln(w, "This instance is not the leader and there is no leader to redirect to.")
+			return
+		}
 
+		http.Redirect(w, r, current.Address+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	}
+}
+
+func (api *Api) Start() {
 	router := httprouter.New()
 	router.GET("/health", api.health)
 
 	router.GET("/1/packages", api.packages)
 	router.GET("/1/packages/:name", api.describePackage)
-	router.POST("/1/packages", deprecate(api.installPackage, "Use /1/install instead."))
-	router.DELETE("/1/packages", deprecate(api.uninstallPackage, "Use /1/install instead."))
+	router.POST("/1/packages", deprecate(api.leaderOnly(api.installPackage), "Use /1/install instead."))
+	router.DELETE("/1/packages", deprecate(api.leaderOnly(api.uninstallPackage), "Use /1/install instead."))
 
 	router.GET("/1/frameworks", api.frameworks)
-	router.DELETE("/1/frameworks/:id", api.shutdownFramework)
+	router.DELETE("/1/frameworks/:id", api.leaderOnly(api.shutdownFramework))
 
-	router.POST("/1/install", api.installPackage)
-	router.DELETE("/1/install", api.uninstallPackage)
+	router.POST("/1/install", api.leaderOnly(api.installPackage))
+	router.DELETE("/1/install", api.leaderOnly(api.uninstallPackage))
+
+	router.GET("/1/leader", api.currentLeader)
 
 	log.WithField("port", api.listen).Info("Starting listener")
 	log.Fatal(http.ListenAndServe(api.listen, logHandler(router)))
@@ -124,17 +151,49 @@ func (api *Api) installPackage(w http.ResponseWriter, req *http.Request, _ httpr
 		return
 	}
 
-	marathonResponse, err := api.install.InstallPackage(pkgRequest)
-	if err != nil {
+	if pkgRequest.DryRun {
+		api.dryRunPackage(w, pkgRequest)
+		return
+	}
+
+	marathonResponse, version, err := api.install.InstallPackage(pkgRequest)
+	if depErr, ok := err.(*install.DependencyError); ok {
+		w.WriteHeader(409)
+		fmt.Fprintln(w, depErr.Error())
+		return
+	} else if feasibilityErr, ok := err.(*install.FeasibilityError); ok {
+		w.WriteHeader(409)
+		fmt.Fprintln(w, feasibilityErr.Error())
+		return
+	} else if policyErr, ok := err.(*install.PolicyError); ok {
+		w.WriteHeader(403)
+		fmt.Fprintln(w, policyErr.Error())
+		return
+	} else if err != nil {
 		writeError(w, fmt.Sprintf("Could not install %s package", pkgRequest.Name), 500, err)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(packageVersionHeader, version)
 	w.WriteHeader(201)
 	fmt.Fprintf(w, marathonResponse)
 }
 
+func (api *Api) dryRunPackage(w http.ResponseWriter, pkgRequest *install.PackageRequest) {
+	result, err := api.install.DryRunPackage(pkgRequest)
+	if err != nil {
+		writeError(w, fmt.Sprintf("Could not render %s package", pkgRequest.Name), 500, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(packageVersionHeader, result.Version)
+	if err = json.NewEncoder(w).Encode(result); err != nil {
+		writeError(w, fmt.Sprintf("Could not encode %s package", pkgRequest.Name), 500, err)
+	}
+}
+
 func (api *Api) uninstallPackage(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
 	req.Header.Add("Accept", "application/json")
 
@@ -145,28 +204,34 @@ func (api *Api) uninstallPackage(w http.ResponseWriter, req *http.Request, _ htt
 		return
 	}
 
-	apps, err := api.install.FindInstalled(pkgRequest)
+	app, err := api.install.FindInstalledApp(pkgRequest)
 
-	if err != nil {
+	if pkgErr, ok := err.(*install.InstalledPackageError); ok {
+		if pkgErr.Count == 0 {
+			w.WriteHeader(404)
+		} else {
+			w.WriteHeader(409)
+		}
+		fmt.Fprintln(w, pkgErr.Error())
+		return
+	} else if err != nil {
 		writeError(w, "Could not retrieve installed packages", 500, err)
 		return
 	}
 
-	if len(apps) == 0 {
-		w.WriteHeader(404)
-		if pkgRequest.AppID != "" {
-			fmt.Fprintf(w, "Package %s (%s) not found.\n", pkgRequest.Name, pkgRequest.AppID)
-		} else {
-			fmt.Fprintf(w, "Package %s not found.\n", pkgRequest.Name)
+	if !pkgRequest.Force {
+		err = api.install.CheckDependents(app)
+		if depErr, ok := err.(*install.DependencyError); ok {
+			w.WriteHeader(409)
+			fmt.Fprintln(w, depErr.Error())
+			return
+		} else if err != nil {
+			writeError(w, "Could not retrieve installed packages", 500, err)
+			return
 		}
-		return
-	} else if len(apps) > 1 {
-		w.WriteHeader(409)
-		fmt.Fprintf(w, "There is more than 1 instance of the %s package running. Please include the application id in the request.\n", pkgRequest.Name)
-		return
 	}
 
-	err = api.install.UninstallPackage(apps[0])
+	err = api.install.UninstallPackage(app)
 	if err != nil {
 		writeError(w, fmt.Sprintf("Could not uninstall %s package", pkgRequest.Name), 500, err)
 		return
@@ -175,6 +240,44 @@ func (api *Api) uninstallPackage(w http.ResponseWriter, req *http.Request, _ htt
 	w.WriteHeader(204)
 }
 
+type leaderResponse struct {
+	ID       string `json:"id"`
+	Address  string `json:"address"`
+	IsLeader bool   `json:"isLeader"`
+}
+
+func (api *Api) currentLeader(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	if api.leader == nil {
+		w.WriteHeader(404)
+		fmt.Fprintln(w, "Leader election is disabled.")
+		return
+	}
+
+	current, err := api.leader.Leader()
+	if err != nil {
+		writeError(w, "Could not retrieve leader", 500, err)
+		return
+	}
+
+	if current == nil {
+		w.WriteHeader(404)
+		fmt.Fprintln(w, "No leader elected.")
+		return
+	}
+
+	self := api.leader.Self()
+	response := &leaderResponse{
+		ID:       current.ID,
+		Address:  current.Address,
+		IsLeader: api.leader.IsLeader() && current.ID == self.ID,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(response); err != nil {
+		writeError(w, "Could not encode leader", 500, err)
+	}
+}
+
 type frameworkResponse struct {
 	Name             string    `json:"name"`
 	ID               string    `json:"id"`
@@ -0,0 +1,285 @@
+package install
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/go-cleanhttp"
+)
+
+// fetchHTTPSource downloads and extracts an archive source, or downloads a
+// single file universe repository. Unless force is set, the request is
+// conditional on the ETag and Last-Modified values recorded by the last sync,
+// and an unmodified archive is not downloaded. A source pinned to a sha256
+// other than the one of the last synced archive is always downloaded.
+func (install *Install) fetchHTTPSource(source *Source, force bool) (*fetchedSource, error) {
+	request, err := http.NewRequest("GET", source.Path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// universe servers serve the single file repository format when asked for it
+	request.Header.Set("Accept", strings.Join(append(universeMediaTypes, "*/*"), ", "))
+
+	if !force && source.SHA256 != "" {
+		if synced, err := install.sourceMeta(source, "sha256"); err != nil || !strings.EqualFold(synced, source.SHA256) {
+			force = true
+		}
+	}
+
+	if !force {
+		if etag, err := install.sourceMeta(source, "etag"); err == nil && etag != "" {
+			request.Header.Set("If-None-Match", etag)
+		}
+		if lastModified, err := install.sourceMeta(source, "last-modified"); err == nil && lastModified != "" {
+			request.Header.Set("If-Modified-Since", lastModified)
+		}
+	}
+
+	// a server that stalls must not hold the sync lock forever
+	client := cleanhttp.DefaultClient()
+	client.Timeout = source.downloadTimeout()
+
+	log.Debugf("Downloading %s", source.displayPath())
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotModified {
+		log.Debugf("%s source archive not modified", source.Name)
+		return &fetchedSource{unchanged: true, cleanup: func() {}}, nil
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("Could not download %s: %s", source.displayPath(), response.Status))
+	}
+
+	temp, err := ioutil.TempDir(os.TempDir(), "mantl-install")
+	if err != nil {
+		return nil, err
+	}
+	cleanup := func() { os.RemoveAll(temp) }
+
+	archive := filepath.Join(temp, "download")
+	sum, err := download(response.Body, archive, source.maxSize())
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+
+	if source.SHA256 != "" && !strings.EqualFold(source.SHA256, sum) {
+		cleanup()
+		return nil, errors.New(fmt.Sprintf("Checksum mismatch for %s: expected %s, got %s", source.displayPath(), source.SHA256, sum))
+	}
+
+	root := archive
+	format := archiveFormat(source.Path, response.Header.Get("Content-Type"))
+	if format != "json" {
+		dest := filepath.Join(temp, "extracted")
+		err = extractArchive(archive, format, dest, source.maxSize())
+		if err != nil {
+			cleanup()
+			return nil, err
+		}
+		root = archiveRoot(dest)
+	}
+
+	return &fetchedSource{
+		path: root,
+		meta: map[string]string{
+			"etag":          response.Header.Get("ETag"),
+			"last-modified": response.Header.Get("Last-Modified"),
+			"sha256":        sum,
+		},
+		cleanup: cleanup,
+	}, nil
+}
+
+// download writes body to file and returns its sha256. Bodies larger than
+// limit are an error.
+func download(body io.Reader, file string, limit int64) (string, error) {
+	out, err := os.Create(file)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(out, hash), io.LimitReader(body, limit+1))
+	if err != nil {
+		return "", err
+	}
+	if n > limit {
+		return "", errors.New(fmt.Sprintf("Download is larger than %d bytes", limit))
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func archiveFormat(url string, contentType string) string {
+	u := strings.ToLower(strings.SplitN(url, "?", 2)[0])
+	switch {
+	case strings.HasSuffix(u, ".json"), isUniverseContentType(contentType):
+		return "json"
+	case strings.HasSuffix(u, ".zip"), contentType == "application/zip":
+		return "zip"
+	case strings.HasSuffix(u, ".tar"), contentType == "application/x-tar":
+		return "tar"
+	}
+	return "tar.gz"
+}
+
+// extractArchive extracts archive into dest. Extracting more than limit
+// bytes is an error.
+func extractArchive(archive string, format string, dest string, limit int64) error {
+	remaining := limit
+	if format == "zip" {
+		return extractZip(archive, dest, &remaining)
+	}
+
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if format == "tar.gz" {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	return extractTar(r, dest, &remaining)
+}
+
+func extractTar(r io.Reader, dest string, remaining *int64) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		if err := extractFile(tr, dest, header.Name, remaining); err != nil {
+			return err
+		}
+	}
+}
+
+func extractZip(archive string, dest string, remaining *int64) error {
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		err = extractFile(rc, dest, f.Name, remaining)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// extractFile writes an archive entry below dest and subtracts its size from
+// remaining.
+func extractFile(r io.Reader, dest string, name string, remaining *int64) error {
+	target := filepath.Join(dest, filepath.FromSlash(name))
+	if !strings.HasPrefix(target, filepath.Clean(dest)+string(os.PathSeparator)) {
+		return errors.New(fmt.Sprintf("Archive entry %s is outside of the archive root", name))
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	out, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	n, err := io.Copy(out, io.LimitReader(r, *remaining+1))
+	*remaining -= n
+	if err == nil && *remaining < 0 {
+		err = errors.New(fmt.Sprintf("Archive entry %s exceeds the size limit of the extracted content", name))
+	}
+	return err
+}
+
+// fileSource extracts a .tar.gz, .tgz, .tar or .zip repository archive, like
+// the one written by ExportBundle, into a temporary directory. Other files
+// are single file universe repositories.
+func fileSource(file string) (string, func(), error) {
+	name := strings.ToLower(file)
+	format := ""
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		format = "tar.gz"
+	case strings.HasSuffix(name, ".tar"):
+		format = "tar"
+	case strings.HasSuffix(name, ".zip"):
+		format = "zip"
+	default:
+		return universeSource(file)
+	}
+
+	temp, err := ioutil.TempDir(os.TempDir(), "mantl-install")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(temp) }
+
+	if err := extractArchive(file, format, temp, defaultMaxSourceSize); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	return archiveRoot(temp), cleanup, nil
+}
+
+// archiveRoot descends into the single top-level directory that release
+// archives usually wrap their content in.
+func archiveRoot(dir string) string {
+	entries, err := ioutil.ReadDir(dir)
+	if err == nil && len(entries) == 1 && entries[0].IsDir() && entries[0].Name() != "repo" {
+		return filepath.Join(dir, entries[0].Name())
+	}
+	return dir
+}
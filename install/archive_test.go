@@ -0,0 +1,153 @@
+package install
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func tarGz(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+func archiveServer(archive []byte) (*httptest.Server, *int) {
+	downloads := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		downloads++
+		w.Header().Set("ETag", `"v1"`)
+		w.Write(archive)
+	}))
+	return ts, &downloads
+}
+
+func TestSyncHTTPSource(t *testing.T) {
+	t.Parallel()
+	ts, kv, inst := fakeConsul()
+	defer ts.Close()
+
+	archive := tarGz(t, map[string]string{
+		"universe-1.0/repo/packages/K/kafka/0/package.json": `{"name": "kafka", "version": "0.9.4.0"}`,
+	})
+	as, downloads := archiveServer(archive)
+	defer as.Close()
+
+	sum := sha256.Sum256(archive)
+	source := &Source{Name: "archive", Path: as.URL + "/universe.tar.gz", SourceType: HTTP, SHA256: hex.EncodeToString(sum[:])}
+
+	synced, err := inst.syncSource(source, false, nil)
+	assert.Nil(t, err)
+	assert.True(t, synced)
+	assert.Equal(t, []string{"kafka"}, packageNames(t, inst))
+	etag, _ := kv.get("mantl-install/repository/0/etag")
+	assert.Equal(t, `"v1"`, string(etag))
+
+	synced, err = inst.syncSource(source, false, nil)
+	assert.Nil(t, err)
+	assert.False(t, synced)
+	assert.Equal(t, 1, *downloads)
+	synced256, _ := kv.get("mantl-install/repository/0/sha256")
+	assert.Equal(t, source.SHA256, string(synced256))
+
+	// a new pin is checked against the archive instead of trusting a 304
+	source.SHA256 = "abc"
+	_, err = inst.syncSource(source, false, nil)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "Checksum mismatch")
+	}
+	assert.Equal(t, 2, *downloads)
+}
+
+func TestSyncHTTPSourceChecksumMismatch(t *testing.T) {
+	t.Parallel()
+	ts, _, inst := fakeConsul()
+	defer ts.Close()
+
+	as, _ := archiveServer(tarGz(t, map[string]string{"repo/packages/K/kafka/0/package.json": "{}"}))
+	defer as.Close()
+
+	source := &Source{Name: "archive", Path: as.URL + "/universe.tar.gz", SourceType: HTTP, SHA256: "abc"}
+	_, err := inst.syncSource(source, false, nil)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "Checksum mismatch")
+	}
+}
+
+func TestSyncHTTPSourceTimeout(t *testing.T) {
+	t.Parallel()
+	ts, _, inst := fakeConsul()
+	defer ts.Close()
+
+	stalled := make(chan struct{})
+	as := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		<-stalled
+	}))
+	defer as.Close()
+	defer close(stalled)
+
+	source := &Source{Name: "archive", Path: as.URL + "/universe.tar.gz", SourceType: HTTP, Timeout: 100 * time.Millisecond}
+	_, err := inst.syncSource(source, false, nil)
+	assert.Error(t, err)
+}
+
+func TestSyncHTTPSourceMaxSize(t *testing.T) {
+	t.Parallel()
+	ts, _, inst := fakeConsul()
+	defer ts.Close()
+
+	// compresses to far less than it extracts to
+	archive := tarGz(t, map[string]string{"repo/packages/K/kafka/0/package.json": strings.Repeat(" ", 1<<20)})
+	as, _ := archiveServer(archive)
+	defer as.Close()
+
+	source := &Source{Name: "archive", Path: as.URL + "/universe.tar.gz", SourceType: HTTP, MaxSize: 1024}
+	_, err := inst.syncSource(source, true, nil)
+	assert.EqualError(t, err, "Download is larger than 1024 bytes")
+
+	source.MaxSize = int64(len(archive))
+	_, err = inst.syncSource(source, true, nil)
+	assert.EqualError(t, err, "Archive entry repo/packages/K/kafka/0/package.json exceeds the size limit of the extracted content")
+}
+
+func TestExtractRejectsEscapingEntries(t *testing.T) {
+	t.Parallel()
+	archive := tarGz(t, map[string]string{"../evil.json": "{}"})
+	gz, _ := gzip.NewReader(bytes.NewReader(archive))
+	remaining := int64(defaultMaxSourceSize)
+	err := extractTar(gz, "/tmp/mantl-install-extract-test", &remaining)
+	assert.NotNil(t, err)
+}
+
+func TestArchiveFormat(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, "zip", archiveFormat("http://repo/universe.zip", ""))
+	assert.Equal(t, "zip", archiveFormat("http://repo/universe", "application/zip"))
+	assert.Equal(t, "tar", archiveFormat("http://repo/universe.tar?token=x", ""))
+	assert.Equal(t, "tar.gz", archiveFormat("http://repo/universe.tgz", ""))
+}
@@ -0,0 +1,215 @@
+package install
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// BundleManifest lists every Docker image and artifact that the supported
+// package versions of the catalog refer to with their default config.
+type BundleManifest struct {
+	Packages []*BundlePackage `json:"packages"`
+	Images   []string         `json:"images"`
+	URIs     []string         `json:"uris"`
+}
+
+type BundlePackage struct {
+	Name       string   `json:"name"`
+	Version    string   `json:"version"`
+	Repository string   `json:"repository"`
+	Index      string   `json:"index"`
+	Images     []string `json:"images"`
+	URIs       []string `json:"uris"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// ExportBundle writes the supported package versions of the synced catalog
+// to archive as a gzipped repository that can be synced as a source, and
+// returns the images and artifacts the packages need. Packages that can't
+// be rendered with their default config are exported with an error.
+func (install *Install) ExportBundle(archive io.Writer) (*BundleManifest, error) {
+	packages, err := install.getPackages()
+	if err != nil {
+		return nil, err
+	}
+
+	gz := gzip.NewWriter(archive)
+	tw := tar.NewWriter(gz)
+
+	manifest := &BundleManifest{Packages: []*BundlePackage{}}
+	images := make(map[string]bool)
+	uris := make(map[string]bool)
+
+	for _, pkg := range packages {
+		versions := pkg.SupportedVersions()
+		sort.Sort(sort.Reverse(packageVersionByMostRecent(versions)))
+
+		// versions from different repositories may share an index
+		used := make(map[string]bool)
+		for _, pv := range versions {
+			index := bundleIndex(used, pv.Index)
+			if err := install.exportPackageVersion(tw, pkg, pv, index); err != nil {
+				return nil, err
+			}
+
+			bundlePkg := &BundlePackage{
+				Name:       pkg.Name,
+				Version:    pv.Version,
+				Repository: pv.Repository,
+				Index:      index,
+				Images:     []string{},
+				URIs:       []string{},
+			}
+
+			pkgImages, pkgURIs, err := install.packageReferences(pkg.Name, pv)
+			if err != nil {
+				log.Warnf("Could not render %s %s: %v", pkg.Name, pv.Version, err)
+				bundlePkg.Error = err.Error()
+			}
+			for _, image := range pkgImages {
+				images[image] = true
+			}
+			for _, uri := range pkgURIs {
+				uris[uri] = true
+			}
+			bundlePkg.Images = append(bundlePkg.Images, pkgImages...)
+			bundlePkg.URIs = append(bundlePkg.URIs, pkgURIs...)
+
+			manifest.Packages = append(manifest.Packages, bundlePkg)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+
+	manifest.Images = sortedKeys(images)
+	manifest.URIs = sortedKeys(uris)
+	return manifest, nil
+}
+
+func (install *Install) exportPackageVersion(tw *tar.Writer, pkg *Package, pv *PackageVersion, index string) error {
+	kvps, _, err := install.kv.List(pv.key, nil)
+	if err != nil {
+		return err
+	}
+
+	dir := path.Join("repo", "packages", pkg.PackageVersionKey(index))
+	for _, kvp := range kvps {
+		name := strings.TrimPrefix(kvp.Key, pv.key)
+		if name == "" || strings.HasSuffix(name, "/") {
+			continue
+		}
+
+		header := &tar.Header{
+			Name:     path.Join(dir, name),
+			Mode:     0644,
+			Size:     int64(len(kvp.Value)),
+			ModTime:  time.Now(),
+			Typeflag: tar.TypeReg,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := tw.Write(kvp.Value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// packageReferences renders a package version with its default config and
+// returns the images and urls of its apps or pod and of its resources.
+func (install *Install) packageReferences(name string, pv *PackageVersion) ([]string, []string, error) {
+	images := make(map[string]bool)
+	uris := make(map[string]bool)
+	collect := func(field string, value string, image bool) string {
+		if image {
+			images[value] = true
+		} else {
+			uris[value] = true
+		}
+		return value
+	}
+
+	pkgDef, err := install.GetPackageDefinition(name, pv.Version, pv.Repository, nil, apiConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	// a bundle lists the original locations, which the mirrors are filled from
+	pkgDef.rewrites = Rewrites{}
+
+	if len(pkgDef.resourceJson) > 0 {
+		var resource interface{}
+		if err := json.Unmarshal(pkgDef.resourceJson, &resource); err == nil {
+			walkReferences(resource, "resource", false, collect)
+		}
+	}
+
+	marathonJson, err := pkgDef.MarathonAppJson()
+	if err != nil {
+		return sortedKeys(images), sortedKeys(uris), err
+	}
+
+	deployment, err := newPackageDeployment(marathonJson)
+	if err != nil {
+		return sortedKeys(images), sortedKeys(uris), err
+	}
+
+	for _, app := range deployment.apps() {
+		if app.Container != nil && app.Container.Docker != nil && app.Container.Docker.Image != "" {
+			images[app.Container.Docker.Image] = true
+		}
+		for _, uri := range app.Uris {
+			uris[uri] = true
+		}
+		for _, fetch := range app.Fetch {
+			uris[fetch.URI] = true
+		}
+		for _, url := range app.StoreUrls {
+			uris[url] = true
+		}
+	}
+	if deployment.Pod != nil {
+		podReferences(deployment.Pod, collect)
+	}
+
+	return sortedKeys(images), sortedKeys(uris), nil
+}
+
+// bundleIndex returns index, or the next free index when it is taken.
+func bundleIndex(used map[string]bool, index string) string {
+	if used[index] {
+		next := 0
+		for i := range used {
+			if n, err := strconv.Atoi(i); err == nil && n >= next {
+				next = n + 1
+			}
+		}
+		index = strconv.Itoa(next)
+	}
+	used[index] = true
+	return index
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,78 @@
+package install
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportBundle(t *testing.T) {
+	t.Parallel()
+	ts, _, inst := fakeConsul()
+	defer ts.Close()
+
+	kafka := func(version string, image string) map[string]string {
+		return map[string]string{
+			"repo/packages/K/kafka/0/package.json":  `{"name": "kafka", "version": "` + version + `"}`,
+			"repo/packages/K/kafka/0/config.json":   `{"type": "object", "properties": {}}`,
+			"repo/packages/K/kafka/0/mantl.json":    `{}`,
+			"repo/packages/K/kafka/0/resource.json": `{"assets": {"container": {"docker": {"kafka": "` + image + `"}}, "uris": {"scheduler": "https://downloads.example.com/kafka-` + version + `.tgz"}}}`,
+			"repo/packages/K/kafka/0/marathon.json": `{"id": "kafka", "container": {"docker": {"image": "{{resource.assets.container.docker.kafka}}"}}, "uris": ["{{resource.assets.uris.scheduler}}"]}`,
+		}
+	}
+	syncTestSource(t, inst, "mantl", 0, kafka("0.9.4.0", "mesosphere/kafka:0.9"))
+	syncTestSource(t, inst, "custom", 1, kafka("1.0.0", "mesosphere/kafka:1.0"))
+	syncTestSource(t, inst, "broken", 2, map[string]string{
+		"repo/packages/Z/zookeeper/0/package.json":  `{"name": "zookeeper", "version": "3.4"}`,
+		"repo/packages/Z/zookeeper/0/config.json":   `{"type": "object"}`,
+		"repo/packages/Z/zookeeper/0/mantl.json":    `{}`,
+		"repo/packages/Z/zookeeper/0/marathon.json": `{"id": "zookeeper", "instances": }`,
+	})
+
+	dir, err := ioutil.TempDir("", "mantl-install-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	archivePath := filepath.Join(dir, "repository.tar.gz")
+	archive, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := inst.ExportBundle(archive)
+	archive.Close()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, []string{"mesosphere/kafka:0.9", "mesosphere/kafka:1.0"}, manifest.Images)
+	assert.Equal(t, []string{"https://downloads.example.com/kafka-0.9.4.0.tgz", "https://downloads.example.com/kafka-1.0.0.tgz"}, manifest.URIs)
+	if assert.Len(t, manifest.Packages, 3) {
+		assert.Equal(t, "0", manifest.Packages[0].Index)
+		assert.Equal(t, "0.9.4.0", manifest.Packages[0].Version)
+		assert.Equal(t, "1", manifest.Packages[1].Index)
+		assert.Equal(t, "custom", manifest.Packages[1].Repository)
+		assert.Equal(t, []string{"mesosphere/kafka:1.0"}, manifest.Packages[1].Images)
+		assert.Equal(t, "zookeeper", manifest.Packages[2].Name)
+		assert.NotEmpty(t, manifest.Packages[2].Error)
+	}
+
+	// the archive is a repository of its own
+	ts2, _, offline := fakeConsul()
+	defer ts2.Close()
+
+	_, err = offline.syncSource(&Source{Name: "bundle", Path: archivePath, SourceType: FileSystem}, true, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	pkg, err := offline.getPackageByName("kafka")
+	if assert.NoError(t, err) && assert.NotNil(t, pkg) {
+		assert.Len(t, pkg.SupportedVersions(), 2)
+		assert.Equal(t, "1.0.0", pkg.CurrentVersion)
+	}
+}
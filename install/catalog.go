@@ -5,12 +5,19 @@ import (
 	log "github.com/Sirupsen/logrus"
 	consul "github.com/hashicorp/consul/api"
 	"sort"
+	"strconv"
 	"strings"
 )
 
 type packageCatalog struct {
-	catalog map[string]map[string]map[string]string
-	kv      *consul.KV
+	catalog      map[string]map[string]map[string]string
+	repositories map[string]*Repository
+	kv           *consul.KV
+}
+
+type catalogKey struct {
+	repository *Repository
+	key        string
 }
 
 func (c packageCatalog) names() []string {
@@ -22,8 +29,10 @@ func (c packageCatalog) names() []string {
 	return names
 }
 
-func (c packageCatalog) packageKeys() map[string][]string {
-	keys := make(map[string][]string)
+// packageKeys lists the keys of every version of each package, ordered by
+// repository precedence from lowest to highest.
+func (c packageCatalog) packageKeys() map[string][]catalogKey {
+	keys := make(map[string][]catalogKey)
 
 	for _, name := range c.names() {
 		keySlice := keys[name]
@@ -33,7 +42,7 @@ func (c packageCatalog) packageKeys() map[string][]string {
 		for repoIdx, _ := range repos {
 			repoIdxs = append(repoIdxs, repoIdx)
 		}
-		sort.Strings(repoIdxs)
+		sortIndexes(repoIdxs)
 
 		for _, repoIdx := range repoIdxs {
 			versions := c.catalog[name][repoIdx]
@@ -41,11 +50,11 @@ func (c packageCatalog) packageKeys() map[string][]string {
 			for verIdx, _ := range versions {
 				verIdxs = append(verIdxs, verIdx)
 			}
-			sort.Strings(verIdxs)
+			sortIndexes(verIdxs)
 
 			for _, verIdx := range verIdxs {
 				pkgKey := c.catalog[name][repoIdx][verIdx]
-				keySlice = append(keySlice, pkgKey)
+				keySlice = append(keySlice, catalogKey{c.repositories[repoIdx], pkgKey})
 			}
 		}
 
@@ -62,65 +71,50 @@ func (c packageCatalog) packagesIndex() (PackageCollection, error) {
 
 	for _, name := range c.names() {
 		pkg := NewPackage(name)
-		keys := keyMap[name]
-
-		supported := false
-		supportedVersions := make([]string, 0, len(keys))
 
-		for _, key := range keys {
-			versionIndex := packageVersionIndex(key)
+		for _, pvk := range keyMap[name] {
+			meta := c.packageMeta(pvk.key)
+			if meta == nil {
+				continue
+			}
 
-			supportedVersion := keyExists(key+"mantl.json", c.kv)
-			if supportedVersion {
-				supported = true
-				supportedVersions = append(supportedVersions, versionIndex)
+			version, ok := meta["version"].(string)
+			if !ok {
+				log.Warnf("Skipping %s: package.json has no version", pvk.key)
+				continue
 			}
 
-			meta := c.packageMeta(key)
-			if meta != nil {
-				if desc, ok := meta["description"]; ok {
-					pkg.Description = desc.(string)
-				}
-				if isFramework, ok := meta["framework"]; ok {
-					pkg.Framework = isFramework.(bool)
-				}
+			if desc, ok := meta["description"].(string); ok {
+				pkg.Description = desc
+			}
+			if isFramework, ok := meta["framework"].(bool); ok {
+				pkg.Framework = isFramework
+			}
 
-				if tagList, ok := meta["tags"].([]interface{}); ok {
-					tags := make([]string, len(tagList))
-					for i, tag := range tagList {
-						tags[i] = tag.(string)
+			if tagList, ok := meta["tags"].([]interface{}); ok {
+				tags := make([]string, 0, len(tagList))
+				for _, tag := range tagList {
+					if tag, ok := tag.(string); ok {
+						tags = append(tags, tag)
 					}
-					pkg.Tags = tags
-				}
-
-				version := meta["version"].(string)
-
-				pkgVersion := &PackageVersion{
-					Version: version,
-					Index:   versionIndex,
 				}
-				pkg.Versions[version] = pkgVersion
+				pkg.Tags = tags
 			}
-		}
-
-		pkg.Supported = supported
 
-		for _, sv := range supportedVersions {
-			for _, pv := range pkg.Versions {
-				if sv == pv.Index {
-					pv.Supported = true
-					pkg.CurrentVersion = pv.Version
-				}
+			pkgVersion := &PackageVersion{
+				Version:    version,
+				Index:      packageVersionIndex(pvk.key),
+				Supported:  keyExists(pvk.key+"mantl.json", c.kv),
+				Repository: pvk.repository.Name,
+				key:        pvk.key,
 			}
-		}
 
-		if pkg.CurrentVersion == "" {
-			latest := pkg.FindLatestPackageVersion()
-			if latest != nil {
-				pkg.CurrentVersion = latest.Version
-			}
+			// the same version in a repository with a higher index replaces
+			// the whole version rather than individual files
+			pkg.addVersion(pkgVersion)
 		}
 
+		pkg.setCurrentVersion()
 		packages = append(packages, pkg)
 	}
 
@@ -160,37 +154,42 @@ func keyExists(key string, kv *consul.KV) bool {
 	return kp != nil
 }
 
-func NewPackageCatalog(kv *consul.KV, repositoryRoot string) (*packageCatalog, error) {
-	catalog := &packageCatalog{kv: kv}
+func NewPackageCatalog(kv *consul.KV, repositories RepositoryCollection) (*packageCatalog, error) {
+	catalog := &packageCatalog{kv: kv, repositories: make(map[string]*Repository)}
 	pkgIndex := make(map[string]map[string]map[string]string)
 
-	keys, _, err := kv.Keys(repositoryRoot, "", nil)
-	if err != nil {
-		return nil, err
-	}
-	sort.Strings(keys)
-
-	// package key example: mantl-install/repository/0/repo/packages/S/spark/3/config.json
-	for _, key := range keys {
-		parts := strings.Split(key, "/")
-		if len(parts) == 9 {
-			repoIdx := parts[2]
-			name := parts[6]
-			verIdx := parts[7]
-			_, ok := pkgIndex[name]
-			if !ok {
-				pkgIndex[name] = make(map[string]map[string]string)
-			}
+	for _, repo := range repositories {
+		packagesKey := repo.PackagesKey() + "/"
+		keys, _, err := kv.Keys(packagesKey, "", nil)
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(keys)
 
-			_, ok = pkgIndex[name][repoIdx]
-			if !ok {
-				pkgIndex[name][repoIdx] = make(map[string]string)
-			}
+		repoIdx := strconv.Itoa(repo.Index)
+		catalog.repositories[repoIdx] = repo
 
-			_, ok = pkgIndex[name][repoIdx][verIdx]
-			if !ok {
-				pkgKey := key[0 : strings.LastIndex(key, "/")+1]
-				pkgIndex[name][repoIdx][verIdx] = pkgKey
+		// package key example: S/spark/3/config.json (relative to the packages key)
+		for _, key := range keys {
+			parts := strings.Split(strings.TrimPrefix(key, packagesKey), "/")
+			if len(parts) == 4 {
+				name := parts[1]
+				verIdx := parts[2]
+				_, ok := pkgIndex[name]
+				if !ok {
+					pkgIndex[name] = make(map[string]map[string]string)
+				}
+
+				_, ok = pkgIndex[name][repoIdx]
+				if !ok {
+					pkgIndex[name][repoIdx] = make(map[string]string)
+				}
+
+				_, ok = pkgIndex[name][repoIdx][verIdx]
+				if !ok {
+					pkgKey := key[0 : strings.LastIndex(key, "/")+1]
+					pkgIndex[name][repoIdx][verIdx] = pkgKey
+				}
 			}
 		}
 	}
@@ -0,0 +1,98 @@
+package install
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func syncTestSource(t *testing.T, inst *Install, name string, index int, files map[string]string) {
+	dir, err := ioutil.TempDir("", "mantl-install-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for rel, content := range files {
+		writeSourceFile(t, dir, rel, content)
+	}
+
+	source := &Source{Name: name, Path: dir, Index: index}
+	if err := inst.sync(source, dir, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCatalogRepositoryPrecedence(t *testing.T) {
+	t.Parallel()
+	ts, _, inst := fakeConsul()
+	defer ts.Close()
+
+	syncTestSource(t, inst, "mantl", 0, map[string]string{
+		"repo/packages/H/hdfs/0/package.json":  `{"name": "hdfs", "version": "0.1.0"}`,
+		"repo/packages/H/hdfs/1/package.json":  `{"name": "hdfs", "version": "0.2.0"}`,
+		"repo/packages/H/hdfs/1/config.json":   `{"type": "object"}`,
+		"repo/packages/H/hdfs/1/marathon.json": `{"id": "hdfs-mantl"}`,
+		"repo/packages/H/hdfs/1/mantl.json":    `{}`,
+	})
+	syncTestSource(t, inst, "custom", 1, map[string]string{
+		"repo/packages/H/hdfs/0/package.json":  `{"name": "hdfs", "version": "0.2.0"}`,
+		"repo/packages/H/hdfs/0/marathon.json": `{"id": "hdfs-custom"}`,
+	})
+
+	pkg, err := inst.getPackageByName("hdfs")
+	if !assert.Nil(t, err) || !assert.NotNil(t, pkg) {
+		return
+	}
+
+	assert.Equal(t, 2, len(pkg.Versions))
+	assert.Equal(t, "mantl", pkg.Versions["0.1.0"].Repository)
+	assert.Equal(t, "custom", pkg.Versions["0.2.0"].Repository)
+	assert.False(t, pkg.Versions["0.2.0"].Supported)
+	assert.Equal(t, "0.2.0", pkg.CurrentVersion)
+	assert.Equal(t, "custom", pkg.Repository)
+
+	// the custom version replaces the whole version, no files are merged in
+	def, err := inst.GetPackageDefinition("hdfs", "0.2.0", "", nil, nil)
+	if assert.Nil(t, err) {
+		assert.Equal(t, `{"id": "hdfs-custom"}`, string(def.marathonJson))
+		assert.Empty(t, def.configJson)
+		assert.False(t, def.IsValid())
+	}
+
+	def, err = inst.GetPackageDefinition("hdfs", "0.2.0", "mantl", nil, nil)
+	if assert.Nil(t, err) {
+		assert.Equal(t, `{"id": "hdfs-mantl"}`, string(def.marathonJson))
+		assert.Equal(t, "1", def.release)
+	}
+
+	_, err = inst.GetPackageDefinition("hdfs", "", "missing", nil, nil)
+	assert.NotNil(t, err)
+}
+
+func TestPackageFromRepository(t *testing.T) {
+	t.Parallel()
+	pkg := NewPackage("kafka")
+	pkg.addVersion(&PackageVersion{Version: "0.9.4.0", Index: "0", Repository: "mantl", Supported: true})
+	pkg.addVersion(&PackageVersion{Version: "0.9.5.0", Index: "1", Repository: "mantl"})
+	pkg.addVersion(&PackageVersion{Version: "0.9.5.0", Index: "0", Repository: "custom"})
+	pkg.setCurrentVersion()
+
+	assert.Equal(t, "0.9.4.0", pkg.CurrentVersion)
+	assert.Equal(t, "mantl", pkg.Repository)
+	assert.Equal(t, "custom", pkg.Versions["0.9.5.0"].Repository)
+
+	mantl, err := pkg.FromRepository("mantl")
+	if assert.Nil(t, err) {
+		assert.Equal(t, 2, len(mantl.Versions))
+		assert.Equal(t, "1", mantl.Versions["0.9.5.0"].Index)
+	}
+
+	custom, err := pkg.FromRepository("custom")
+	if assert.Nil(t, err) {
+		assert.Equal(t, "0.9.5.0", custom.CurrentVersion)
+		assert.False(t, custom.Supported)
+	}
+}
@@ -8,41 +8,178 @@ import (
 	"github.com/hashicorp/consul/api"
 )
 
-func (inst *Install) Watch(intervalSeconds time.Duration) {
-	ticker := time.NewTicker(intervalSeconds * time.Second)
+const (
+	watchMinBackoff = 1 * time.Second
+	watchMaxBackoff = 1 * time.Minute
+)
+
+type kvListResult struct {
+	kvps api.KVPairs
+	meta *api.QueryMeta
+	err  error
+}
+
+// Watch uses consul blocking queries to pick up package requests as soon as
+// they are written to AppsRoot. It returns when stop is closed.
+func (inst *Install) Watch(waitTime time.Duration, stop <-chan struct{}) {
 	kv := inst.consul.KV()
-	for _ = range ticker.C {
-		kvps, _, err := kv.List(AppsRoot, nil)
-		if err != nil {
-			log.Warnf("Could not retrieve %s keys: %v", AppsRoot, err)
+	var waitIndex uint64
+	backoff := watchMinBackoff
+
+	for {
+		results := make(chan kvListResult, 1)
+		go func(index uint64) {
+			kvps, meta, err := kv.List(AppsRoot, &api.QueryOptions{
+				WaitIndex: index,
+				WaitTime:  waitTime,
+			})
+			results <- kvListResult{kvps, meta, err}
+		}(waitIndex)
+
+		var result kvListResult
+		select {
+		case <-stop:
+			log.Debugf("Stopped watching %s", AppsRoot)
+			return
+		case result = <-results:
+		}
+
+		if result.err != nil {
+			log.Warnf("Could not retrieve %s keys (retrying in %v): %v", AppsRoot, backoff, result.err)
+			select {
+			case <-stop:
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > watchMaxBackoff {
+				backoff = watchMaxBackoff
+			}
 			continue
 		}
+		backoff = watchMinBackoff
 
-		for _, kvp := range kvps {
+		lastIndex := result.meta.LastIndex
+		if lastIndex < waitIndex {
+			// the index went backwards (e.g. consul was restored from a
+			// snapshot), so start over
+			waitIndex = 0
+			continue
+		}
+		// requests are processed even when the query timed out without
+		// changes so that failed requests are retried once they are due
+		waitIndex = lastIndex
+
+		for _, kvp := range result.kvps {
 			appName := strings.TrimPrefix(kvp.Key, AppsRoot)
 			if appName != "" {
-				inst.installPackageFromKVPair(kvp, kv)
+				inst.processKVRequest(kvp)
 			}
 		}
 	}
 }
 
-func (inst *Install) installPackageFromKVPair(kvp *api.KVPair, kv *api.KV) {
-	defer func() {
-		_, err := kv.Delete(kvp.Key, nil)
+func (inst *Install) processKVRequest(kvp *api.KVPair) {
+	name := strings.TrimPrefix(kvp.Key, AppsRoot)
+	status := inst.requestStatus(name, kvp)
+	switch {
+	case status.Status == RequestRetrying && time.Now().Before(status.NextAttempt):
+		return
+	case status.Status == RequestSucceeded || status.Status == RequestFailed:
+		// the request was finished but its key couldn't be deleted
+		inst.deleteRequest(kvp)
+		return
+	}
+
+	status.Attempts++
+	status.Updated = time.Now().UTC()
+
+	pkgReq, err := NewPackageRequest(kvp.Value)
+	if err != nil {
+		log.Warnf("Failed to parse package request from %s: %v", kvp.Key, err)
+		status.Error = err.Error()
+		inst.failRequest(kvp, status)
+		return
+	}
+	status.Action = pkgReq.Action
+
+	appID, version, err := inst.applyPackageRequest(pkgReq)
+	if err != nil {
+		log.Errorf("Failed to %s app from %s (attempt %d of %d): %v", pkgReq.Action, kvp.Key, status.Attempts, inst.RequestAttempts, err)
+		status.Error = err.Error()
+
+		// retrying won't help when the request doesn't match exactly one app
+		_, conflict := err.(*InstalledPackageError)
+		if conflict || status.Attempts >= inst.RequestAttempts {
+			inst.failRequest(kvp, status)
+		} else {
+			status.Status = RequestRetrying
+			status.NextAttempt = status.Updated.Add(requestRetryBackoff(status.Attempts))
+			inst.setRequestStatus(status)
+		}
+		return
+	}
+
+	status.Status = RequestSucceeded
+	status.AppID = appID
+	status.Version = version
+	status.Error = ""
+	status.NextAttempt = time.Time{}
+	inst.setRequestStatus(status)
+	inst.deleteRequest(kvp)
+}
+
+// applyPackageRequest returns the id of the app the request applied to and
+// the package version that was installed, upgraded to or uninstalled.
+func (inst *Install) applyPackageRequest(pkgReq *PackageRequest) (string, string, error) {
+	if pkgReq.Action == InstallAction {
+		response, version, err := inst.InstallPackage(pkgReq)
 		if err != nil {
-			log.Errorf("Could not delete %s key: %v", kvp.Key, err)
+			return "", "", err
 		}
-	}()
+		return marathonAppID(response), version, nil
+	}
 
-	pkgReq, err := NewPackageRequest(kvp.Value)
+	app, err := inst.FindInstalledApp(pkgReq)
 	if err != nil {
-		log.Warnf("Failed to parse package request from %s", kvp.Key)
+		return "", "", err
+	}
+
+	version := app.Labels[packageVersionKey]
+	switch pkgReq.Action {
+	case UninstallAction:
+		if !pkgReq.Force {
+			if err = inst.CheckDependents(app); err != nil {
+				return "", "", err
+			}
+		}
+		err = inst.UninstallPackage(app)
+	case UpgradeAction:
+		_, version, err = inst.UpgradePackage(pkgReq, app)
+	}
+
+	return app.ID, version, err
+}
+
+func (inst *Install) failRequest(kvp *api.KVPair, status *RequestStatus) {
+	status.Status = RequestFailed
+	status.NextAttempt = time.Time{}
+
+	failedKey := FailedRoot + status.Name
+	_, err := inst.kv.Put(&api.KVPair{Key: failedKey, Value: kvp.Value}, nil)
+	if err != nil {
+		// leave the request in place rather than lose it
+		log.Errorf("Could not move %s to %s: %v", kvp.Key, failedKey, err)
 		return
 	}
 
-	_, err = inst.InstallPackage(pkgReq)
+	inst.setRequestStatus(status)
+	inst.deleteRequest(kvp)
+}
+
+func (inst *Install) deleteRequest(kvp *api.KVPair) {
+	_, err := inst.kv.Delete(kvp.Key, nil)
 	if err != nil {
-		log.Errorf("Failed to install app from %s: %v", kvp.Key, err)
+		log.Errorf("Could not delete %s key: %v", kvp.Key, err)
 	}
 }
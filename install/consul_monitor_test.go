@@ -0,0 +1,433 @@
+package install
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/CiscoCloud/mantl-api/marathon"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeKV struct {
+	sync.Mutex
+	index    uint64
+	data     map[string][]byte
+	modified map[string]uint64
+	sessions map[string]string
+
+	// failDeletes makes deletes fail, like an unavailable consul
+	failDeletes bool
+}
+
+func (f *fakeKV) put(key string, value []byte) {
+	f.Lock()
+	defer f.Unlock()
+	f.set(key, value)
+}
+
+// set and deleteTree expect the lock to be held
+func (f *fakeKV) set(key string, value []byte) {
+	f.index++
+	f.data[key] = value
+	f.modified[key] = f.index
+}
+
+func (f *fakeKV) deleteTree(prefix string, recurse bool) {
+	for k := range f.data {
+		if k == prefix || (recurse && strings.HasPrefix(k, prefix)) {
+			delete(f.data, k)
+			delete(f.modified, k)
+		}
+	}
+	f.index++
+}
+
+func (f *fakeKV) get(key string) ([]byte, bool) {
+	f.Lock()
+	defer f.Unlock()
+	value, ok := f.data[key]
+	return value, ok
+}
+
+func (f *fakeKV) keys(prefix string) []string {
+	f.Lock()
+	defer f.Unlock()
+	var keys []string
+	for key := range f.data {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *fakeKV) txn(w http.ResponseWriter, r *http.Request) {
+	var ops consul.TxnOps
+	if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	for i, op := range ops {
+		what := ""
+		if op.KV.Verb == consul.KVCAS && f.modified[op.KV.Key] != op.KV.Index {
+			what = "failed CAS"
+		} else if op.KV.Verb == consul.KVCheckSession && f.sessions[op.KV.Key] != op.KV.Session {
+			what = "lock is not held"
+		}
+		if what != "" {
+			w.WriteHeader(409)
+			json.NewEncoder(w).Encode(&consul.TxnResponse{
+				Errors: consul.TxnErrors{&consul.TxnError{OpIndex: i, What: what}},
+			})
+			return
+		}
+	}
+
+	for _, op := range ops {
+		switch op.KV.Verb {
+		case string(consul.KVSet), consul.KVCAS:
+			f.set(op.KV.Key, op.KV.Value)
+		case consul.KVDelete:
+			f.deleteTree(op.KV.Key, false)
+		case consul.KVDeleteTree:
+			f.deleteTree(op.KV.Key, true)
+		}
+	}
+
+	json.NewEncoder(w).Encode(&consul.TxnResponse{})
+}
+
+func (f *fakeKV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/v1/txn" {
+		f.txn(w, r)
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	query := r.URL.Query()
+
+	switch r.Method {
+	case "PUT":
+		body, _ := ioutil.ReadAll(r.Body)
+		f.put(key, body)
+		fmt.Fprint(w, "true")
+	case "DELETE":
+		f.Lock()
+		if f.failDeletes {
+			f.Unlock()
+			w.WriteHeader(500)
+			return
+		}
+		_, recurse := query["recurse"]
+		f.deleteTree(key, recurse)
+		f.Unlock()
+		fmt.Fprint(w, "true")
+	case "GET":
+		// emulate a blocking query by waiting briefly for the index to move
+		if waitIndex, err := strconv.ParseUint(query.Get("index"), 10, 64); err == nil {
+			for i := 0; i < 20; i++ {
+				f.Lock()
+				index := f.index
+				f.Unlock()
+				if index > waitIndex {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+
+		f.Lock()
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+		f.Unlock()
+		w.Header().Set("X-Consul-LastContact", "0")
+		w.Header().Set("X-Consul-KnownLeader", "true")
+
+		_, recurse := query["recurse"]
+		_, keysOnly := query["keys"]
+		separator := query.Get("separator")
+		var matching []string
+		seen := make(map[string]bool)
+		for _, k := range f.keys(key) {
+			if !recurse && !keysOnly && k != key {
+				continue
+			}
+			if separator != "" {
+				if i := strings.Index(k[len(key):], separator); i >= 0 {
+					k = k[:len(key)+i+len(separator)]
+				}
+			}
+			if !seen[k] {
+				seen[k] = true
+				matching = append(matching, k)
+			}
+		}
+
+		if len(matching) == 0 {
+			w.WriteHeader(404)
+			return
+		}
+
+		if keysOnly {
+			json.NewEncoder(w).Encode(matching)
+			return
+		}
+
+		pairs := []*consul.KVPair{}
+		f.Lock()
+		for _, k := range matching {
+			pairs = append(pairs, &consul.KVPair{Key: k, Value: f.data[k], ModifyIndex: f.modified[k]})
+		}
+		f.Unlock()
+		json.NewEncoder(w).Encode(pairs)
+	}
+}
+
+func fakeConsul() (*httptest.Server, *fakeKV, *Install) {
+	kv := &fakeKV{index: 1, data: make(map[string][]byte), modified: make(map[string]uint64), sessions: make(map[string]string)}
+	ts := httptest.NewServer(kv)
+
+	config := consul.DefaultConfig()
+	config.Address = strings.TrimPrefix(ts.URL, "http://")
+	client, _ := consul.NewClient(config)
+
+	return ts, kv, &Install{consul: client, kv: client.KV(), RequestAttempts: defaultRequestAttempts}
+}
+
+func waitFor(condition func() bool) bool {
+	for i := 0; i < 100; i++ {
+		if condition() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestWatchProcessesRequests(t *testing.T) {
+	t.Parallel()
+	ts, kv, inst := fakeConsul()
+	defer ts.Close()
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		inst.Watch(time.Second, stop)
+		close(done)
+	}()
+
+	kv.put(AppsRoot+"invalid", []byte("{"))
+	assert.True(t, waitFor(func() bool {
+		return len(kv.keys(AppsRoot)) == 0
+	}))
+
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Watch did not stop")
+	}
+}
+
+func requestStatusFromKV(kv *fakeKV, name string) *RequestStatus {
+	value, ok := kv.get(StatusRoot + name)
+	if !ok {
+		return nil
+	}
+	status := &RequestStatus{}
+	json.Unmarshal(value, status)
+	return status
+}
+
+func TestInstallRequestUnparseable(t *testing.T) {
+	t.Parallel()
+	ts, kv, inst := fakeConsul()
+	defer ts.Close()
+	inst.RequestAttempts = 3
+
+	kv.put(AppsRoot+"broken", []byte("{"))
+	kvp, _, _ := inst.kv.Get(AppsRoot+"broken", nil)
+	inst.processKVRequest(kvp)
+
+	_, pending := kv.get(AppsRoot + "broken")
+	assert.False(t, pending)
+	failed, _ := kv.get(FailedRoot + "broken")
+	assert.Equal(t, "{", string(failed))
+
+	status := requestStatusFromKV(kv, "broken")
+	if assert.NotNil(t, status) {
+		assert.Equal(t, RequestFailed, status.Status)
+		assert.Equal(t, 1, status.Attempts)
+		assert.NotEmpty(t, status.Error)
+	}
+}
+
+func TestInstallRequestRetries(t *testing.T) {
+	t.Parallel()
+	ts, kv, inst := fakeConsul()
+	defer ts.Close()
+	inst.RequestAttempts = 2
+
+	kv.put(AppsRoot+"missing", []byte(`{"name": "missing"}`))
+	kvp, _, _ := inst.kv.Get(AppsRoot+"missing", nil)
+	inst.processKVRequest(kvp)
+
+	_, pending := kv.get(AppsRoot + "missing")
+	assert.True(t, pending)
+	status := requestStatusFromKV(kv, "missing")
+	if assert.NotNil(t, status) {
+		assert.Equal(t, RequestRetrying, status.Status)
+		assert.Equal(t, "Could not find missing package", status.Error)
+		assert.True(t, status.NextAttempt.After(status.Updated))
+	}
+
+	// not due yet
+	inst.processKVRequest(kvp)
+	assert.Equal(t, 1, requestStatusFromKV(kv, "missing").Attempts)
+
+	status.NextAttempt = time.Now().Add(-time.Second)
+	inst.setRequestStatus(status)
+	inst.processKVRequest(kvp)
+
+	_, pending = kv.get(AppsRoot + "missing")
+	assert.False(t, pending)
+	status = requestStatusFromKV(kv, "missing")
+	assert.Equal(t, RequestFailed, status.Status)
+	assert.Equal(t, 2, status.Attempts)
+}
+
+func TestRequestRetryBackoff(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, requestMinBackoff, requestRetryBackoff(1))
+	assert.Equal(t, 2*requestMinBackoff, requestRetryBackoff(2))
+	assert.Equal(t, requestMaxBackoff, requestRetryBackoff(20))
+}
+
+func TestUninstallRequestNotInstalled(t *testing.T) {
+	t.Parallel()
+	ts, kv, inst := fakeConsul()
+	defer ts.Close()
+
+	ms := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/pods" {
+			fmt.Fprint(w, `[]`)
+			return
+		}
+		fmt.Fprint(w, `{"apps": [{"id": "/kafka", "labels": {"MANTL_PACKAGE_NAME": "kafka"}}]}`)
+	}))
+	defer ms.Close()
+	inst.marathon, _ = marathon.NewMarathon(ms.URL, "", "", false)
+
+	kv.put(AppsRoot+"cassandra", []byte(`{"name": "cassandra", "action": "uninstall"}`))
+	kvp, _, _ := inst.kv.Get(AppsRoot+"cassandra", nil)
+	inst.processKVRequest(kvp)
+
+	status := requestStatusFromKV(kv, "cassandra")
+	if assert.NotNil(t, status) {
+		assert.Equal(t, UninstallAction, status.Action)
+		assert.Equal(t, RequestFailed, status.Status)
+		assert.Equal(t, 1, status.Attempts)
+		assert.Equal(t, "Package cassandra not found.", status.Error)
+	}
+	_, failed := kv.get(FailedRoot + "cassandra")
+	assert.True(t, failed)
+}
+
+func TestFinishedRequestIsNotRepeated(t *testing.T) {
+	t.Parallel()
+	ts, kv, inst := fakeConsul()
+	defer ts.Close()
+
+	var deletes int32
+	ms := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "DELETE":
+			atomic.AddInt32(&deletes, 1)
+			fmt.Fprint(w, `{"deploymentId": "1"}`)
+		case r.URL.Path == "/v2/pods":
+			fmt.Fprint(w, `[]`)
+		default:
+			fmt.Fprint(w, `{"apps": [{"id": "/kafka", "labels": {"MANTL_PACKAGE_NAME": "kafka"}}]}`)
+		}
+	}))
+	defer ms.Close()
+	inst.marathon, _ = marathon.NewMarathon(ms.URL, "", "", false)
+
+	kv.put(AppsRoot+"kafka", []byte(`{"name": "kafka", "action": "uninstall"}`))
+	kvp, _, _ := inst.kv.Get(AppsRoot+"kafka", nil)
+
+	kv.Lock()
+	kv.failDeletes = true
+	kv.Unlock()
+	inst.processKVRequest(kvp)
+
+	_, pending := kv.get(AppsRoot + "kafka")
+	assert.True(t, pending)
+	assert.Equal(t, RequestSucceeded, requestStatusFromKV(kv, "kafka").Status)
+
+	// the next pass only deletes the request
+	kv.Lock()
+	kv.failDeletes = false
+	kv.Unlock()
+	inst.processKVRequest(kvp)
+
+	_, pending = kv.get(AppsRoot + "kafka")
+	assert.False(t, pending)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&deletes))
+	assert.Equal(t, 1, requestStatusFromKV(kv, "kafka").Attempts)
+}
+
+func TestInstallRequestRecordsVersion(t *testing.T) {
+	t.Parallel()
+	ts, kv, inst := fakeConsul()
+	defer ts.Close()
+
+	syncTestSource(t, inst, "mantl", 0, map[string]string{
+		"repo/packages/K/kafka/0/package.json":  `{"name": "kafka", "version": "0.9.4.0"}`,
+		"repo/packages/K/kafka/0/config.json":   `{"type": "object"}`,
+		"repo/packages/K/kafka/0/marathon.json": `{"id": "/kafka", "apps": [{"id": "broker", "cmd": "kafka"}]}`,
+		"repo/packages/K/kafka/0/mantl.json":    `{}`,
+	})
+
+	ms := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/v2/groups":
+			// marathon doesn't return the labels of the apps of a group
+			fmt.Fprint(w, `{"version": "2016-01-01T00:00:00.000Z", "deploymentId": "1"}`)
+		case r.URL.Path == "/v2/pods":
+			fmt.Fprint(w, `[]`)
+		default:
+			fmt.Fprint(w, `{"apps": []}`)
+		}
+	}))
+	defer ms.Close()
+	inst.marathon, _ = marathon.NewMarathon(ms.URL, "", "", false)
+
+	_, version, err := inst.InstallPackage(&PackageRequest{Name: "kafka"})
+	assert.NoError(t, err)
+	assert.Equal(t, "0.9.4.0", version)
+
+	kv.put(AppsRoot+"kafka", []byte(`{"name": "kafka"}`))
+	kvp, _, _ := inst.kv.Get(AppsRoot+"kafka", nil)
+	inst.processKVRequest(kvp)
+
+	if status := requestStatusFromKV(kv, "kafka"); assert.NotNil(t, status) {
+		assert.Equal(t, RequestSucceeded, status.Status, status.Error)
+		assert.Equal(t, "0.9.4.0", status.Version)
+	}
+}
@@ -0,0 +1,251 @@
+package install
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/CiscoCloud/mantl-api/marathon"
+	log "github.com/Sirupsen/logrus"
+)
+
+const packageDependenciesKey = "MANTL_PACKAGE_DEPENDENCIES"
+
+type packageDependency struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+func (d packageDependency) String() string {
+	if d.Version == "" {
+		return d.Name
+	}
+	return fmt.Sprintf("%s (%s)", d.Name, d.Version)
+}
+
+// DependencyError is returned when a package can't be installed because
+// packages it depends on are missing or installed at a version that doesn't
+// satisfy it, or can't be uninstalled because installed packages depend on
+// it.
+type DependencyError struct {
+	Name         string
+	Missing      []string
+	Incompatible []string
+	Dependents   []string
+}
+
+func (e *DependencyError) Error() string {
+	if len(e.Dependents) > 0 {
+		return fmt.Sprintf("Package %s is required by installed packages: %s. Set force to uninstall it anyway.", e.Name, strings.Join(e.Dependents, ", "))
+	}
+	if len(e.Incompatible) > 0 {
+		return fmt.Sprintf("Package %s requires other versions of installed packages: %s. Upgrade them first.", e.Name, strings.Join(e.Incompatible, "; "))
+	}
+	return fmt.Sprintf("Package %s requires packages that are not installed: %s. Install them first or set installDependencies.", e.Name, strings.Join(e.Missing, ", "))
+}
+
+// Dependencies returns the packages this package depends on, from the
+// dependencies section of package.json and mantl.json. The section maps
+// package names to version constraints, or lists objects with a name and a
+// version. Dependencies in mantl.json override those in package.json.
+func (d packageDefinition) Dependencies() ([]packageDependency, error) {
+	byName := make(map[string]packageDependency)
+
+	var pkg map[string]interface{}
+	if len(d.packageJson) > 0 {
+		if err := json.Unmarshal(d.packageJson, &pkg); err != nil {
+			return nil, err
+		}
+		if err := parseDependencies(pkg["dependencies"], byName); err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid dependencies in package.json of %s: %v", d.name, err))
+		}
+	}
+
+	if len(d.optionsJson) > 0 {
+		options, err := d.renderOptions()
+		if err != nil {
+			return nil, err
+		}
+		if err := parseDependencies(options["dependencies"], byName); err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid dependencies in mantl.json of %s: %v", d.name, err))
+		}
+	}
+
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	dependencies := make([]packageDependency, len(names))
+	for i, name := range names {
+		dependencies[i] = byName[name]
+	}
+
+	return dependencies, nil
+}
+
+func parseDependencies(section interface{}, byName map[string]packageDependency) error {
+	switch deps := section.(type) {
+	case nil:
+	case map[string]interface{}:
+		for name, version := range deps {
+			v, ok := version.(string)
+			if !ok && version != nil {
+				return errors.New(fmt.Sprintf("version of %s must be a string", name))
+			}
+			byName[name] = packageDependency{Name: name, Version: v}
+		}
+	case []interface{}:
+		for _, dep := range deps {
+			m, ok := dep.(map[string]interface{})
+			if !ok {
+				return errors.New("dependencies must be objects with a name and a version")
+			}
+			name, _ := m["name"].(string)
+			version, _ := m["version"].(string)
+			if name == "" {
+				return errors.New("dependencies must have a name")
+			}
+			byName[name] = packageDependency{Name: name, Version: version}
+		}
+	default:
+		return errors.New("dependencies must be an object or an array")
+	}
+	return nil
+}
+
+// satisfiedBy reports whether an installed app of the dependency has a
+// version that matches its constraint.
+func (d packageDependency) satisfiedBy(apps []*marathon.App) bool {
+	if d.Version == "" {
+		return len(apps) > 0
+	}
+
+	constraint, err := parseVersionConstraint(d.Version)
+	for _, app := range apps {
+		version := app.Labels[packageVersionKey]
+		if strings.EqualFold(version, d.Version) || (err == nil && constraint.matches(version)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ensureDependencies checks that every dependency of the package is
+// installed. Missing dependencies are installed first when the request asks
+// for it, otherwise a DependencyError is returned. installing holds the
+// packages whose dependencies are being installed, to detect cycles.
+func (install *Install) ensureDependencies(pkgReq *PackageRequest, pkgDef *packageDefinition, installing map[string]bool) error {
+	dependencies, err := pkgDef.Dependencies()
+	if err != nil || len(dependencies) == 0 {
+		return err
+	}
+
+	installed, err := install.installedApps()
+	if err != nil {
+		return err
+	}
+
+	var missing []packageDependency
+	var incompatible []string
+	for _, dep := range dependencies {
+		apps := filterByPackageName(dep.Name, installed)
+		if dep.satisfiedBy(apps) {
+			continue
+		}
+
+		if len(apps) > 0 {
+			incompatible = append(incompatible, fmt.Sprintf("%s, found %s", dep, apps[0].Labels[packageVersionKey]))
+			continue
+		}
+		missing = append(missing, dep)
+	}
+
+	// installing dependencies can't fix these
+	if len(incompatible) > 0 {
+		return &DependencyError{Name: pkgDef.name, Incompatible: incompatible}
+	}
+
+	if len(missing) == 0 {
+		return nil
+	}
+
+	if !pkgReq.InstallDependencies {
+		names := make([]string, len(missing))
+		for i, dep := range missing {
+			names[i] = dep.String()
+		}
+		return &DependencyError{Name: pkgDef.name, Missing: names}
+	}
+
+	if installing == nil {
+		installing = make(map[string]bool)
+	}
+	installing[strings.ToLower(pkgDef.name)] = true
+
+	for _, dep := range missing {
+		if installing[strings.ToLower(dep.Name)] {
+			return errors.New(fmt.Sprintf("Circular dependency between %s and %s", pkgDef.name, dep.Name))
+		}
+
+		log.Infof("Installing %s, which %s depends on", dep, pkgDef.name)
+		depReq := &PackageRequest{
+			Action:              InstallAction,
+			Name:                dep.Name,
+			Version:             dep.Version,
+			InstallDependencies: true,
+		}
+		if _, _, err := install.installPackage(depReq, installing); err != nil {
+			return errors.New(fmt.Sprintf("Could not install %s, which %s depends on: %v", dep.Name, pkgDef.name, err))
+		}
+	}
+
+	return nil
+}
+
+// CheckDependents returns a DependencyError when installed packages depend
+// on the package of app and no other instance of that package is installed.
+func (install *Install) CheckDependents(app *marathon.App) error {
+	name := app.Labels[packageNameKey]
+	if name == "" {
+		return nil
+	}
+
+	installed, err := install.installedApps()
+	if err != nil {
+		return err
+	}
+
+	for _, other := range filterByPackageName(name, installed) {
+		if other.ID != app.ID {
+			// the remaining instance still satisfies the dependents
+			return nil
+		}
+	}
+
+	var dependents []string
+	for _, other := range filterPackages(installed) {
+		for _, dep := range strings.Split(other.Labels[packageDependenciesKey], ",") {
+			if dep != "" && strings.EqualFold(dep, name) {
+				dependents = append(dependents, fmt.Sprintf("%s (%s)", other.Labels[packageNameKey], other.ID))
+			}
+		}
+	}
+
+	if len(dependents) > 0 {
+		return &DependencyError{Name: name, Dependents: dependents}
+	}
+
+	return nil
+}
+
+func dependencyNames(dependencies []packageDependency) string {
+	names := make([]string, len(dependencies))
+	for i, dep := range dependencies {
+		names[i] = dep.Name
+	}
+	return strings.Join(names, ",")
+}
@@ -0,0 +1,113 @@
+package install
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/CiscoCloud/mantl-api/marathon"
+	"github.com/stretchr/testify/assert"
+)
+
+func marathonWithApps(t *testing.T, apps string) (*httptest.Server, *Install) {
+	ms := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/pods" {
+			fmt.Fprint(w, `[]`)
+			return
+		}
+		fmt.Fprintf(w, `{"apps": %s}`, apps)
+	}))
+	m, err := marathon.NewMarathon(ms.URL, "", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ms, &Install{marathon: m}
+}
+
+func TestPackageDependencies(t *testing.T) {
+	t.Parallel()
+	pkgDef := &packageDefinition{
+		name:        "kafka-manager",
+		packageJson: []byte(`{"name": "kafka-manager", "dependencies": {"kafka": "~0.9", "zookeeper": null}}`),
+		optionsJson: []byte(`{"dependencies": [{"name": "kafka", "version": ">=0.9.4"}], "kafka-manager": {"instances": 1}}`),
+		configJson:  []byte(`{"type": "object", "properties": {}}`),
+	}
+
+	deps, err := pkgDef.Dependencies()
+	assert.Nil(t, err)
+	assert.Equal(t, []packageDependency{
+		{Name: "kafka", Version: ">=0.9.4"},
+		{Name: "zookeeper"},
+	}, deps)
+
+	options, err := pkgDef.Options()
+	assert.Nil(t, err)
+	_, ok := options["dependencies"]
+	assert.False(t, ok)
+	assert.NotNil(t, options["kafka-manager"])
+}
+
+func TestInvalidPackageDependencies(t *testing.T) {
+	t.Parallel()
+	pkgDef := &packageDefinition{packageJson: []byte(`{"dependencies": "kafka"}`)}
+	_, err := pkgDef.Dependencies()
+	assert.NotNil(t, err)
+}
+
+func TestDependencySatisfiedBy(t *testing.T) {
+	t.Parallel()
+	apps := []*marathon.App{{ID: "/kafka", Labels: map[string]string{packageNameKey: "kafka", packageVersionKey: "0.9.4.0"}}}
+	assert.True(t, packageDependency{Name: "kafka"}.satisfiedBy(apps))
+	assert.True(t, packageDependency{Name: "kafka", Version: "~0.9"}.satisfiedBy(apps))
+	assert.True(t, packageDependency{Name: "kafka", Version: "0.9.4.0"}.satisfiedBy(apps))
+	assert.False(t, packageDependency{Name: "kafka", Version: ">=1.0"}.satisfiedBy(apps))
+	assert.False(t, packageDependency{Name: "kafka"}.satisfiedBy(nil))
+}
+
+func TestEnsureDependenciesRefusesMissing(t *testing.T) {
+	t.Parallel()
+	ms, inst := marathonWithApps(t, `[{"id": "/zookeeper", "labels": {"MANTL_PACKAGE_NAME": "zookeeper", "MANTL_PACKAGE_VERSION": "3.4"}}]`)
+	defer ms.Close()
+
+	pkgDef := &packageDefinition{
+		name:        "kafka-manager",
+		packageJson: []byte(`{"dependencies": {"kafka": "~0.9", "zookeeper": ""}}`),
+	}
+
+	err := inst.ensureDependencies(&PackageRequest{Name: "kafka-manager"}, pkgDef, nil)
+	if assert.IsType(t, &DependencyError{}, err) {
+		assert.Equal(t, []string{"kafka (~0.9)"}, err.(*DependencyError).Missing)
+	}
+
+	pkgDef.packageJson = []byte(`{"dependencies": {"zookeeper": ">=3.5"}}`)
+	err = inst.ensureDependencies(&PackageRequest{Name: "kafka-manager", InstallDependencies: true}, pkgDef, nil)
+	if assert.IsType(t, &DependencyError{}, err) {
+		assert.Equal(t, []string{"zookeeper (>=3.5), found 3.4"}, err.(*DependencyError).Incompatible)
+		assert.Equal(t, "Package kafka-manager requires other versions of installed packages: zookeeper (>=3.5), found 3.4. Upgrade them first.", err.Error())
+	}
+
+	pkgDef.packageJson = []byte(`{"dependencies": {"zookeeper": "~3.4"}}`)
+	assert.Nil(t, inst.ensureDependencies(&PackageRequest{Name: "kafka-manager"}, pkgDef, nil))
+}
+
+func TestCheckDependents(t *testing.T) {
+	t.Parallel()
+	ms, inst := marathonWithApps(t, `[
+		{"id": "/kafka", "labels": {"MANTL_PACKAGE_NAME": "kafka"}},
+		{"id": "/kafka-manager", "labels": {"MANTL_PACKAGE_NAME": "kafka-manager", "MANTL_PACKAGE_DEPENDENCIES": "kafka,zookeeper"}},
+		{"id": "/elasticsearch", "labels": {"MANTL_PACKAGE_NAME": "elasticsearch"}},
+		{"id": "/elasticsearch-2", "labels": {"MANTL_PACKAGE_NAME": "elasticsearch"}},
+		{"id": "/logstash", "labels": {"MANTL_PACKAGE_NAME": "logstash", "MANTL_PACKAGE_DEPENDENCIES": "elasticsearch"}}
+	]`)
+	defer ms.Close()
+
+	err := inst.CheckDependents(&marathon.App{ID: "/kafka", Labels: map[string]string{packageNameKey: "kafka"}})
+	if assert.IsType(t, &DependencyError{}, err) {
+		assert.Equal(t, []string{"kafka-manager (/kafka-manager)"}, err.(*DependencyError).Dependents)
+	}
+
+	// another instance still satisfies logstash
+	assert.Nil(t, inst.CheckDependents(&marathon.App{ID: "/elasticsearch", Labels: map[string]string{packageNameKey: "elasticsearch"}}))
+	assert.Nil(t, inst.CheckDependents(&marathon.App{ID: "/kafka-manager", Labels: map[string]string{packageNameKey: "kafka-manager"}}))
+}
@@ -0,0 +1,350 @@
+package install
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/CiscoCloud/mantl-api/marathon"
+	log "github.com/Sirupsen/logrus"
+)
+
+const packageKindKey = "MANTL_PACKAGE_KIND"
+const packageGroupKey = "MANTL_PACKAGE_GROUP"
+
+const (
+	appKind   = "app"
+	groupKind = "group"
+	podKind   = "pod"
+)
+
+// packageDeployment is what the marathon.json of a package renders to: a
+// single app, a group of apps, or a pod.
+type packageDeployment struct {
+	App   *marathon.App
+	Group *marathon.Group
+	Pod   *marathon.Pod
+}
+
+// newPackageDeployment decides between an app, a group and a pod by the
+// fields of the rendered json: groups have apps or groups, pods have
+// containers.
+func newPackageDeployment(marathonJson string) (*packageDeployment, error) {
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal([]byte(marathonJson), &fields); err != nil {
+		return nil, err
+	}
+
+	_, hasApps := fields["apps"]
+	_, hasGroups := fields["groups"]
+	_, hasContainers := fields["containers"]
+
+	deployment := &packageDeployment{}
+	var err error
+	switch {
+	case hasApps || hasGroups:
+		deployment.Group = &marathon.Group{}
+		err = json.Unmarshal([]byte(marathonJson), deployment.Group)
+	case hasContainers:
+		deployment.Pod = &marathon.Pod{}
+		err = json.Unmarshal([]byte(marathonJson), deployment.Pod)
+	default:
+		deployment.App = &marathon.App{}
+		err = json.Unmarshal([]byte(marathonJson), deployment.App)
+	}
+
+	return deployment, err
+}
+
+func (d *packageDeployment) ID() string {
+	switch {
+	case d.Group != nil:
+		return d.Group.ID
+	case d.Pod != nil:
+		return d.Pod.ID
+	}
+	return d.App.ID
+}
+
+func (d *packageDeployment) setID(id string) {
+	switch {
+	case d.Group != nil:
+		d.Group.ID = id
+		for _, app := range d.Group.AllApps() {
+			if _, ok := app.Labels[packageGroupKey]; ok {
+				app.Labels[packageGroupKey] = id
+			}
+		}
+	case d.Pod != nil:
+		d.Pod.ID = id
+	default:
+		d.App.ID = id
+	}
+}
+
+func (d *packageDeployment) kind() string {
+	switch {
+	case d.Group != nil:
+		return groupKind
+	case d.Pod != nil:
+		return podKind
+	}
+	return appKind
+}
+
+// apps returns the app, or every app of the group.
+func (d *packageDeployment) apps() []*marathon.App {
+	switch {
+	case d.Group != nil:
+		return d.Group.AllApps()
+	case d.Pod != nil:
+		return nil
+	}
+	return []*marathon.App{d.App}
+}
+
+// addLabels adds the MANTL_PACKAGE_* labels to the app, every app of the
+// group, or the pod. Groups can't have labels of their own, so their apps
+// also record the group they belong to.
+func (d *packageDeployment) addLabels(pkgDef *packageDefinition) error {
+	if d.Pod != nil {
+		labels, err := mantlLabels(d.Pod.Labels, pkgDef)
+		if err != nil {
+			return err
+		}
+		labels[packageKindKey] = podKind
+		d.Pod.Labels = labels
+		return nil
+	}
+
+	for _, app := range d.apps() {
+		if err := addMantlLabels(app, pkgDef); err != nil {
+			return err
+		}
+		if d.Group != nil {
+			app.Labels[packageKindKey] = groupKind
+			app.Labels[packageGroupKey] = d.Group.ID
+		}
+	}
+
+	return nil
+}
+
+func (d *packageDeployment) rewrite(pkgDef *packageDefinition) {
+	for _, app := range d.apps() {
+		pkgDef.rewriteApp(app)
+	}
+	if d.Pod != nil {
+		pkgDef.rewritePod(d.Pod)
+	}
+}
+
+// deployment renders the app, group or pod of a package with the labels
+// of the package and the configured rewrites.
+func (d packageDefinition) deployment() (*packageDeployment, error) {
+	marathonJson, err := d.MarathonAppJson()
+	if err != nil {
+		log.Errorf("Could not generate marathon json: %v", err)
+		return nil, err
+	}
+
+	deployment, err := newPackageDeployment(marathonJson)
+	if err != nil {
+		log.Errorf("Could not unmarshal marathon json: %v", err)
+		return nil, err
+	}
+
+	err = deployment.addLabels(&d)
+	if err != nil {
+		log.Errorf("Could not add labels to marathon json: %v", err)
+		return nil, err
+	}
+
+	deployment.rewrite(&d)
+
+	return deployment, nil
+}
+
+// redactedDeployment renders d again with Vault references in place of the
+// values they resolved to.
+func (d packageDefinition) redactedDeployment(deployment *packageDeployment) (*packageDeployment, error) {
+	if d.secrets == nil || len(d.secrets.values) == 0 {
+		return deployment, nil
+	}
+
+	redacted, err := d.redacted().deployment()
+	if err != nil {
+		return nil, err
+	}
+	redacted.setID(deployment.ID())
+	return redacted, nil
+}
+
+func (install *Install) createDeployment(d *packageDeployment) (string, error) {
+	switch {
+	case d.Group != nil:
+		return install.marathon.CreateGroup(d.Group)
+	case d.Pod != nil:
+		return install.marathon.CreatePod(d.Pod)
+	}
+	return install.marathon.CreateApp(d.App)
+}
+
+func (install *Install) updateDeployment(d *packageDeployment) (string, error) {
+	switch {
+	case d.Group != nil:
+		return install.marathon.UpdateGroup(d.Group)
+	case d.Pod != nil:
+		return install.marathon.UpdatePod(d.Pod)
+	}
+	return install.marathon.UpdateApp(d.App)
+}
+
+// destroyInstalled removes an installed package, which is the whole group
+// for packages that were deployed as a group.
+func (install *Install) destroyInstalled(app *marathon.App) (string, error) {
+	switch installedKind(app) {
+	case groupKind:
+		return install.marathon.DestroyGroup(app.ID)
+	case podKind:
+		return install.marathon.DestroyPod(app.ID)
+	}
+	return install.marathon.DestroyApp(app.ID)
+}
+
+func installedKind(app *marathon.App) string {
+	if kind := app.Labels[packageKindKey]; kind != "" {
+		return kind
+	}
+	return appKind
+}
+
+// checkUpgradeKind refuses upgrades that would turn an app into a group or
+// a pod, or the other way around, which Marathon can't do in place.
+func checkUpgradeKind(d *packageDeployment, installed *marathon.App) error {
+	if kind := installedKind(installed); kind != d.kind() {
+		return errors.New(fmt.Sprintf("Can't upgrade %s from a Marathon %s to a %s. Uninstall it first.", installed.ID, kind, d.kind()))
+	}
+	return nil
+}
+
+// installedPackages combines the apps of every package group into a single
+// app that stands for the group, and adds the pods of packages as apps.
+func installedPackages(apps []*marathon.App, pods []*marathon.Pod) []*marathon.App {
+	packages := []*marathon.App{}
+	groups := make(map[string]*marathon.App)
+
+	for _, app := range apps {
+		groupID := app.Labels[packageGroupKey]
+		if installedKind(app) != groupKind || groupID == "" {
+			packages = append(packages, app)
+			continue
+		}
+
+		groupID = path.Join("/", groupID)
+		if _, ok := groups[groupID]; ok {
+			continue
+		}
+
+		labels := make(map[string]string)
+		for k, v := range app.Labels {
+			labels[k] = v
+		}
+		group := &marathon.App{ID: groupID, Labels: labels, Version: app.Version}
+		groups[groupID] = group
+		packages = append(packages, group)
+	}
+
+	for _, pod := range pods {
+		if _, ok := pod.Labels[packageNameKey]; !ok {
+			continue
+		}
+
+		labels := make(map[string]string)
+		for k, v := range pod.Labels {
+			labels[k] = v
+		}
+		labels[packageKindKey] = podKind
+		packages = append(packages, &marathon.App{ID: path.Join("/", pod.ID), Labels: labels})
+	}
+
+	return packages
+}
+
+// rewritePod rewrites the images and artifact uris of the containers of a
+// pod.
+func (d packageDefinition) rewritePod(pod *marathon.Pod) {
+	if d.rewrites.IsEmpty() {
+		return
+	}
+
+	podReferences(pod, func(field string, value string, image bool) string {
+		rewrite := d.rewrites.URL
+		if image {
+			rewrite = d.rewrites.Image
+		}
+		if rewritten, ok := rewrite(value); ok {
+			d.applied.add(field, value, rewritten)
+			return rewritten
+		}
+		return value
+	})
+}
+
+// podReferences calls fn with the Docker image and the artifact uris of
+// every container of a pod and replaces them with its result.
+func podReferences(pod *marathon.Pod, fn func(field string, value string, image bool) string) {
+	containers, _ := pod.Spec["containers"].([]interface{})
+	for i, c := range containers {
+		container, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		if image, ok := container["image"].(map[string]interface{}); ok {
+			kind, _ := image["kind"].(string)
+			if id, ok := image["id"].(string); ok && id != "" && (kind == "" || strings.EqualFold(kind, "DOCKER")) {
+				image["id"] = fn(fmt.Sprintf("containers.%d.image.id", i), id, true)
+			}
+		}
+
+		artifacts, _ := container["artifacts"].([]interface{})
+		for j, a := range artifacts {
+			artifact, ok := a.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if uri, ok := artifact["uri"].(string); ok && uri != "" {
+				artifact["uri"] = fn(fmt.Sprintf("containers.%d.artifacts.%d.uri", i, j), uri, false)
+			}
+		}
+	}
+}
+
+// definition returns the app, group or pod as it is submitted to Marathon.
+func (d *packageDeployment) definition() interface{} {
+	switch {
+	case d.Group != nil:
+		return d.Group
+	case d.Pod != nil:
+		return d.Pod
+	}
+	return d.App
+}
+
+func logDeployment(action string, d *packageDeployment, pkgDef *packageDefinition) {
+	redacted, err := pkgDef.redactedDeployment(d)
+	if err != nil {
+		log.Warnf("Could not redact %s %s: %v", d.kind(), d.ID(), err)
+		return
+	}
+
+	blob, err := json.Marshal(redacted.definition())
+	if err != nil {
+		log.Warnf("Could not marshal %s %s: %v", d.kind(), d.ID(), err)
+		return
+	}
+	log.Debugf("%s %s to marathon: %s", action, d.kind(), string(blob))
+}
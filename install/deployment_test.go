@@ -0,0 +1,117 @@
+package install
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/CiscoCloud/mantl-api/marathon"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewPackageDeployment(t *testing.T) {
+	t.Parallel()
+
+	d, err := newPackageDeployment(`{"id": "/kafka", "cpus": 1}`)
+	if assert.NoError(t, err) {
+		assert.Equal(t, appKind, d.kind())
+		assert.Equal(t, "/kafka", d.ID())
+	}
+
+	d, err = newPackageDeployment(`{"id": "/stack", "apps": [{"id": "api"}, {"id": "worker"}]}`)
+	if assert.NoError(t, err) {
+		assert.Equal(t, groupKind, d.kind())
+		assert.Len(t, d.apps(), 2)
+	}
+
+	d, err = newPackageDeployment(`{"id": "/web", "containers": [{"name": "nginx", "image": {"kind": "DOCKER", "id": "nginx:1.11"}}]}`)
+	if assert.NoError(t, err) {
+		assert.Equal(t, podKind, d.kind())
+		assert.Empty(t, d.apps())
+	}
+}
+
+func TestGroupLabels(t *testing.T) {
+	t.Parallel()
+	pkgDef := &packageDefinition{
+		name:        "stack",
+		version:     "1.0",
+		release:     "0",
+		packageJson: []byte(`{"name": "stack"}`),
+		configJson:  []byte(`{"type": "object", "properties": {}}`),
+	}
+
+	d, _ := newPackageDeployment(`{"id": "/stack", "apps": [{"id": "api"}], "groups": [{"id": "db", "apps": [{"id": "primary"}]}]}`)
+	assert.NoError(t, d.addLabels(pkgDef))
+	for _, app := range d.apps() {
+		assert.Equal(t, "stack", app.Labels[packageNameKey])
+		assert.Equal(t, groupKind, app.Labels[packageKindKey])
+		assert.Equal(t, "/stack", app.Labels[packageGroupKey])
+	}
+
+	d.setID("/stack-2")
+	assert.Equal(t, "/stack-2", d.apps()[1].Labels[packageGroupKey])
+
+	err := checkUpgradeKind(d, &marathon.App{ID: "/stack", Labels: map[string]string{packageNameKey: "stack"}})
+	assert.EqualError(t, err, "Can't upgrade /stack from a Marathon app to a group. Uninstall it first.")
+}
+
+func TestInstalledGroupsAndPods(t *testing.T) {
+	t.Parallel()
+
+	var deleted []string
+	ms := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "DELETE":
+			deleted = append(deleted, r.URL.Path)
+			fmt.Fprint(w, `{}`)
+		case r.URL.Path == "/v2/pods":
+			fmt.Fprint(w, `[
+				{"id": "/web", "labels": {"MANTL_PACKAGE_NAME": "web", "MANTL_PACKAGE_KIND": "pod"}, "containers": []},
+				{"id": "/other", "containers": []}
+			]`)
+		default:
+			fmt.Fprint(w, `{"apps": [
+				{"id": "/kafka", "labels": {"MANTL_PACKAGE_NAME": "kafka"}},
+				{"id": "/stack/api", "labels": {"MANTL_PACKAGE_NAME": "stack", "MANTL_PACKAGE_KIND": "group", "MANTL_PACKAGE_GROUP": "/stack"}},
+				{"id": "/stack/db/primary", "labels": {"MANTL_PACKAGE_NAME": "stack", "MANTL_PACKAGE_KIND": "group", "MANTL_PACKAGE_GROUP": "/stack"}}
+			]}`)
+		}
+	}))
+	defer ms.Close()
+	m, _ := marathon.NewMarathon(ms.URL, "", "", false)
+	inst := &Install{marathon: m}
+
+	stack, err := inst.FindInstalledApp(&PackageRequest{Name: "stack"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "/stack", stack.ID)
+
+	web, err := inst.FindInstalledApp(&PackageRequest{Name: "web"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "/web", web.ID)
+
+	installed, err := inst.installedApps()
+	assert.NoError(t, err)
+	assert.Len(t, filterPackages(installed), 3)
+
+	assert.NoError(t, inst.UninstallPackage(stack))
+	assert.NoError(t, inst.UninstallPackage(web))
+	assert.Equal(t, []string{"/v2/groups/stack", "/v2/pods/web"}, deleted)
+}
+
+func TestRewritePod(t *testing.T) {
+	t.Parallel()
+
+	pkgDef := packageDefinition{rewrites: testRewrites, applied: &appliedRewrites{}}
+	d, _ := newPackageDeployment(`{"id": "/web", "containers": [{"name": "nginx", "image": {"kind": "DOCKER", "id": "nginx:1.11"}, "artifacts": [{"uri": "https://downloads.mesosphere.com/web/config.tgz"}]}]}`)
+	d.rewrite(&pkgDef)
+
+	container := d.Pod.Spec["containers"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "registry.example.com/library/nginx:1.11", container["image"].(map[string]interface{})["id"])
+	assert.Equal(t, "http://mirror.example.com/mesosphere/web/config.tgz", container["artifacts"].([]interface{})[0].(map[string]interface{})["uri"])
+}
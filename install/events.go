@@ -0,0 +1,68 @@
+package install
+
+import (
+	"path"
+
+	"github.com/CiscoCloud/mantl-api/marathon"
+	log "github.com/Sirupsen/logrus"
+)
+
+// TrackDeployments logs the outcome of the Marathon deployments of
+// packages as they are reported on sub. It returns when stop is closed.
+func (install *Install) TrackDeployments(sub *marathon.Subscription, stop <-chan struct{}) {
+	defer sub.Unsubscribe()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case event, ok := <-sub.Events:
+			if !ok {
+				return
+			}
+			trackDeployment(event)
+		}
+	}
+}
+
+func trackDeployment(event *marathon.Event) {
+	if event.Deployment == nil {
+		return
+	}
+
+	for _, pkg := range deployedPackages(event.Deployment.Plan) {
+		name := pkg.Labels[packageNameKey]
+		version := pkg.Labels[packageVersionKey]
+		switch event.Type {
+		case marathon.EventDeploymentSuccess:
+			log.Infof("Deployed %s package %s as %s", name, version, pkg.ID)
+		case marathon.EventDeploymentFailed:
+			if reason := event.Deployment.Reason; reason != "" {
+				log.Errorf("Deployment of %s package %s as %s failed: %s", name, version, pkg.ID, reason)
+			} else {
+				log.Errorf("Deployment of %s package %s as %s failed", name, version, pkg.ID)
+			}
+		}
+	}
+}
+
+// deployedPackages returns the package apps that a deployment changes,
+// with a single app standing for each package group.
+func deployedPackages(plan *marathon.DeploymentPlan) []*marathon.App {
+	if plan == nil || plan.Target == nil {
+		return nil
+	}
+
+	affected := make(map[string]bool)
+	for _, id := range plan.AffectedApps() {
+		affected[path.Join("/", id)] = true
+	}
+
+	apps := []*marathon.App{}
+	for _, app := range plan.Target.AllApps() {
+		if _, ok := app.Labels[packageNameKey]; ok && affected[path.Join("/", app.ID)] {
+			apps = append(apps, app)
+		}
+	}
+	return installedPackages(apps, nil)
+}
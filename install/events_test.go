@@ -0,0 +1,123 @@
+package install
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/CiscoCloud/mantl-api/marathon"
+	log "github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// messageHook records log messages. It is added before the tests run, as
+// hooks can't be added while other tests are logging.
+type messageHook struct {
+	sync.Mutex
+	messages []string
+}
+
+func (h *messageHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *messageHook) Fire(entry *log.Entry) error {
+	h.Lock()
+	defer h.Unlock()
+	h.messages = append(h.messages, entry.Message)
+	return nil
+}
+
+func (h *messageHook) logged(prefix string) bool {
+	h.Lock()
+	defer h.Unlock()
+	for _, message := range h.messages {
+		if strings.HasPrefix(message, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+var logHook = &messageHook{}
+
+func init() {
+	log.AddHook(logHook)
+}
+
+func TestDeployedPackages(t *testing.T) {
+	t.Parallel()
+	plan := &marathon.DeploymentPlan{
+		Target: &marathon.Group{
+			ID: "/",
+			Apps: []*marathon.App{
+				{ID: "/kafka", Labels: map[string]string{packageNameKey: "kafka", packageVersionKey: "0.9.0"}},
+				{ID: "/unrelated", Labels: map[string]string{}},
+				{ID: "/idle", Labels: map[string]string{packageNameKey: "idle"}},
+			},
+			Groups: []*marathon.Group{
+				{
+					ID: "/stack",
+					Apps: []*marathon.App{
+						{ID: "/stack/api", Labels: map[string]string{packageNameKey: "stack", packageKindKey: groupKind, packageGroupKey: "/stack"}},
+						{ID: "/stack/db", Labels: map[string]string{packageNameKey: "stack", packageKindKey: groupKind, packageGroupKey: "/stack"}},
+					},
+				},
+			},
+		},
+		Steps: []*marathon.DeploymentStep{
+			{Actions: []*marathon.DeploymentAction{{Action: "StartApplication", App: "/kafka"}, {Action: "StartApplication", App: "/unrelated"}}},
+			{Actions: []*marathon.DeploymentAction{{Action: "StartApplication", App: "/stack/api"}, {Action: "StartApplication", App: "/stack/db"}}},
+		},
+	}
+
+	ids := []string{}
+	for _, app := range deployedPackages(plan) {
+		ids = append(ids, app.ID)
+	}
+	assert.Equal(t, []string{"/kafka", "/stack"}, ids)
+
+	assert.Empty(t, deployedPackages(nil))
+}
+
+func TestTrackDeployments(t *testing.T) {
+	t.Parallel()
+	ms := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "event_type=deployment_success&event_type=deployment_failed", r.URL.RawQuery)
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: deployment_failed\n")
+		fmt.Fprint(w, `data: {"eventType":"deployment_failed","id":"2","reason":"task failed","plan":{"id":"2","target":{"id":"/","apps":[`+
+			`{"id":"/track-kafka","labels":{"MANTL_PACKAGE_NAME":"track-kafka","MANTL_PACKAGE_VERSION":"0.9.0"}}]},`+
+			`"steps":[{"actions":[{"action":"StartApplication","app":"/track-kafka"}]}]}}`+"\n\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer ms.Close()
+	client, _ := marathon.NewMarathon(ms.URL, "", "", false)
+
+	inst := &Install{Events: marathon.NewEventStream(client, marathon.EventDeploymentSuccess, marathon.EventDeploymentFailed)}
+	deployments := inst.Events.Subscribe(marathon.EventDeploymentSuccess, marathon.EventDeploymentFailed)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		inst.TrackDeployments(deployments, stop)
+		close(done)
+	}()
+	go inst.Events.Run(stop)
+
+	assert.True(t, waitFor(func() bool {
+		return logHook.logged("Deployment of track-kafka package 0.9.0 as /track-kafka failed: task failed")
+	}))
+
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("TrackDeployments did not stop")
+	}
+}
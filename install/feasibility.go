@@ -0,0 +1,439 @@
+package install
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/CiscoCloud/mantl-api/marathon"
+	"github.com/CiscoCloud/mantl-api/mesos"
+	log "github.com/Sirupsen/logrus"
+)
+
+// FeasibilityError is returned when no combination of Mesos agents can run
+// all instances of an app, so its deployment would never finish.
+type FeasibilityError struct {
+	AppID   string
+	Reasons []string
+}
+
+func (e *FeasibilityError) Error() string {
+	return fmt.Sprintf("%s can't be deployed on this cluster: %s. Set force to install it anyway.", e.AppID, strings.Join(e.Reasons, "; "))
+}
+
+type agentRequirement struct {
+	description string
+	satisfied   func(*mesos.Slave) bool
+}
+
+// taskRequirements are the resources and placement of the instances of an
+// app or pod.
+type taskRequirements struct {
+	id          string
+	instances   int
+	cpus        float64
+	mem         float64
+	disk        float64
+	ports       int   // host ports per instance, fixed or random
+	fixedPorts  []int // host ports that must be offered as they are
+	constraints [][]string
+}
+
+// appTask returns the requirements of an app. Host ports come from the
+// Docker port mappings of bridged and user networks, and from the port
+// definitions, or ports, otherwise.
+func appTask(app *marathon.App) *taskRequirements {
+	task := &taskRequirements{
+		id:          app.ID,
+		instances:   app.Instances,
+		cpus:        app.CPUs,
+		mem:         app.Mem,
+		disk:        app.Disk,
+		constraints: app.Constraints,
+	}
+
+	var docker *marathon.Docker
+	if app.Container != nil {
+		docker = app.Container.Docker
+	}
+	network := ""
+	if docker != nil {
+		network = strings.ToUpper(docker.Network)
+	}
+
+	switch {
+	case (network == "BRIDGE" || network == "USER") && len(docker.PortMappings) > 0:
+		for _, mapping := range docker.PortMappings {
+			// bridged containers get a random host port for a zero host
+			// port, user networks don't use a host port at all
+			if mapping.HostPort != 0 || network == "BRIDGE" {
+				task.ports++
+			}
+			if mapping.HostPort != 0 {
+				task.fixedPorts = append(task.fixedPorts, mapping.HostPort)
+			}
+		}
+	case len(app.PortDefinitions) > 0:
+		for _, definition := range app.PortDefinitions {
+			task.ports++
+			if app.RequirePorts && definition.Port != 0 {
+				task.fixedPorts = append(task.fixedPorts, definition.Port)
+			}
+		}
+	default:
+		for _, port := range app.Ports {
+			task.ports++
+			if app.RequirePorts && port != 0 {
+				task.fixedPorts = append(task.fixedPorts, port)
+			}
+		}
+	}
+
+	return task
+}
+
+// podTask returns the requirements of a pod: the sum of the resources of its
+// containers, and the host ports of their endpoints.
+func podTask(pod *marathon.Pod) *taskRequirements {
+	task := &taskRequirements{id: pod.ID, instances: 1}
+
+	if scaling, ok := pod.Spec["scaling"].(map[string]interface{}); ok {
+		if instances, ok := scaling["instances"].(float64); ok {
+			task.instances = int(instances)
+		}
+	}
+
+	hostNetwork := true
+	if networks, ok := pod.Spec["networks"].([]interface{}); ok && len(networks) > 0 {
+		if network, ok := networks[0].(map[string]interface{}); ok {
+			mode, _ := network["mode"].(string)
+			hostNetwork = mode == "" || mode == "host"
+		}
+	}
+
+	containers, _ := pod.Spec["containers"].([]interface{})
+	for _, c := range containers {
+		container, _ := c.(map[string]interface{})
+
+		if resources, ok := container["resources"].(map[string]interface{}); ok {
+			cpus, _ := resources["cpus"].(float64)
+			mem, _ := resources["mem"].(float64)
+			disk, _ := resources["disk"].(float64)
+			task.cpus += cpus
+			task.mem += mem
+			task.disk += disk
+		}
+
+		endpoints, _ := container["endpoints"].([]interface{})
+		for _, e := range endpoints {
+			endpoint, _ := e.(map[string]interface{})
+			hostPort, hasHostPort := endpoint["hostPort"].(float64)
+			// container networks only use a host port when one is asked for
+			if hasHostPort || hostNetwork {
+				task.ports++
+			}
+			if hostPort != 0 {
+				task.fixedPorts = append(task.fixedPorts, int(hostPort))
+			}
+		}
+	}
+
+	if scheduling, ok := pod.Spec["scheduling"].(map[string]interface{}); ok {
+		if placement, ok := scheduling["placement"].(map[string]interface{}); ok {
+			constraints, _ := placement["constraints"].([]interface{})
+			for _, c := range constraints {
+				constraint, _ := c.(map[string]interface{})
+				field, _ := constraint["fieldName"].(string)
+				operator, _ := constraint["operator"].(string)
+				parts := []string{field, operator}
+				if value, ok := constraint["value"].(string); ok {
+					parts = append(parts, value)
+				}
+				task.constraints = append(task.constraints, parts)
+			}
+		}
+	}
+
+	return task
+}
+
+// checkFeasibility compares the resources, ports and constraints of a task
+// with the total resources and attributes of the active Mesos agents.
+// Resources in use are not considered: the check only rejects apps and pods
+// that could never be deployed.
+func (install *Install) checkFeasibility(task *taskRequirements) error {
+	if install.mesos == nil {
+		return nil
+	}
+
+	agents, err := install.mesos.Slaves()
+	if err != nil {
+		// don't block installs when mesos can't be reached
+		log.Warnf("Could not retrieve Mesos agents to check whether %s can be deployed: %v", task.id, err)
+		return nil
+	}
+
+	return taskFeasibility(task, agents)
+}
+
+// checkDeploymentFeasibility checks the pod, or every app, of a package.
+func (install *Install) checkDeploymentFeasibility(d *packageDeployment) error {
+	if d.Pod != nil {
+		return install.checkFeasibility(podTask(d.Pod))
+	}
+
+	for _, app := range d.apps() {
+		if err := install.checkFeasibility(appTask(app)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appFeasibility(app *marathon.App, agents []*mesos.Slave) error {
+	return taskFeasibility(appTask(app), agents)
+}
+
+func taskFeasibility(task *taskRequirements, agents []*mesos.Slave) error {
+	instances := task.instances
+	if instances == 0 {
+		// marathon's default
+		instances = 1
+	}
+
+	requirements, err := agentRequirements(task)
+	if err != nil {
+		return &FeasibilityError{AppID: task.id, Reasons: []string{err.Error()}}
+	}
+
+	if len(agents) == 0 {
+		return &FeasibilityError{AppID: task.id, Reasons: []string{"there are no active Mesos agents"}}
+	}
+	// agents that satisfy every requirement, and how many instances fit on
+	// each of them
+	capacity := make(map[*mesos.Slave]int)
+	var reasons []string
+	for _, req := range requirements {
+		failed := 0
+		for _, agent := range agents {
+			if !req.satisfied(agent) {
+				failed++
+			}
+		}
+		if failed > 0 {
+			reasons = append(reasons, fmt.Sprintf("%d of %d agents don't %s", failed, len(agents), req.description))
+		}
+	}
+
+	for _, agent := range agents {
+		eligible := true
+		for _, req := range requirements {
+			if !req.satisfied(agent) {
+				eligible = false
+				break
+			}
+		}
+		if eligible {
+			capacity[agent] = agentCapacity(task, agent, instances)
+		}
+	}
+
+	if len(capacity) == 0 {
+		return &FeasibilityError{AppID: task.id, Reasons: append([]string{"no agent can run an instance"}, reasons...)}
+	}
+
+	total := 0
+	for _, c := range capacity {
+		total += c
+	}
+	if total < instances {
+		reasons = append([]string{fmt.Sprintf("only %d of %d instances fit on the agents", total, instances)}, reasons...)
+		return &FeasibilityError{AppID: task.id, Reasons: reasons}
+	}
+
+	for _, constraint := range task.constraints {
+		if len(constraint) < 2 {
+			continue
+		}
+
+		field, operator := constraint[0], strings.ToUpper(constraint[1])
+		perValue := 0
+		switch operator {
+		case "UNIQUE":
+			perValue = 1
+		case "MAX_PER":
+			if len(constraint) > 2 {
+				perValue, _ = strconv.Atoi(constraint[2])
+			}
+		}
+		if perValue <= 0 {
+			continue
+		}
+
+		byValue := make(map[string]int)
+		for agent, c := range capacity {
+			value, _ := agent.Attribute(field)
+			byValue[value] += c
+		}
+
+		placeable := 0
+		for _, c := range byValue {
+			if c > perValue {
+				c = perValue
+			}
+			placeable += c
+		}
+
+		if placeable < instances {
+			reasons = append([]string{fmt.Sprintf("constraint %s allows only %d of %d instances on %d distinct %s values", strings.Join(constraint, ":"), placeable, instances, len(byValue), field)}, reasons...)
+			return &FeasibilityError{AppID: task.id, Reasons: reasons}
+		}
+	}
+
+	return nil
+}
+
+// agentRequirements are the conditions an agent must meet to run a single
+// instance of a task.
+func agentRequirements(task *taskRequirements) ([]agentRequirement, error) {
+	var requirements []agentRequirement
+
+	if task.cpus > 0 {
+		requirements = append(requirements, agentRequirement{
+			fmt.Sprintf("have %g cpus", task.cpus),
+			func(a *mesos.Slave) bool { return a.Resources.CPUs >= task.cpus },
+		})
+	}
+	if task.mem > 0 {
+		requirements = append(requirements, agentRequirement{
+			fmt.Sprintf("have %g MB of memory", task.mem),
+			func(a *mesos.Slave) bool { return a.Resources.Mem >= task.mem },
+		})
+	}
+	if task.disk > 0 {
+		requirements = append(requirements, agentRequirement{
+			fmt.Sprintf("have %g MB of disk", task.disk),
+			func(a *mesos.Slave) bool { return a.Resources.Disk >= task.disk },
+		})
+	}
+
+	if task.ports > 0 {
+		requirements = append(requirements, agentRequirement{
+			fmt.Sprintf("offer %d ports", task.ports),
+			func(a *mesos.Slave) bool { return portCount(a) >= task.ports },
+		})
+	}
+
+	for _, port := range task.fixedPorts {
+		port := port
+		requirements = append(requirements, agentRequirement{
+			fmt.Sprintf("offer port %d", port),
+			func(a *mesos.Slave) bool { return offersPort(a, port) },
+		})
+	}
+
+	for _, constraint := range task.constraints {
+		req, err := constraintRequirement(constraint)
+		if err != nil {
+			return nil, err
+		}
+		if req != nil {
+			requirements = append(requirements, *req)
+		}
+	}
+
+	return requirements, nil
+}
+
+// constraintRequirement returns the agent condition of a constraint, if it
+// has one. UNIQUE and MAX_PER also limit the number of instances, which is
+// checked across agents.
+func constraintRequirement(constraint []string) (*agentRequirement, error) {
+	if len(constraint) < 2 {
+		return nil, errors.New(fmt.Sprintf("invalid constraint %v", constraint))
+	}
+
+	field, operator, value := constraint[0], strings.ToUpper(constraint[1]), ""
+	if len(constraint) > 2 {
+		value = constraint[2]
+	}
+	description := fmt.Sprintf("match constraint %s", strings.Join(constraint, ":"))
+
+	hasField := func(a *mesos.Slave) bool {
+		_, ok := a.Attribute(field)
+		return ok
+	}
+
+	switch operator {
+	case "LIKE", "UNLIKE":
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid constraint %s: %v", strings.Join(constraint, ":"), err))
+		}
+		like := operator == "LIKE"
+		return &agentRequirement{description, func(a *mesos.Slave) bool {
+			v, ok := a.Attribute(field)
+			if !ok {
+				return !like
+			}
+			return re.MatchString(v) == like
+		}}, nil
+	case "CLUSTER":
+		if value == "" {
+			return &agentRequirement{description, hasField}, nil
+		}
+		return &agentRequirement{description, func(a *mesos.Slave) bool {
+			v, ok := a.Attribute(field)
+			return ok && v == value
+		}}, nil
+	case "UNIQUE", "MAX_PER":
+		return &agentRequirement{description, hasField}, nil
+	}
+
+	// GROUP_BY and unknown operators don't restrict where instances run
+	return nil, nil
+}
+
+// agentCapacity is the number of instances of a task that fit on the total
+// resources of an agent, up to instances.
+func agentCapacity(task *taskRequirements, agent *mesos.Slave, instances int) int {
+	capacity := instances
+	limit := func(available float64, needed float64) {
+		if needed > 0 {
+			if n := int(available / needed); n < capacity {
+				capacity = n
+			}
+		}
+	}
+
+	limit(agent.Resources.CPUs, task.cpus)
+	limit(agent.Resources.Mem, task.mem)
+	limit(agent.Resources.Disk, task.disk)
+	limit(float64(portCount(agent)), float64(task.ports))
+
+	// a fixed host port can only be used once per agent
+	if len(task.fixedPorts) > 0 && capacity > 1 {
+		capacity = 1
+	}
+
+	return capacity
+}
+
+func portCount(agent *mesos.Slave) int {
+	count := 0
+	for _, r := range agent.Resources.PortRanges() {
+		count += r[1] - r[0] + 1
+	}
+	return count
+}
+
+func offersPort(agent *mesos.Slave, port int) bool {
+	for _, r := range agent.Resources.PortRanges() {
+		if port >= r[0] && port <= r[1] {
+			return true
+		}
+	}
+	return false
+}
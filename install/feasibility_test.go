@@ -0,0 +1,218 @@
+package install
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/CiscoCloud/mantl-api/marathon"
+	"github.com/CiscoCloud/mantl-api/mesos"
+	"github.com/stretchr/testify/assert"
+)
+
+func testAgents() []*mesos.Slave {
+	agent := func(hostname string, rack string, cpus float64, mem float64) *mesos.Slave {
+		return &mesos.Slave{
+			Hostname:   hostname,
+			Active:     true,
+			Attributes: map[string]interface{}{"rack": rack},
+			Resources:  mesos.Resources{CPUs: cpus, Mem: mem, Disk: 10000, Ports: "[4000-5000, 31000-32000]"},
+		}
+	}
+	return []*mesos.Slave{
+		agent("worker-01", "a", 4, 8192),
+		agent("worker-02", "a", 4, 8192),
+		agent("worker-03", "b", 2, 4096),
+	}
+}
+
+func TestAppFeasible(t *testing.T) {
+	t.Parallel()
+
+	app := &marathon.App{
+		ID:          "/kafka",
+		CPUs:        1,
+		Mem:         2048,
+		Instances:   3,
+		Ports:       []int{0, 0},
+		Constraints: [][]string{{"hostname", "UNIQUE"}, {"rack", "LIKE", "a|b"}},
+	}
+	assert.NoError(t, appFeasibility(app, testAgents()))
+
+	// instances are packed onto agents without constraints
+	app = &marathon.App{ID: "/kafka", CPUs: 1, Mem: 1024, Instances: 10}
+	assert.NoError(t, appFeasibility(app, testAgents()))
+}
+
+func TestAppInfeasibleResources(t *testing.T) {
+	t.Parallel()
+
+	app := &marathon.App{ID: "/kafka", CPUs: 8, Mem: 1024}
+	err := appFeasibility(app, testAgents())
+	if assert.IsType(t, &FeasibilityError{}, err) {
+		assert.Equal(t, []string{"no agent can run an instance", "3 of 3 agents don't have 8 cpus"}, err.(*FeasibilityError).Reasons)
+	}
+
+	app = &marathon.App{ID: "/kafka", CPUs: 2, Mem: 1024, Instances: 6}
+	err = appFeasibility(app, testAgents())
+	if assert.IsType(t, &FeasibilityError{}, err) {
+		assert.Equal(t, []string{"only 5 of 6 instances fit on the agents"}, err.(*FeasibilityError).Reasons)
+	}
+}
+
+func TestAppInfeasiblePorts(t *testing.T) {
+	t.Parallel()
+
+	app := &marathon.App{ID: "/kafka", Ports: []int{9092}, RequirePorts: true, Instances: 1}
+	err := appFeasibility(app, testAgents())
+	if assert.IsType(t, &FeasibilityError{}, err) {
+		assert.Contains(t, err.Error(), "3 of 3 agents don't offer port 9092")
+	}
+
+	// a fixed port can only be used once per agent
+	app = &marathon.App{ID: "/kafka", Ports: []int{4040}, RequirePorts: true, Instances: 4}
+	err = appFeasibility(app, testAgents())
+	if assert.IsType(t, &FeasibilityError{}, err) {
+		assert.Contains(t, err.Error(), "only 3 of 4 instances fit on the agents")
+	}
+}
+
+func TestAppInfeasibleHostPorts(t *testing.T) {
+	t.Parallel()
+
+	app := &marathon.App{ID: "/kafka", PortDefinitions: []marathon.PortDefinition{{Port: 9092}}, RequirePorts: true}
+	err := appFeasibility(app, testAgents())
+	if assert.IsType(t, &FeasibilityError{}, err) {
+		assert.Contains(t, err.Error(), "3 of 3 agents don't offer port 9092")
+	}
+
+	// without requirePorts the port is assigned by marathon
+	app = &marathon.App{ID: "/kafka", PortDefinitions: []marathon.PortDefinition{{Port: 9092}}, Instances: 4}
+	assert.NoError(t, appFeasibility(app, testAgents()))
+
+	app = &marathon.App{ID: "/kafka", Instances: 4, Container: &marathon.Container{Docker: &marathon.Docker{
+		Network:      "BRIDGE",
+		PortMappings: []marathon.PortMapping{{ContainerPort: 9092, HostPort: 4040}, {ContainerPort: 8080}},
+	}}}
+	err = appFeasibility(app, testAgents())
+	if assert.IsType(t, &FeasibilityError{}, err) {
+		assert.Contains(t, err.Error(), "only 3 of 4 instances fit on the agents")
+	}
+
+	app.Container.Docker.PortMappings[0].HostPort = 9092
+	err = appFeasibility(app, testAgents())
+	if assert.IsType(t, &FeasibilityError{}, err) {
+		assert.Contains(t, err.Error(), "3 of 3 agents don't offer port 9092")
+	}
+
+	// the ports of a bridged app are unused
+	app = &marathon.App{ID: "/kafka", Ports: []int{9092}, RequirePorts: true, Container: &marathon.Container{Docker: &marathon.Docker{
+		Network:      "BRIDGE",
+		PortMappings: []marathon.PortMapping{{ContainerPort: 9092}},
+	}}}
+	assert.NoError(t, appFeasibility(app, testAgents()))
+}
+
+func TestPodFeasibility(t *testing.T) {
+	t.Parallel()
+
+	pod := func(spec string) *marathon.Pod {
+		p := &marathon.Pod{ID: "/kafka"}
+		assert.NoError(t, json.Unmarshal([]byte(spec), &p.Spec))
+		return p
+	}
+
+	// resources of the containers add up
+	task := podTask(pod(`{
+		"scaling": {"kind": "fixed", "instances": 2},
+		"containers": [
+			{"name": "broker", "resources": {"cpus": 2, "mem": 4096}, "endpoints": [{"name": "kafka", "hostPort": 0}]},
+			{"name": "exporter", "resources": {"cpus": 1, "mem": 128}}
+		]
+	}`))
+	assert.Equal(t, 2, task.instances)
+	assert.Equal(t, 3.0, task.cpus)
+	assert.Equal(t, 1, task.ports)
+	assert.NoError(t, taskFeasibility(task, testAgents()))
+
+	task = podTask(pod(`{
+		"containers": [
+			{"name": "broker", "resources": {"cpus": 4, "mem": 4096}},
+			{"name": "exporter", "resources": {"cpus": 1, "mem": 128}}
+		]
+	}`))
+	err := taskFeasibility(task, testAgents())
+	if assert.IsType(t, &FeasibilityError{}, err) {
+		assert.Contains(t, err.Error(), "3 of 3 agents don't have 5 cpus")
+	}
+
+	task = podTask(pod(`{
+		"scaling": {"kind": "fixed", "instances": 4},
+		"containers": [{"name": "broker", "resources": {"cpus": 0.5, "mem": 128}, "endpoints": [{"name": "kafka", "hostPort": 4040}]}]
+	}`))
+	err = taskFeasibility(task, testAgents())
+	if assert.IsType(t, &FeasibilityError{}, err) {
+		assert.Contains(t, err.Error(), "only 3 of 4 instances fit on the agents")
+	}
+
+	task = podTask(pod(`{
+		"containers": [{"name": "broker", "resources": {"cpus": 0.5, "mem": 128}, "endpoints": [{"name": "kafka", "hostPort": 9092}]}],
+		"scheduling": {"placement": {"constraints": [{"fieldName": "rack", "operator": "CLUSTER", "value": "b"}]}}
+	}`))
+	err = taskFeasibility(task, testAgents())
+	if assert.IsType(t, &FeasibilityError{}, err) {
+		assert.Contains(t, err.Error(), "3 of 3 agents don't offer port 9092")
+		assert.Contains(t, err.Error(), "2 of 3 agents don't match constraint rack:CLUSTER:b")
+	}
+
+	// container networks only use the host ports that are asked for
+	task = podTask(pod(`{
+		"networks": [{"mode": "container", "name": "dcos"}],
+		"containers": [{"name": "broker", "resources": {"cpus": 0.5, "mem": 128}, "endpoints": [{"name": "kafka", "containerPort": 9092}]}]
+	}`))
+	assert.Equal(t, 0, task.ports)
+	assert.NoError(t, taskFeasibility(task, testAgents()))
+}
+
+func TestAppInfeasibleConstraints(t *testing.T) {
+	t.Parallel()
+
+	app := &marathon.App{ID: "/kafka", Instances: 3, Constraints: [][]string{{"rack", "UNIQUE"}}}
+	err := appFeasibility(app, testAgents())
+	if assert.IsType(t, &FeasibilityError{}, err) {
+		assert.Contains(t, err.Error(), "constraint rack:UNIQUE allows only 2 of 3 instances on 2 distinct rack values")
+	}
+
+	app = &marathon.App{ID: "/kafka", Instances: 3, Constraints: [][]string{{"rack", "MAX_PER", "2"}}}
+	assert.NoError(t, appFeasibility(app, testAgents()))
+
+	app = &marathon.App{ID: "/kafka", Constraints: [][]string{{"zone", "CLUSTER", "us-east-1a"}}}
+	err = appFeasibility(app, testAgents())
+	if assert.IsType(t, &FeasibilityError{}, err) {
+		assert.Contains(t, err.Error(), "3 of 3 agents don't match constraint zone:CLUSTER:us-east-1a")
+	}
+
+	app = &marathon.App{ID: "/kafka", CPUs: 2, Instances: 2, Constraints: [][]string{{"hostname", "UNLIKE", "worker-0[12]"}}}
+	err = appFeasibility(app, testAgents())
+	assert.IsType(t, &FeasibilityError{}, err)
+}
+
+func TestCheckFeasibility(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"slaves": [
+			{"active": true, "hostname": "worker-01", "resources": {"cpus": 2, "mem": 4096, "disk": 1000, "ports": "[31000-32000]"}},
+			{"active": false, "hostname": "worker-02", "resources": {"cpus": 16, "mem": 65536, "disk": 1000, "ports": "[31000-32000]"}}
+		]}`))
+	}))
+	defer ts.Close()
+
+	mesosClient, err := mesos.NewMesos(ts.URL, "", "", false)
+	assert.NoError(t, err)
+	inst := &Install{mesos: mesosClient}
+
+	assert.NoError(t, inst.checkFeasibility(appTask(&marathon.App{ID: "/small", CPUs: 1})))
+	assert.IsType(t, &FeasibilityError{}, inst.checkFeasibility(appTask(&marathon.App{ID: "/large", CPUs: 8})))
+}
@@ -0,0 +1,176 @@
+package install
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const redacted = "xxxxx"
+
+// fetchGitSource fetches a single commit of the source into a temporary
+// directory. The commit is the source's ref (a branch, tag or commit SHA),
+// its branch, or the remote HEAD, in that order.
+func (install *Install) fetchGitSource(source *Source) (*fetchedSource, error) {
+	temp, err := ioutil.TempDir(os.TempDir(), "mantl-install")
+	if err != nil {
+		return nil, err
+	}
+	cleanup := func() { os.RemoveAll(temp) }
+
+	dest := filepath.Join(temp, source.Name)
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		cleanup()
+		return nil, err
+	}
+
+	ref := source.Ref
+	if ref == "" {
+		ref = source.Branch
+	}
+	if ref == "" {
+		ref = "HEAD"
+	}
+
+	log.Debugf("Fetching %s of %s into %s", ref, source.displayPath(), dest)
+	commit, err := source.checkout(dest, ref)
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+
+	os.RemoveAll(filepath.Join(dest, ".git"))
+
+	root := dest
+	if source.Subdirectory != "" {
+		root = filepath.Join(dest, filepath.FromSlash(source.Subdirectory))
+		if !strings.HasPrefix(root, dest+string(os.PathSeparator)) {
+			cleanup()
+			return nil, errors.New(fmt.Sprintf("Subdirectory %s is outside of the %s repository", source.Subdirectory, source.Name))
+		}
+		if info, err := os.Stat(root); err != nil || !info.IsDir() {
+			cleanup()
+			return nil, errors.New(fmt.Sprintf("Subdirectory %s does not exist in %s at %s", source.Subdirectory, source.displayPath(), commit))
+		}
+	}
+
+	return &fetchedSource{
+		path:    root,
+		meta:    map[string]string{"commit": commit},
+		cleanup: cleanup,
+	}, nil
+}
+
+// checkout fetches ref into an empty repository at dir and returns the
+// resolved commit.
+func (source *Source) checkout(dir string, ref string) (string, error) {
+	if _, err := source.git(dir, "init", "--quiet"); err != nil {
+		return "", err
+	}
+	if _, err := source.git(dir, "remote", "add", "origin", source.Path); err != nil {
+		return "", err
+	}
+
+	// servers that don't allow fetching unadvertised commits need the full
+	// history to resolve a commit SHA
+	if _, err := source.git(dir, "fetch", "--quiet", "--depth", "1", "origin", ref); err == nil {
+		ref = "FETCH_HEAD"
+	} else if _, err := source.git(dir, "fetch", "--quiet", "--tags", "origin"); err != nil {
+		return "", err
+	}
+
+	if _, err := source.git(dir, "checkout", "--quiet", "--detach", ref); err != nil {
+		return "", err
+	}
+
+	commit, err := source.git(dir, "rev-parse", "HEAD")
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(commit), nil
+}
+
+// git runs a git command with the source's credentials. Credentials are
+// passed through the environment so they never show up in the command line
+// or the repository config, and they are scrubbed from the returned errors.
+func (source *Source) git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", append(source.gitConfig(), args...)...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), source.gitEnv()...)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	log.Debugf("Running git with args: %v", source.scrub(strings.Join(args, " ")))
+	if err := cmd.Run(); err != nil {
+		msg := fmt.Sprintf("git %s failed: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+		return "", errors.New(source.scrub(msg))
+	}
+
+	return stdout.String(), nil
+}
+
+// gitTokenHelper is a credential helper that answers git with the token
+// from the environment. Unlike http.extraHeader, credential helpers work
+// with every git version that mantl-api supports.
+const gitTokenHelper = `!f() { test "$1" = get && echo username=x-access-token && echo "password=$MANTL_GIT_TOKEN"; }; f`
+
+func (source *Source) gitConfig() []string {
+	if source.Token == "" {
+		return nil
+	}
+	return []string{"-c", "credential.helper=" + gitTokenHelper}
+}
+
+func (source *Source) gitEnv() []string {
+	env := []string{"GIT_TERMINAL_PROMPT=0"}
+
+	if source.SSHKey != "" {
+		env = append(env, fmt.Sprintf("GIT_SSH_COMMAND=ssh -i %s -o IdentitiesOnly=yes -o BatchMode=yes", shellQuote(source.SSHKey)))
+	}
+
+	if source.Token != "" {
+		env = append(env, "MANTL_GIT_TOKEN="+source.Token)
+	}
+
+	return env
+}
+
+// shellQuote quotes s as a single word for sh.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// displayPath is the source path with any credentials removed, for use in
+// logs and errors.
+func (source *Source) displayPath() string {
+	return source.scrub(source.Path)
+}
+
+// scrub removes the source's credentials from s.
+func (source *Source) scrub(s string) string {
+	if source.Token != "" {
+		s = strings.Replace(s, source.Token, redacted, -1)
+	}
+
+	if u, err := url.Parse(source.Path); err == nil && u.User != nil {
+		if password, ok := u.User.Password(); ok && password != "" {
+			s = strings.Replace(s, password, redacted, -1)
+		} else if u.Scheme == "http" || u.Scheme == "https" {
+			// a token passed as the user name
+			s = strings.Replace(s, u.User.Username()+"@", redacted+"@", -1)
+		}
+	}
+
+	return s
+}
@@ -1,16 +1,21 @@
 package install
 
 import (
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/CiscoCloud/mantl-api/marathon"
 	"github.com/CiscoCloud/mantl-api/mesos"
 	"github.com/CiscoCloud/mantl-api/zookeeper"
 	log "github.com/Sirupsen/logrus"
 	consul "github.com/hashicorp/consul/api"
+	vault "github.com/hashicorp/vault/api"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const packageNameKey = "MANTL_PACKAGE_NAME"
@@ -19,6 +24,7 @@ const packageIndexKey = "MANTL_PACKAGE_INDEX"
 const packageIsFrameworkKey = "MANTL_PACKAGE_IS_FRAMEWORK"
 const packageFrameworkNameKey = "MANTL_PACKAGE_FRAMEWORK_NAME"
 const packageUninstallKey = "MANTL_PACKAGE_UNINSTALL"
+const packageConfigHashKey = "MANTL_PACKAGE_CONFIG_HASH"
 const dcosPackageFrameworkNameKey = "DCOS_PACKAGE_FRAMEWORK_NAME"
 const traefikEnableKey = "traefik.enable"
 
@@ -30,6 +36,39 @@ type Install struct {
 	marathon  *marathon.Marathon
 	mesos     *mesos.Mesos
 	zookeeper *zookeeper.Zookeeper
+
+	// RequestAttempts is the number of times a package request from
+	// AppsRoot is attempted before it is moved to FailedRoot.
+	RequestAttempts int
+
+	// SyncLockWait is how long a source sync waits for another sync of the
+	// same source to finish. Zero fails immediately.
+	SyncLockWait time.Duration
+
+	// StrictTemplates makes variables that can't be resolved while
+	// rendering package templates an error instead of an empty string.
+	StrictTemplates bool
+
+	// Vault resolves vault:<path>#<key> references in package configs.
+	Vault *vault.Client
+
+	// VaultRequestPaths are the Vault path prefixes that vault: references
+	// in the config of install requests may refer to.
+	VaultRequestPaths []string
+
+	// VaultMarathonSecrets passes environment variables that refer to Vault
+	// to Marathon as secrets instead of resolving them.
+	VaultMarathonSecrets bool
+
+	// Policies are admission policies from the configuration file. They
+	// are evaluated along with the policies in Consul under PoliciesRoot.
+	Policies []*PolicyRule
+
+	// Rewrites map images and artifact urls of packages to mirrors.
+	Rewrites Rewrites
+
+	// Events is the Marathon event bus, or nil when it isn't followed.
+	Events *marathon.EventStream
 }
 
 func NewInstall(consulClient *consul.Client, marathon *marathon.Marathon, mesos *mesos.Mesos, zkHosts []string) (*Install, error) {
@@ -59,7 +98,15 @@ func NewInstall(consulClient *consul.Client, marathon *marathon.Marathon, mesos
 	}
 
 	zookeeper := zookeeper.NewZookeeper(zkHosts)
-	return &Install{consulClient, consulClient.KV(), marathon, mesos, zookeeper}, nil
+	return &Install{
+		consul:          consulClient,
+		kv:              consulClient.KV(),
+		marathon:        marathon,
+		mesos:           mesos,
+		zookeeper:       zookeeper,
+		RequestAttempts: defaultRequestAttempts,
+		SyncLockWait:    defaultSyncLockWait,
+	}, nil
 }
 
 func (install *Install) Packages() (PackageCollection, error) {
@@ -74,42 +121,169 @@ func (install *Install) Repositories() (RepositoryCollection, error) {
 	return install.getRepositories()
 }
 
-func (install *Install) InstallPackage(pkgReq *PackageRequest) (string, error) {
-	pkgDef, err := install.GetPackageDefinition(pkgReq.Name, pkgReq.Version, pkgReq.Config, apiConfig)
+// InstallPackage submits the app, group or pod of a package request to
+// Marathon. It returns the Marathon response and the package version that
+// was installed.
+func (install *Install) InstallPackage(pkgReq *PackageRequest) (string, string, error) {
+	return install.installPackage(pkgReq, nil)
+}
 
+func (install *Install) installPackage(pkgReq *PackageRequest, installing map[string]bool) (string, string, error) {
+	deployment, pkgDef, err := install.packageDeployment(pkgReq)
 	if err != nil {
-		log.Errorf("Could not find package definition: %v", err)
-		return "", err
+		return "", "", err
+	}
+
+	if err := install.checkPolicies(deployment, pkgDef); err != nil {
+		log.Errorf("Refusing to install %s: %v", pkgReq.Name, err)
+		return "", "", err
+	}
+
+	if !pkgReq.Force {
+		if err := install.checkDeploymentFeasibility(deployment); err != nil {
+			log.Errorf("Refusing to install %s: %v", pkgReq.Name, err)
+			return "", "", err
+		}
 	}
 
-	marathonJson, err := pkgDef.MarathonAppJson()
+	err = install.ensureDependencies(pkgReq, pkgDef, installing)
 	if err != nil {
-		log.Errorf("Could not generate marathon json: %v", err)
-		return "", err
+		log.Errorf("Could not satisfy dependencies of %s: %v", pkgReq.Name, err)
+		return "", "", err
 	}
 
-	app, err := install.marathon.ToApp(marathonJson)
+	logDeployment("Submitting", deployment, pkgDef)
+
+	response, err := install.createDeployment(deployment)
+
 	if err != nil {
-		log.Errorf("Could not unmarshal marathon json: %v", err)
-		return "", err
+		log.Errorf("Could not create %s in Marathon: %v", deployment.kind(), err)
+		return "", "", err
+	}
+
+	return response, pkgDef.version, nil
+}
+
+// UpgradePackage updates an installed package to the version of a package
+// request. It returns the Marathon response and the new package version.
+func (install *Install) UpgradePackage(pkgReq *PackageRequest, installed *marathon.App) (string, string, error) {
+	if installed == nil {
+		return "", "", errors.New("App cannot be nil when upgrading a package")
 	}
 
-	err = addMantlLabels(app, pkgDef)
+	deployment, pkgDef, err := install.packageDeployment(pkgReq)
 	if err != nil {
-		log.Errorf("Could not add labels to marathon json: %v", err)
-		return "", err
+		return "", "", err
+	}
+
+	if err := checkUpgradeKind(deployment, installed); err != nil {
+		log.Errorf("Refusing to upgrade %s: %v", pkgReq.Name, err)
+		return "", "", err
+	}
+
+	if err := install.checkPolicies(deployment, pkgDef); err != nil {
+		log.Errorf("Refusing to upgrade %s: %v", pkgReq.Name, err)
+		return "", "", err
+	}
+
+	if !pkgReq.Force {
+		if err := install.checkDeploymentFeasibility(deployment); err != nil {
+			log.Errorf("Refusing to upgrade %s: %v", pkgReq.Name, err)
+			return "", "", err
+		}
+	}
+
+	err = install.ensureDependencies(pkgReq, pkgDef, nil)
+	if err != nil {
+		log.Errorf("Could not satisfy dependencies of %s: %v", pkgReq.Name, err)
+		return "", "", err
+	}
+
+	// keep the existing id so marathon performs a rolling upgrade
+	deployment.setID(installed.ID)
+
+	logDeployment("Submitting update of", deployment, pkgDef)
+
+	response, err := install.updateDeployment(deployment)
+	if err != nil {
+		log.Errorf("Could not update %s in Marathon: %v", deployment.kind(), err)
+		return "", "", err
+	}
+
+	return response, pkgDef.version, nil
+}
+
+// DryRun is the outcome of a package request that is evaluated without
+// submitting anything to Marathon.
+type DryRun struct {
+	Version    string             `json:"version"`
+	App        *marathon.App      `json:"app,omitempty"`
+	Group      *marathon.Group    `json:"group,omitempty"`
+	Pod        *marathon.Pod      `json:"pod,omitempty"`
+	Violations []*PolicyViolation `json:"violations"`
+	Infeasible []string           `json:"infeasible,omitempty"`
+	Rewrites   []*AppliedRewrite  `json:"rewrites"`
+}
+
+// DryRunPackage renders the app, group or pod of a package request and
+// evaluates the admission policies and the feasibility check against it.
+func (install *Install) DryRunPackage(pkgReq *PackageRequest) (*DryRun, error) {
+	deployment, pkgDef, err := install.packageDeployment(pkgReq)
+	if err != nil {
+		return nil, err
+	}
+
+	violations, err := install.deploymentViolations(deployment, pkgDef)
+	if err != nil {
+		return nil, err
+	}
+
+	// the response must not contain resolved secrets
+	redacted, err := pkgDef.redactedDeployment(deployment)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &DryRun{
+		Version:    pkgDef.version,
+		App:        redacted.App,
+		Group:      redacted.Group,
+		Pod:        redacted.Pod,
+		Violations: violations,
+		Rewrites:   pkgDef.applied.list,
+	}
+	if result.Violations == nil {
+		result.Violations = []*PolicyViolation{}
+	}
+	if result.Rewrites == nil {
+		result.Rewrites = []*AppliedRewrite{}
+	}
+
+	if err := install.checkDeploymentFeasibility(deployment); err != nil {
+		if feasibilityErr, ok := err.(*FeasibilityError); ok {
+			result.Infeasible = feasibilityErr.Reasons
+		} else {
+			return nil, err
+		}
 	}
 
-	log.Debugf("Submitting application to marathon: %+v", app)
+	return result, nil
+}
+
+func (install *Install) packageDeployment(pkgReq *PackageRequest) (*packageDeployment, *packageDefinition, error) {
+	pkgDef, err := install.GetPackageDefinition(pkgReq.Name, pkgReq.Version, pkgReq.Repository, pkgReq.Config, apiConfig)
 
-	response, err := install.marathon.CreateApp(app)
+	if err != nil {
+		log.Errorf("Could not find package definition: %v", err)
+		return nil, nil, err
+	}
 
+	deployment, err := pkgDef.deployment()
 	if err != nil {
-		log.Errorf("Could not create app in Marathon: %v", err)
-		return "", err
+		return nil, nil, err
 	}
 
-	return response, nil
+	return deployment, pkgDef, nil
 }
 
 func (install *Install) FindInstalled(pkgReq *PackageRequest) ([]*marathon.App, error) {
@@ -128,16 +302,47 @@ func (install *Install) FindInstalled(pkgReq *PackageRequest) ([]*marathon.App,
 	return matching, nil
 }
 
+// InstalledPackageError is returned by FindInstalledApp when a request does
+// not identify exactly one installed app.
+type InstalledPackageError struct {
+	Name  string
+	AppID string
+	Count int
+}
+
+func (e *InstalledPackageError) Error() string {
+	if e.Count > 1 {
+		return fmt.Sprintf("There is more than 1 instance of the %s package running. Please include the application id in the request.", e.Name)
+	}
+	if e.AppID != "" {
+		return fmt.Sprintf("Package %s (%s) not found.", e.Name, e.AppID)
+	}
+	return fmt.Sprintf("Package %s not found.", e.Name)
+}
+
+func (install *Install) FindInstalledApp(pkgReq *PackageRequest) (*marathon.App, error) {
+	apps, err := install.FindInstalled(pkgReq)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(apps) != 1 {
+		return nil, &InstalledPackageError{pkgReq.Name, pkgReq.AppID, len(apps)}
+	}
+
+	return apps[0], nil
+}
+
 func (install *Install) UninstallPackage(app *marathon.App) error {
 	if app == nil {
 		return errors.New("App cannot be nil when uninstalling a package")
 	}
 
-	// remove app from marathon
-	_, err := install.marathon.DestroyApp(app.ID)
+	// remove the app, or the whole group or pod, from marathon
+	_, err := install.destroyInstalled(app)
 
 	if err != nil {
-		log.Errorf("Could not destroy app in Marathon: %v", err)
+		log.Errorf("Could not destroy %s in Marathon: %v", installedKind(app), err)
 		return err
 	}
 
@@ -169,23 +374,37 @@ func (install *Install) UninstallPackage(app *marathon.App) error {
 func (install *Install) SyncSources(sources []*Source, force bool) error {
 	// sync repositories if they don't exist
 	for _, source := range sources {
-		ts, err := install.sourceLastUpdated(source)
-		log.Debugf("%s source last updated at %v", source.Name, ts)
-		if err != nil || ts.IsZero() || force {
-			if force {
-				log.Debugf("Forcing sync")
-			}
-			log.Debugf("Syncing %v source", source.Name)
-			err := install.syncSource(source)
-			if err != nil {
-				log.Errorf("Could not sync %s source from %s: %v", source.Name, source.Path, err)
-				return err
-			}
+		err := install.syncSourceIfNeeded(source, force)
+		if err != nil {
+			log.Errorf("Could not sync %s source from %s: %v", source.Name, source.displayPath(), err)
+			return err
 		}
 	}
 	return nil
 }
 
+func (install *Install) syncSourceIfNeeded(source *Source, force bool) error {
+	lock, err := install.lockSource(source)
+	if err != nil {
+		return err
+	}
+	defer install.unlockSource(source, lock)
+
+	// checked while holding the lock so that a sync that just finished
+	// elsewhere is not repeated
+	ts, err := install.sourceLastUpdated(source)
+	log.Debugf("%s source last updated at %v", source.Name, ts)
+	if err != nil || ts.IsZero() || force {
+		if force {
+			log.Debugf("Forcing sync")
+		}
+		log.Debugf("Syncing %v source", source.Name)
+		_, err = install.syncSource(source, true, lock)
+		return err
+	}
+	return nil
+}
+
 func (install *Install) postUninstall(app *marathon.App) error {
 	name := app.Labels[packageNameKey]
 	encoded := app.Labels[packageUninstallKey]
@@ -224,7 +443,14 @@ func (install *Install) installedApps() ([]*marathon.App, error) {
 		return nil, err
 	}
 
-	return apps, err
+	pods, err := install.marathon.Pods()
+	if err != nil {
+		log.Errorf("Could not retrieve installed pods from Marathon: %v", err)
+		return nil, err
+	}
+
+	// a package deployed as a group or pod is a single instance
+	return installedPackages(apps, pods), nil
 }
 
 func filterByID(id string, apps []*marathon.App) []*marathon.App {
@@ -266,35 +492,70 @@ func filterByPackageName(name string, apps []*marathon.App) []*marathon.App {
 }
 
 func addMantlLabels(app *marathon.App, pkgDef *packageDefinition) error {
-	if app.Labels == nil {
-		app.Labels = make(map[string]string)
+	labels, err := mantlLabels(app.Labels, pkgDef)
+	if err != nil {
+		return err
 	}
-	app.Labels[packageNameKey] = pkgDef.name
-	app.Labels[packageVersionKey] = pkgDef.version
-	app.Labels[packageIndexKey] = pkgDef.release
-	app.Labels[packageIsFrameworkKey] = strconv.FormatBool(pkgDef.framework)
+	app.Labels = labels
+	return nil
+}
 
-	uninstallJson, err := pkgDef.UninstallJson()
+// mantlLabels adds the MANTL_PACKAGE_* labels of a package to labels.
+func mantlLabels(labels map[string]string, pkgDef *packageDefinition) (map[string]string, error) {
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	labels[packageNameKey] = pkgDef.name
+	labels[packageVersionKey] = pkgDef.version
+	labels[packageIndexKey] = pkgDef.release
+	labels[packageIsFrameworkKey] = strconv.FormatBool(pkgDef.framework)
+	labels[packageConfigHashKey] = configHash(pkgDef.userConfig)
+
+	dependencies, err := pkgDef.Dependencies()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if len(dependencies) > 0 {
+		labels[packageDependenciesKey] = dependencyNames(dependencies)
 	}
-	app.Labels[packageUninstallKey] = base64.StdEncoding.EncodeToString([]byte(uninstallJson))
+
+	uninstallJson, err := pkgDef.redacted().UninstallJson()
+	if err != nil {
+		return nil, err
+	}
+	labels[packageUninstallKey] = base64.StdEncoding.EncodeToString([]byte(uninstallJson))
 
 	if pkgDef.frameworkName != "" {
-		app.Labels[packageFrameworkNameKey] = pkgDef.frameworkName
+		labels[packageFrameworkNameKey] = pkgDef.frameworkName
 	}
 
 	// copy DCOS_PACKAGE_FRAMEWORK_NAME if it exists
-	if fwName, ok := app.Labels[dcosPackageFrameworkNameKey]; ok {
-		app.Labels[packageFrameworkNameKey] = fwName
+	if fwName, ok := labels[dcosPackageFrameworkNameKey]; ok {
+		labels[packageFrameworkNameKey] = fwName
 	}
 
 	lb, err := pkgDef.LoadBalancer()
 	if err == nil {
-		app.Labels[traefikEnableKey] = strconv.FormatBool(lb == "external")
+		labels[traefikEnableKey] = strconv.FormatBool(lb == "external")
 	} else {
 		log.Warnf("Unable to retrieve load balancer configuration: %s", err.Error())
 	}
 
-	return nil
+	return labels, nil
+}
+
+func configHash(config map[string]interface{}) string {
+	if len(config) == 0 {
+		return ""
+	}
+
+	// json.Marshal sorts map keys, so equal configs hash the same
+	blob, err := json.Marshal(config)
+	if err != nil {
+		log.Warnf("Could not marshal config for hashing: %v", err)
+		return ""
+	}
+
+	sum := sha256.Sum256(blob)
+	return hex.EncodeToString(sum[:])
 }
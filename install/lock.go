@@ -0,0 +1,151 @@
+package install
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	consul "github.com/hashicorp/consul/api"
+)
+
+const LocksRoot = "mantl-install/locks"
+
+const defaultSyncLockWait = 5 * time.Minute
+
+type lockHolder struct {
+	Holder   string    `json:"holder"`
+	Acquired time.Time `json:"acquired"`
+}
+
+func (h *lockHolder) String() string {
+	if h == nil || h.Holder == "" {
+		return "an unknown holder"
+	}
+	return fmt.Sprintf("%s (since %s)", h.Holder, h.Acquired.Format(time.RFC3339))
+}
+
+// sourceLock is a held source sync lock and the session that holds it.
+type sourceLock struct {
+	*consul.Lock
+	key     string
+	session string
+	lost    <-chan struct{}
+}
+
+// held reports whether the lock is still held. A nil lock, for syncs that
+// don't lock, is always held.
+func (l *sourceLock) held() bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case <-l.lost:
+		return false
+	default:
+		return true
+	}
+}
+
+// fence returns a transaction operation that fails unless the session still
+// holds the lock, or nil for a nil lock.
+func (l *sourceLock) fence() *consul.KVTxnOp {
+	if l == nil {
+		return nil
+	}
+	return &consul.KVTxnOp{Verb: consul.KVCheckSession, Key: l.key, Session: l.session}
+}
+
+func (source *Source) lockKey() string {
+	return path.Join(LocksRoot, "sync", fmt.Sprintf("%d", source.Index))
+}
+
+// lockSource acquires the sync lock for a source, waiting up to
+// SyncLockWait for another holder to release it. A zero SyncLockWait fails
+// immediately when the lock is held.
+func (install *Install) lockSource(source *Source) (*sourceLock, error) {
+	key := source.lockKey()
+	value, err := json.Marshal(&lockHolder{Holder: InstanceID(), Acquired: time.Now().UTC()})
+	if err != nil {
+		return nil, err
+	}
+
+	wait := install.SyncLockWait
+	if wait <= 0 {
+		wait = time.Millisecond
+	}
+
+	lock, err := install.consul.LockOpts(&consul.LockOptions{
+		Key:          key,
+		Value:        value,
+		SessionName:  "mantl-api-sync",
+		LockWaitTime: wait,
+		LockTryOnce:  true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if holder := install.lockHolder(key); holder != nil {
+		if install.SyncLockWait > 0 {
+			log.Infof("Waiting up to %v for %s source sync lock held by %s", install.SyncLockWait, source.Name, holder)
+		}
+	}
+
+	lost, err := lock.Lock(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if lost == nil {
+		return nil, errors.New(fmt.Sprintf("Could not acquire %s source sync lock: held by %s", source.Name, install.lockHolder(key)))
+	}
+
+	// the session is only known to the lock, so read it back from the key
+	kp, _, err := install.kv.Get(key, nil)
+	if err != nil || kp == nil || kp.Session == "" {
+		lock.Unlock()
+		if err == nil {
+			err = errors.New(fmt.Sprintf("Could not read the session of %s source sync lock", source.Name))
+		}
+		return nil, err
+	}
+
+	log.Debugf("Acquired %s source sync lock %s", source.Name, key)
+	return &sourceLock{Lock: lock, key: key, session: kp.Session, lost: lost}, nil
+}
+
+func (install *Install) unlockSource(source *Source, lock *sourceLock) {
+	if err := lock.Unlock(); err != nil {
+		log.Warnf("Could not release %s source sync lock: %v", source.Name, err)
+		return
+	}
+	log.Debugf("Released %s source sync lock", source.Name)
+}
+
+func (install *Install) lockHolder(key string) *lockHolder {
+	kp, _, err := install.kv.Get(key, nil)
+	if err != nil || kp == nil || kp.Session == "" {
+		return nil
+	}
+
+	holder := &lockHolder{}
+	if err := json.Unmarshal(kp.Value, holder); err != nil {
+		log.Debugf("Could not unmarshal lock holder from %s: %v", key, err)
+	}
+	return holder
+}
+
+// InstanceID identifies this mantl-api process, as the holder of a lock and
+// as a candidate in the leader election.
+func InstanceID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Warnf("Could not determine hostname: %v", err)
+		hostname = "localhost"
+	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
@@ -0,0 +1,22 @@
+package install
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestSourceLockKey(t *testing.T) {
+	t.Parallel()
+	source := &Source{Name: "mantl", Index: 2}
+	assert.Equal(t, "mantl-install/locks/sync/2", source.lockKey())
+}
+
+func TestLockHolderString(t *testing.T) {
+	t.Parallel()
+	var missing *lockHolder
+	assert.Equal(t, "an unknown holder", missing.String())
+
+	holder := &lockHolder{Holder: "mantl-worker-001-12", Acquired: time.Date(2016, 8, 2, 15, 4, 5, 0, time.UTC)}
+	assert.Equal(t, "mantl-worker-001-12 (since 2016-08-02T15:04:05Z)", holder.String())
+}
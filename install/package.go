@@ -5,30 +5,49 @@ import (
 	"errors"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
-	"github.com/Wuvist/mustache"
+	consul "github.com/hashicorp/consul/api"
+	vault "github.com/hashicorp/vault/api"
 	"path"
 	"sort"
 	"strings"
 )
 
 type PackageVersion struct {
-	Version   string `json:"version"`
-	Index     string `json:"index"`
-	Supported bool   `json:"supported"`
+	Version    string `json:"version"`
+	Index      string `json:"index"`
+	Supported  bool   `json:"supported"`
+	Repository string `json:"repository"`
+	key        string
 }
 
 type packageVersionByMostRecent []*PackageVersion
 
-func (p packageVersionByMostRecent) Len() int           { return len(p) }
-func (p packageVersionByMostRecent) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
-func (p packageVersionByMostRecent) Less(i, j int) bool { return p[j].Index < p[i].Index }
+func (p packageVersionByMostRecent) Len() int      { return len(p) }
+func (p packageVersionByMostRecent) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p packageVersionByMostRecent) Less(i, j int) bool {
+	if c := compareVersions(p[i].Version, p[j].Version); c != 0 {
+		return c > 0
+	}
+	return compareIndexes(p[i].Index, p[j].Index) > 0
+}
+
+const (
+	InstallAction   = "install"
+	UninstallAction = "uninstall"
+	UpgradeAction   = "upgrade"
+)
 
 type PackageRequest struct {
-	Name             string                 `json:"name"`
-	Version          string                 `json:"version"`
-	AppID            string                 `json:"id"`
-	Config           map[string]interface{} `json:"config"`
-	UninstallOptions map[string]interface{} `json:"uninstallOptions"`
+	Action              string                 `json:"action"`
+	Name                string                 `json:"name"`
+	Version             string                 `json:"version"`
+	AppID               string                 `json:"id"`
+	Repository          string                 `json:"repository"`
+	InstallDependencies bool                   `json:"installDependencies"`
+	Force               bool                   `json:"force"`
+	DryRun              bool                   `json:"dryRun"`
+	Config              map[string]interface{} `json:"config"`
+	UninstallOptions    map[string]interface{} `json:"uninstallOptions"`
 }
 
 func NewPackageRequest(data []byte) (request *PackageRequest, err error) {
@@ -43,6 +62,16 @@ func NewPackageRequest(data []byte) (request *PackageRequest, err error) {
 		}
 	}
 
+	if err == nil {
+		switch request.Action {
+		case "":
+			request.Action = InstallAction
+		case InstallAction, UninstallAction, UpgradeAction:
+		default:
+			err = errors.New(fmt.Sprintf("Unknown action %s", request.Action))
+		}
+	}
+
 	return request, err
 }
 
@@ -52,8 +81,13 @@ type Package struct {
 	Framework      bool                       `json:"framework"`
 	CurrentVersion string                     `json:"currentVersion"`
 	Supported      bool                       `json:"supported"`
+	Repository     string                     `json:"repository"`
 	Tags           []string                   `json:"tags"`
 	Versions       map[string]*PackageVersion `json:"versions"`
+
+	// every version in every repository, including the versions that are
+	// replaced in Versions by a repository with a higher index
+	allVersions []*PackageVersion
 }
 
 func NewPackage(name string) *Package {
@@ -63,6 +97,49 @@ func NewPackage(name string) *Package {
 	}
 }
 
+// addVersion adds a package version, replacing any version with the same
+// version string. Versions must be added in repository precedence order.
+func (p *Package) addVersion(pv *PackageVersion) {
+	p.allVersions = append(p.allVersions, pv)
+	p.Versions[pv.Version] = pv
+}
+
+func (p *Package) setCurrentVersion() {
+	p.Supported = p.HasSupportedVersion()
+
+	current := p.FindLatestSupportedPackageVersion()
+	if current == nil {
+		current = p.FindLatestPackageVersion()
+	}
+	if current != nil {
+		p.CurrentVersion = current.Version
+		p.Repository = current.Repository
+	}
+}
+
+// FromRepository returns the package as it is defined by a single
+// repository, including versions that a repository with a higher index
+// replaces.
+func (p Package) FromRepository(repository string) (*Package, error) {
+	pkg := NewPackage(p.Name)
+	pkg.Description = p.Description
+	pkg.Framework = p.Framework
+	pkg.Tags = p.Tags
+
+	for _, pv := range p.allVersions {
+		if strings.EqualFold(pv.Repository, strings.TrimSpace(repository)) {
+			pkg.addVersion(pv)
+		}
+	}
+
+	if len(pkg.Versions) == 0 {
+		return nil, errors.New(fmt.Sprintf("Could not find %s package in the %s repository", p.Name, repository))
+	}
+
+	pkg.setCurrentVersion()
+	return pkg, nil
+}
+
 func (p Package) ContainerId() string {
 	return strings.ToUpper(string([]rune(p.Name)[0]))
 }
@@ -136,8 +213,24 @@ func (p Package) FindLatestSupportedPackageVersion() *PackageVersion {
 }
 
 func (p Package) FindPackageVersion(version string) *PackageVersion {
-	pkgVer := p.GetPackageVersion(version)
-	if pkgVer == nil {
+	pkgVer, err := p.ResolvePackageVersion(version)
+	if err != nil {
+		return nil
+	}
+	return pkgVer
+}
+
+// ResolvePackageVersion finds the version to install for a version request.
+// An empty request resolves to the current version. Otherwise the request is
+// an exact version, latest, latest-supported or a constraint like ~1.2 or
+// ">=0.9 <1.0", which resolves to the most recent matching supported version,
+// or the most recent matching version if none are supported.
+func (p Package) ResolvePackageVersion(version string) (*PackageVersion, error) {
+	version = strings.TrimSpace(version)
+
+	var pkgVer *PackageVersion
+	switch version {
+	case "":
 		pkgVer = p.GetPackageVersion(p.CurrentVersion)
 		if pkgVer == nil {
 			pkgVer = p.FindLatestSupportedPackageVersion()
@@ -145,9 +238,38 @@ func (p Package) FindPackageVersion(version string) *PackageVersion {
 				pkgVer = p.FindLatestPackageVersion()
 			}
 		}
+	case LatestVersion:
+		pkgVer = p.FindLatestPackageVersion()
+	case LatestSupportedVersion:
+		pkgVer = p.FindLatestSupportedPackageVersion()
+	default:
+		pkgVer = p.GetPackageVersion(version)
+		if pkgVer != nil {
+			return pkgVer, nil
+		}
+
+		constraint, err := parseVersionConstraint(version)
+		if err != nil {
+			return nil, err
+		}
+
+		versions := p.PackageVersions()
+		sort.Sort(packageVersionByMostRecent(versions))
+		for _, v := range versions {
+			if constraint.matches(v.Version) && (pkgVer == nil || (v.Supported && !pkgVer.Supported)) {
+				pkgVer = v
+			}
+		}
 	}
 
-	return pkgVer
+	if pkgVer == nil {
+		if version == "" {
+			return nil, errors.New(fmt.Sprintf("Could not find installable version for %s", p.Name))
+		}
+		return nil, errors.New(fmt.Sprintf("Could not find %s version of %s", version, p.Name))
+	}
+
+	return pkgVer, nil
 }
 
 type PackageCollection []*Package
@@ -162,18 +284,22 @@ type packageConfigGroup struct {
 	Default              interface{}                   `json:"default"`
 }
 
-func (g packageConfigGroup) defaultConfig(d packageDefinition) map[string]interface{} {
+func (g packageConfigGroup) defaultConfig(d packageDefinition) (map[string]interface{}, error) {
 	defaults := make(map[string]interface{})
 
 	for groupName, group := range g.Properties {
+		var err error
 		if group.Default != nil {
-			defaults[groupName] = d.transformedConfigValue(group.Default, group.Type)
+			defaults[groupName], err = d.transformedConfigValue(group.Default, group.Type, true)
 		} else if group.Type == "object" {
-			defaults[groupName] = group.defaultConfig(d)
+			defaults[groupName], err = group.defaultConfig(d)
+		}
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	return defaults
+	return defaults, nil
 }
 
 type packageDefinition struct {
@@ -182,6 +308,7 @@ type packageDefinition struct {
 	marathonJson      []byte
 	packageJson       []byte
 	optionsJson       []byte
+	resourceJson      []byte
 	uninstallJson     []byte
 	apiConfig         map[string]interface{}
 	userConfig        map[string]interface{}
@@ -190,7 +317,17 @@ type packageDefinition struct {
 	release           string
 	framework         bool
 	frameworkName     string
+	strict            bool
+	consul            *consul.Client
+	vault             *vault.Client
+	vaultRequestPaths []string
+	marathonSecrets   bool
+	secrets           *packageSecrets
+	redactSecrets     bool
+	rewrites          Rewrites
+	applied           *appliedRewrites
 	valueTransformers map[string][]valueTransformer
+	valueResolvers    map[string]valueResolver
 }
 
 func (d packageDefinition) IsValid() bool {
@@ -221,27 +358,68 @@ func (d packageDefinition) Options() (map[string]interface{}, error) {
 
 	var options map[string]interface{}
 	if len(d.optionsJson) > 0 {
-		// Render options
-		optionsTemplate := string(d.optionsJson)
-		tmpl, err := mustache.ParseString(optionsTemplate)
+		options, err = d.renderOptions()
 		if err != nil {
-			log.Errorf("Could not parse options template: %v", err)
 			return nil, err
 		}
 
-		renderedOptions := tmpl.Render(d.apiConfig)
+		// dependencies are not configuration
+		delete(options, "dependencies")
 
-		err = json.Unmarshal([]byte(renderedOptions), &options)
+		// expressions are resolved before merging, so that request values
+		// can only use the resolvers allowed for requests
+		if options, err = d.resolveConfig(options, false); err != nil {
+			return nil, err
+		}
+		userConfig, err := d.resolveConfig(d.userConfig, true)
 		if err != nil {
-			log.Errorf("Could not unmarshal options json: %v", err)
 			return nil, err
 		}
 
 		// merge user config
-		d.mergeConfig(options, d.userConfig, schema)
+		if _, err := d.mergeConfig(options, userConfig, schema, false); err != nil {
+			return nil, err
+		}
 
 		// add api config to options
-		d.mergeConfig(options, d.apiConfig, schema)
+		if _, err := d.mergeConfig(options, d.apiConfig, schema, true); err != nil {
+			return nil, err
+		}
+	}
+
+	return options, nil
+}
+
+// resolveConfig returns a copy of config with the expressions in its values
+// resolved.
+func (d packageDefinition) resolveConfig(config map[string]interface{}, fromRequest bool) (map[string]interface{}, error) {
+	resolved := make(map[string]interface{}, len(config))
+	for k, v := range config {
+		var err error
+		if nested, ok := v.(map[string]interface{}); ok {
+			resolved[k], err = d.resolveConfig(nested, fromRequest)
+		} else {
+			resolved[k], err = d.resolveValue(v, fromRequest)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return resolved, nil
+}
+
+func (d packageDefinition) renderOptions() (map[string]interface{}, error) {
+	renderedOptions, err := renderTemplate("mantl.json", string(d.optionsJson), d.apiConfig, d.strict)
+	if err != nil {
+		log.Errorf("Could not render options template: %v", err)
+		return nil, err
+	}
+
+	var options map[string]interface{}
+	err = json.Unmarshal([]byte(renderedOptions), &options)
+	if err != nil {
+		log.Errorf("Could not unmarshal options json: %v", err)
+		return nil, err
 	}
 
 	return options, nil
@@ -262,17 +440,40 @@ func (d packageDefinition) MergedConfig() (map[string]interface{}, error) {
 		return nil, err
 	}
 
-	config := schema.defaultConfig(d)
+	config, err := schema.defaultConfig(d)
+	if err != nil {
+		return nil, err
+	}
 
-	return d.mergeConfig(config, options, schema), nil
+	// options are already resolved
+	return d.mergeConfig(config, options, schema, false)
 }
 
 func (d packageDefinition) MarathonAppJson() (string, error) {
-	return d.renderJsonMustacheTemplate(d.marathonJson)
+	appJson, err := d.renderJsonMustacheTemplate("marathon.json", d.marathonJson)
+	if err != nil || !d.marathonSecrets {
+		return appJson, err
+	}
+	return d.withMarathonSecrets(appJson)
 }
 
 func (d packageDefinition) UninstallJson() (string, error) {
-	return d.renderJsonMustacheTemplate(d.uninstallJson)
+	return d.renderJsonMustacheTemplate("uninstall.json", d.uninstallJson)
+}
+
+// Tags returns the tags from package.json.
+func (d packageDefinition) Tags() ([]string, error) {
+	if len(d.packageJson) == 0 {
+		return nil, nil
+	}
+
+	meta := struct {
+		Tags []string `json:"tags"`
+	}{}
+	if err := json.Unmarshal(d.packageJson, &meta); err != nil {
+		return nil, err
+	}
+	return meta.Tags, nil
 }
 
 func (d packageDefinition) LoadBalancer() (string, error) {
@@ -290,23 +491,30 @@ func (d packageDefinition) LoadBalancer() (string, error) {
 	return lb, nil
 }
 
-func (d packageDefinition) renderJsonMustacheTemplate(jsonBlob []byte) (string, error) {
-	template := string(jsonBlob)
+func (d packageDefinition) renderJsonMustacheTemplate(name string, jsonBlob []byte) (string, error) {
 	config, err := d.MergedConfig()
 	if err != nil {
 		log.Errorf("Unable to retrieve package definition configuration: %v", err)
 		return "", err
 	}
 
+	// universe templates refer to the package resources, e.g. docker images
+	if _, ok := config["resource"]; !ok && len(d.resourceJson) > 0 {
+		var resource map[string]interface{}
+		if err := json.Unmarshal(d.resourceJson, &resource); err != nil {
+			log.Errorf("Could not unmarshal resource.json: %v", err)
+			return "", err
+		}
+		config["resource"] = d.rewriteResource(resource, "resource", false)
+	}
+
 	// Render template with config
-	tmpl, err := mustache.ParseString(template)
+	json, err := renderTemplate(name, string(jsonBlob), config, d.strict)
 	if err != nil {
-		log.Errorf("Could not parse template: %v", err)
+		log.Errorf("Could not render template: %v", err)
 		return "", err
 	}
 
-	json := tmpl.Render(config)
-
 	return json, nil
 }
 
@@ -324,7 +532,12 @@ type zookeeperNode struct {
 }
 
 func (install *Install) getPackages() (PackageCollection, error) {
-	catalog, err := NewPackageCatalog(install.kv, RepositoryRoot)
+	repositories, err := install.getRepositories()
+	if err != nil {
+		return nil, err
+	}
+
+	catalog, err := NewPackageCatalog(install.kv, repositories)
 	if err != nil {
 		return nil, err
 	}
@@ -349,7 +562,9 @@ func (install *Install) getPackageByName(name string) (*Package, error) {
 	return nil, nil
 }
 
-func (install *Install) GetPackageDefinition(name string, version string, userConfig map[string]interface{}, apiConfig map[string]interface{}) (*packageDefinition, error) {
+// GetPackageDefinition loads a version of a package. When repository is
+// set, only versions from that repository are considered.
+func (install *Install) GetPackageDefinition(name string, version string, repository string, userConfig map[string]interface{}, apiConfig map[string]interface{}) (*packageDefinition, error) {
 	pkg, err := install.getPackageByName(name)
 	if err != nil {
 		return nil, err
@@ -359,12 +574,14 @@ func (install *Install) GetPackageDefinition(name string, version string, userCo
 		return nil, errors.New(fmt.Sprintf("Could not find %s package", name))
 	}
 
-	pkgVersion := pkg.FindPackageVersion(version)
-	if pkgVersion == nil {
-		return nil, errors.New(fmt.Sprintf("Could not find installable version for %s", name))
+	if repository != "" {
+		pkg, err = pkg.FromRepository(repository)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	repositories, err := install.Repositories()
+	pkgVersion, err := pkg.ResolvePackageVersion(version)
 	if err != nil {
 		return nil, err
 	}
@@ -376,38 +593,33 @@ func (install *Install) GetPackageDefinition(name string, version string, userCo
 		framework:         pkg.Framework,
 		apiConfig:         apiConfig,
 		userConfig:        userConfig,
+		strict:            install.StrictTemplates,
+		consul:            install.consul,
+		vault:             install.Vault,
+		vaultRequestPaths: install.VaultRequestPaths,
+		marathonSecrets:   install.VaultMarathonSecrets,
+		secrets:           newPackageSecrets(),
+		rewrites:          install.Rewrites,
+		applied:           &appliedRewrites{},
 		valueTransformers: valueTransformers,
+		valueResolvers:    valueResolvers,
 	}
 
-	for _, repo := range repositories {
-		pkgKey := path.Join(
-			repo.PackagesKey(),
-			pkg.PackageVersionKey(pkgVersion.Index),
-		)
+	files := map[string]*[]byte{
+		"command.json":   &pkgDef.commandJson,
+		"config.json":    &pkgDef.configJson,
+		"marathon.json":  &pkgDef.marathonJson,
+		"package.json":   &pkgDef.packageJson,
+		"mantl.json":     &pkgDef.optionsJson,
+		"uninstall.json": &pkgDef.uninstallJson,
+		"resource.json":  &pkgDef.resourceJson,
+	}
 
-		data := install.getPackageDefinitionFile("command.json", pkgKey)
-		if len(data) > 0 {
-			pkgDef.commandJson = data
-		}
-		data = install.getPackageDefinitionFile("config.json", pkgKey)
-		if len(data) > 0 {
-			pkgDef.configJson = data
-		}
-		data = install.getPackageDefinitionFile("marathon.json", pkgKey)
+	// every file comes from the repository the version belongs to
+	for name, field := range files {
+		data := install.getPackageDefinitionFile(name, pkgVersion.key)
 		if len(data) > 0 {
-			pkgDef.marathonJson = data
-		}
-		data = install.getPackageDefinitionFile("package.json", pkgKey)
-		if len(data) > 0 {
-			pkgDef.packageJson = data
-		}
-		data = install.getPackageDefinitionFile("mantl.json", pkgKey)
-		if len(data) > 0 {
-			pkgDef.optionsJson = data
-		}
-		data = install.getPackageDefinitionFile("uninstall.json", pkgKey)
-		if len(data) > 0 {
-			pkgDef.uninstallJson = data
+			*field = data
 		}
 	}
 
@@ -441,26 +653,36 @@ func (install *Install) getPackageDefinitionFile(name string, key string) []byte
 	return []byte{}
 }
 
-func (d packageDefinition) transformedConfigValue(val interface{}, typ string) interface{} {
+// transformedConfigValue transforms a config value, after resolving it
+// unless resolve is false.
+func (d packageDefinition) transformedConfigValue(val interface{}, typ string, resolve bool) (interface{}, error) {
 	// TODO: probably should use the config schema for this
 	if slice, ok := val.([]interface{}); ok {
 		// if the config val is an array, convert it to a json representation
 		blob, err := json.Marshal(slice)
 		if err == nil {
-			return string(blob)
+			return string(blob), nil
 		} else {
 			log.Warnf("Could not marshal %+v config value to json: %v", val, err)
-			return val
+			return val, nil
 		}
 	} else {
+		var err error
+		if resolve {
+			if val, err = d.resolveValue(val, false); err != nil {
+				return nil, err
+			}
+		}
 		for _, fn := range d.valueTransformers[typ] {
-			val = fn(val, d)
+			if val, err = fn(val, d); err != nil {
+				return nil, err
+			}
 		}
-		return val
+		return val, nil
 	}
 }
 
-func (d packageDefinition) mergeConfig(config map[string]interface{}, override map[string]interface{}, schema packageConfigGroup) map[string]interface{} {
+func (d packageDefinition) mergeConfig(config map[string]interface{}, override map[string]interface{}, schema packageConfigGroup, resolve bool) (map[string]interface{}, error) {
 	for k, v := range override {
 		_, configExists := config[k]
 
@@ -470,16 +692,20 @@ func (d packageDefinition) mergeConfig(config map[string]interface{}, override m
 			valType = valSchema.Type
 		}
 
+		var err error
 		configVal, configValIsMap := config[k].(map[string]interface{})
 		overrideVal, overrideValIsMap := v.(map[string]interface{})
 		if configExists && configValIsMap && overrideValIsMap {
-			config[k] = d.mergeConfig(configVal, overrideVal, valSchema)
+			config[k], err = d.mergeConfig(configVal, overrideVal, valSchema, resolve)
 		} else {
-			config[k] = d.transformedConfigValue(v, valType)
+			config[k], err = d.transformedConfigValue(v, valType, resolve)
+		}
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	return config
+	return config, nil
 }
 
 func getConfig(m map[string]interface{}, node string) interface{} {
@@ -463,7 +463,8 @@ func TestExtractDefaultValues(t *testing.T) {
 		valueTransformers: valueTransformers,
 	}
 	schema, _ := pkgDef.ConfigSchema()
-	defaults := schema.defaultConfig(*pkgDef)
+	defaults, err := schema.defaultConfig(*pkgDef)
+	assert.NoError(t, err)
 
 	assert.Equal(t, "zk://master.mesos:2181/mesos", getConfigVal(defaults, "mesos", "master"))
 	assert.Equal(t, ".", getConfigVal(defaults, "cassandra", "data-directory"))
@@ -550,3 +551,18 @@ func buildPackage(pkgVers []*PackageVersion, currentVersion string) *Package {
 
 	return pkg
 }
+
+func TestNewPackageRequestDefaultAction(t *testing.T) {
+	t.Parallel()
+	req, err := NewPackageRequest([]byte(`{"name": "cassandra"}`))
+	assert.Nil(t, err)
+	assert.Equal(t, InstallAction, req.Action)
+}
+
+func TestNewPackageRequestUnknownAction(t *testing.T) {
+	t.Parallel()
+	_, err := NewPackageRequest([]byte(`{"name": "cassandra", "action": "restart"}`))
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "Unknown action restart", err.Error())
+	}
+}
@@ -0,0 +1,542 @@
+package install
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/CiscoCloud/mantl-api/marathon"
+	log "github.com/Sirupsen/logrus"
+)
+
+const PoliciesRoot = "mantl-install/policies/"
+
+const (
+	PolicyEquals     = "equals"
+	PolicyNotEquals  = "not-equals"
+	PolicyPrefix     = "prefix"
+	PolicyMatches    = "matches"
+	PolicyNotMatches = "not-matches"
+	PolicyIn         = "in"
+	PolicyNotIn      = "not-in"
+	PolicyMax        = "max"
+	PolicyMin        = "min"
+	PolicyExists     = "exists"
+	PolicyAbsent     = "absent"
+)
+
+// PolicyRule is a requirement that every rendered Marathon app must meet.
+// Field is a dotted path into the app json, like container.docker.image.
+// A rule only applies to the packages it names, or to packages with one of
+// its tags, and never to the packages in Except.
+type PolicyRule struct {
+	Name     string      `json:"name"`
+	Message  string      `json:"message,omitempty"`
+	Field    string      `json:"field"`
+	Operator string      `json:"operator"`
+	Value    interface{} `json:"value,omitempty"`
+	Packages []string    `json:"packages,omitempty"`
+	Tags     []string    `json:"tags,omitempty"`
+	Except   []string    `json:"except,omitempty"`
+}
+
+type PolicyViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// PolicyError is returned when a package violates admission policies.
+type PolicyError struct {
+	Name       string
+	Violations []*PolicyViolation
+}
+
+func (e *PolicyError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		messages[i] = fmt.Sprintf("%s: %s", v.Rule, v.Message)
+	}
+	return fmt.Sprintf("Package %s violates policies: %s", e.Name, strings.Join(messages, "; "))
+}
+
+func (rule *PolicyRule) validate() error {
+	if rule.Field == "" && rule.Operator != "" {
+		return errors.New(fmt.Sprintf("Policy %s has no field", rule.Name))
+	}
+
+	switch rule.Operator {
+	case PolicyEquals, PolicyNotEquals, PolicyIn, PolicyNotIn, PolicyExists, PolicyAbsent:
+	case PolicyPrefix:
+		if _, ok := rule.Value.(string); !ok {
+			return errors.New(fmt.Sprintf("Policy %s needs a string value", rule.Name))
+		}
+	case PolicyMatches, PolicyNotMatches:
+		s, ok := rule.Value.(string)
+		if !ok {
+			return errors.New(fmt.Sprintf("Policy %s needs a regular expression value", rule.Name))
+		}
+		if _, err := regexp.Compile(s); err != nil {
+			return errors.New(fmt.Sprintf("Policy %s has an invalid regular expression: %v", rule.Name, err))
+		}
+	case PolicyMax, PolicyMin:
+		if _, ok := policyNumber(rule.Value); !ok {
+			return errors.New(fmt.Sprintf("Policy %s needs a numeric value", rule.Name))
+		}
+	default:
+		return errors.New(fmt.Sprintf("Policy %s has an unknown operator %q", rule.Name, rule.Operator))
+	}
+
+	return nil
+}
+
+func (rule *PolicyRule) appliesTo(name string, tags []string) bool {
+	for _, except := range rule.Except {
+		if strings.EqualFold(except, name) {
+			return false
+		}
+	}
+
+	if len(rule.Packages) == 0 && len(rule.Tags) == 0 {
+		return true
+	}
+
+	for _, pkg := range rule.Packages {
+		if strings.EqualFold(pkg, name) {
+			return true
+		}
+	}
+
+	for _, tag := range rule.Tags {
+		for _, t := range tags {
+			if strings.EqualFold(tag, t) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// check returns a violation when app doesn't meet the rule. Every value a
+// field resolves to must meet it; missing fields only violate exists.
+func (rule *PolicyRule) check(app map[string]interface{}) *PolicyViolation {
+	values := policyValues(app, strings.Split(rule.Field, "."))
+
+	violated := false
+	switch rule.Operator {
+	case PolicyExists:
+		violated = len(values) == 0
+	case PolicyAbsent:
+		violated = len(values) > 0
+	default:
+		for _, v := range values {
+			if !rule.holds(v) {
+				violated = true
+				break
+			}
+		}
+	}
+
+	if !violated {
+		return nil
+	}
+
+	message := rule.Message
+	if message == "" {
+		message = rule.describe(values)
+	}
+
+	return &PolicyViolation{Rule: rule.Name, Message: message}
+}
+
+func (rule *PolicyRule) holds(v interface{}) bool {
+	switch rule.Operator {
+	case PolicyEquals:
+		return policyEqual(v, rule.Value)
+	case PolicyNotEquals:
+		return !policyEqual(v, rule.Value)
+	case PolicyIn, PolicyNotIn:
+		found := false
+		if list, ok := rule.Value.([]interface{}); ok {
+			for _, item := range list {
+				if policyEqual(v, item) {
+					found = true
+				}
+			}
+		}
+		return found == (rule.Operator == PolicyIn)
+	case PolicyPrefix:
+		s, ok := v.(string)
+		return ok && strings.HasPrefix(s, rule.Value.(string))
+	case PolicyMatches, PolicyNotMatches:
+		re := regexp.MustCompile("^(?:" + rule.Value.(string) + ")$")
+		return re.MatchString(fmt.Sprintf("%v", v)) == (rule.Operator == PolicyMatches)
+	case PolicyMax, PolicyMin:
+		n, ok := policyNumber(v)
+		limit, _ := policyNumber(rule.Value)
+		if !ok {
+			return false
+		}
+		if rule.Operator == PolicyMax {
+			return n <= limit
+		}
+		return n >= limit
+	}
+	return false
+}
+
+var policyDescriptions = map[string]string{
+	PolicyEquals:     "be",
+	PolicyNotEquals:  "not be",
+	PolicyPrefix:     "start with",
+	PolicyMatches:    "match",
+	PolicyNotMatches: "not match",
+	PolicyIn:         "be one of",
+	PolicyNotIn:      "not be one of",
+	PolicyMax:        "be at most",
+	PolicyMin:        "be at least",
+}
+
+func (rule *PolicyRule) describe(values []interface{}) string {
+	switch rule.Operator {
+	case PolicyExists:
+		return fmt.Sprintf("%s must be set", rule.Field)
+	case PolicyAbsent:
+		return fmt.Sprintf("%s must not be set", rule.Field)
+	}
+
+	var found []string
+	for _, v := range values {
+		if !rule.holds(v) {
+			found = append(found, fmt.Sprintf("%v", v))
+		}
+	}
+
+	return fmt.Sprintf("%s must %s %v, found %s", rule.Field, policyDescriptions[rule.Operator], rule.Value, strings.Join(found, ", "))
+}
+
+// policyValues returns the values at path in v. Arrays along the path
+// resolve to the values of each of their elements.
+func policyValues(v interface{}, path []string) []interface{} {
+	if list, ok := v.([]interface{}); ok {
+		var values []interface{}
+		for _, item := range list {
+			values = append(values, policyValues(item, path)...)
+		}
+		return values
+	}
+
+	if len(path) == 0 {
+		if v == nil {
+			return nil
+		}
+		return []interface{}{v}
+	}
+
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	next, ok := m[path[0]]
+	if !ok {
+		return nil
+	}
+	return policyValues(next, path[1:])
+}
+
+func policyEqual(a interface{}, b interface{}) bool {
+	if an, ok := policyNumber(a); ok {
+		bn, ok := policyNumber(b)
+		return ok && an == bn
+	}
+	if as, ok := a.(string); ok {
+		bs, ok := b.(string)
+		return ok && strings.EqualFold(as, bs)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func policyNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// ParsePolicies parses the policies section of the configuration file,
+// which maps rule names to rules. Any invalid rule is an error, so that a
+// typo can't silently disable a rule.
+func ParsePolicies(config map[string]interface{}) ([]*PolicyRule, error) {
+	names := make([]string, 0, len(config))
+	for name := range config {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var rules []*PolicyRule
+	for _, name := range names {
+		blob, err := json.Marshal(config[name])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not parse policy %s: %v", name, err))
+		}
+
+		rule := &PolicyRule{}
+		if err := json.Unmarshal(blob, rule); err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not parse policy %s: %v", name, err))
+		}
+		if rule.Name == "" {
+			rule.Name = name
+		}
+		if err := rule.validate(); err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// policies returns the configured policies followed by those stored in
+// Consul under PoliciesRoot.
+func (install *Install) policies() ([]*PolicyRule, error) {
+	rules := append([]*PolicyRule{}, install.Policies...)
+
+	kvps, _, err := install.kv.List(PoliciesRoot, nil)
+	if err != nil {
+		log.Errorf("Could not retrieve %s keys: %v", PoliciesRoot, err)
+		return nil, err
+	}
+
+	for _, kvp := range kvps {
+		name := strings.TrimPrefix(kvp.Key, PoliciesRoot)
+		if name == "" || strings.HasSuffix(name, "/") {
+			continue
+		}
+
+		rule := &PolicyRule{}
+		if err := json.Unmarshal(kvp.Value, rule); err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not parse policy %s: %v", kvp.Key, err))
+		}
+		if rule.Name == "" {
+			rule.Name = path.Base(name)
+		}
+		rules = append(rules, rule)
+	}
+
+	for _, rule := range rules {
+		if err := rule.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	return rules, nil
+}
+
+// applicableRules returns the policies that apply to a package.
+func (install *Install) applicableRules(pkgDef *packageDefinition) ([]*PolicyRule, error) {
+	rules, err := install.policies()
+	if err != nil || len(rules) == 0 {
+		return nil, err
+	}
+
+	tags, err := pkgDef.Tags()
+	if err != nil {
+		return nil, err
+	}
+
+	var applicable []*PolicyRule
+	for _, rule := range rules {
+		if rule.appliesTo(pkgDef.name, tags) {
+			applicable = append(applicable, rule)
+		}
+	}
+	return applicable, nil
+}
+
+// policyJson returns v as it is submitted to Marathon, as generic json.
+func policyJson(v interface{}) (map[string]interface{}, error) {
+	blob, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(blob, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// policyViolations evaluates every applicable policy against an app.
+func (install *Install) policyViolations(app interface{}, pkgDef *packageDefinition) ([]*PolicyViolation, error) {
+	rules, err := install.applicableRules(pkgDef)
+	if err != nil || len(rules) == 0 {
+		return nil, err
+	}
+
+	appJson, err := policyJson(app)
+	if err != nil {
+		return nil, err
+	}
+
+	var violations []*PolicyViolation
+	for _, rule := range rules {
+		if violation := rule.check(appJson); violation != nil {
+			violations = append(violations, violation)
+		}
+	}
+
+	return violations, nil
+}
+
+// podContainerFields are the app fields that podContainerApp maps from the
+// containers of a pod.
+var podContainerFields = map[string]bool{
+	"container": true,
+	"cpus":      true,
+	"mem":       true,
+	"disk":      true,
+	"gpus":      true,
+	"env":       true,
+}
+
+// podNetworks maps the network modes of a pod to Docker networks of apps.
+var podNetworks = map[string]string{
+	"host":             "HOST",
+	"container/bridge": "BRIDGE",
+	"container":        "USER",
+}
+
+// podViolations evaluates the policies against a pod. Rules on the app
+// fields in podContainerFields are checked against every container of the
+// pod as it would look in an app, the others against the pod itself.
+func (install *Install) podViolations(pod *marathon.Pod, pkgDef *packageDefinition) ([]*PolicyViolation, error) {
+	rules, err := install.applicableRules(pkgDef)
+	if err != nil || len(rules) == 0 {
+		return nil, err
+	}
+
+	podJson, err := policyJson(pod)
+	if err != nil {
+		return nil, err
+	}
+	containers, _ := podJson["containers"].([]interface{})
+
+	var violations []*PolicyViolation
+	for _, rule := range rules {
+		if !podContainerFields[strings.Split(rule.Field, ".")[0]] || len(containers) == 0 {
+			if violation := rule.check(podJson); violation != nil {
+				violations = append(violations, violation)
+			}
+			continue
+		}
+
+		for i, c := range containers {
+			container, _ := c.(map[string]interface{})
+			name, ok := container["name"].(string)
+			if !ok || name == "" {
+				name = fmt.Sprintf("%d", i)
+			}
+			if violation := rule.check(podContainerApp(podJson, container)); violation != nil {
+				violations = append(violations, &PolicyViolation{Rule: violation.Rule, Message: fmt.Sprintf("container %s: %s", name, violation.Message)})
+			}
+		}
+	}
+
+	return violations, nil
+}
+
+// podContainerApp returns the app fields of a container of a pod.
+func podContainerApp(pod map[string]interface{}, container map[string]interface{}) map[string]interface{} {
+	app := map[string]interface{}{}
+
+	if resources, ok := container["resources"].(map[string]interface{}); ok {
+		for _, field := range []string{"cpus", "mem", "disk", "gpus"} {
+			app[field] = resources[field]
+		}
+	}
+
+	env := map[string]interface{}{}
+	for _, environment := range []interface{}{pod["environment"], container["environment"]} {
+		if m, ok := environment.(map[string]interface{}); ok {
+			for k, v := range m {
+				env[k] = v
+			}
+		}
+	}
+	if len(env) > 0 {
+		app["env"] = env
+	}
+
+	image, _ := container["image"].(map[string]interface{})
+	kind, _ := image["kind"].(string)
+	if image == nil || (kind != "" && !strings.EqualFold(kind, "DOCKER")) {
+		app["container"] = map[string]interface{}{"type": "MESOS"}
+		return app
+	}
+
+	docker := map[string]interface{}{
+		"image":          image["id"],
+		"forcePullImage": image["forcePull"],
+	}
+	if networks, ok := pod["networks"].([]interface{}); ok && len(networks) > 0 {
+		if network, ok := networks[0].(map[string]interface{}); ok {
+			if mode, ok := network["mode"].(string); ok {
+				docker["network"] = podNetworks[mode]
+			}
+		}
+	}
+	app["container"] = map[string]interface{}{"type": "DOCKER", "docker": docker}
+
+	return app
+}
+
+// deploymentViolations evaluates the policies against the app or pod of a
+// package, or against every app of its group.
+func (install *Install) deploymentViolations(d *packageDeployment, pkgDef *packageDefinition) ([]*PolicyViolation, error) {
+	switch {
+	case d.Pod != nil:
+		return install.podViolations(d.Pod, pkgDef)
+	case d.Group == nil:
+		return install.policyViolations(d.definition(), pkgDef)
+	}
+
+	var violations []*PolicyViolation
+	for _, app := range d.apps() {
+		appViolations, err := install.policyViolations(app, pkgDef)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range appViolations {
+			violations = append(violations, &PolicyViolation{Rule: v.Rule, Message: fmt.Sprintf("%s: %s", app.ID, v.Message)})
+		}
+	}
+
+	return violations, nil
+}
+
+// checkPolicies returns a PolicyError listing every policy the package
+// violates.
+func (install *Install) checkPolicies(d *packageDeployment, pkgDef *packageDefinition) error {
+	violations, err := install.deploymentViolations(d, pkgDef)
+	if err != nil {
+		return err
+	}
+	if len(violations) > 0 {
+		return &PolicyError{Name: pkgDef.name, Violations: violations}
+	}
+	return nil
+}
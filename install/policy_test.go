@@ -0,0 +1,166 @@
+package install
+
+import (
+	"testing"
+
+	"github.com/CiscoCloud/mantl-api/marathon"
+	"github.com/stretchr/testify/assert"
+)
+
+func policyApp() *marathon.App {
+	return &marathon.App{
+		ID:  "/kafka",
+		Mem: 8192,
+		Container: &marathon.Container{
+			Type: "DOCKER",
+			Docker: &marathon.Docker{
+				Image:      "docker.io/library/kafka:0.9",
+				Network:    "HOST",
+				Privileged: true,
+			},
+		},
+	}
+}
+
+func policyPackage(name string, tags string) *packageDefinition {
+	return &packageDefinition{
+		name:        name,
+		packageJson: []byte(`{"name": "` + name + `", "tags": [` + tags + `]}`),
+	}
+}
+
+var testPolicies = []*PolicyRule{
+	{Name: "no-privileged", Field: "container.docker.privileged", Operator: PolicyNotEquals, Value: true},
+	{Name: "no-host-network", Field: "container.docker.network", Operator: PolicyNotEquals, Value: "HOST", Except: []string{"traefik"}},
+	{Name: "registry", Field: "container.docker.image", Operator: PolicyPrefix, Value: "registry.example.com/", Message: "images must come from registry.example.com"},
+	{Name: "memory", Field: "mem", Operator: PolicyMax, Value: 4096.0, Tags: []string{"database"}},
+}
+
+func TestPolicyViolations(t *testing.T) {
+	t.Parallel()
+	ts, _, inst := fakeConsul()
+	defer ts.Close()
+	inst.Policies = testPolicies
+
+	violations, err := inst.policyViolations(policyApp(), policyPackage("kafka", `"database"`))
+	assert.NoError(t, err)
+	assert.Equal(t, []*PolicyViolation{
+		{Rule: "no-privileged", Message: "container.docker.privileged must not be true, found true"},
+		{Rule: "no-host-network", Message: "container.docker.network must not be HOST, found HOST"},
+		{Rule: "registry", Message: "images must come from registry.example.com"},
+		{Rule: "memory", Message: "mem must be at most 4096, found 8192"},
+	}, violations)
+
+	// exceptions and tags limit the packages a rule applies to
+	violations, err = inst.policyViolations(policyApp(), policyPackage("traefik", `"proxy"`))
+	assert.NoError(t, err)
+	assert.Len(t, violations, 2)
+
+	app := policyApp()
+	app.Mem = 1024
+	app.Container.Docker = &marathon.Docker{Image: "registry.example.com/kafka:0.9"}
+	err = inst.checkPolicies(&packageDeployment{App: app}, policyPackage("kafka", `"database"`))
+	assert.NoError(t, err)
+}
+
+func TestPodPolicyViolations(t *testing.T) {
+	t.Parallel()
+	ts, _, inst := fakeConsul()
+	defer ts.Close()
+	inst.Policies = append(testPolicies, &PolicyRule{Name: "labels", Field: "labels.OWNER", Operator: PolicyExists})
+
+	pod := &packageDeployment{Pod: &marathon.Pod{
+		ID: "/kafka",
+		Spec: map[string]interface{}{
+			"networks": []interface{}{map[string]interface{}{"mode": "host"}},
+			"containers": []interface{}{
+				map[string]interface{}{
+					"name":      "broker",
+					"resources": map[string]interface{}{"cpus": 1.0, "mem": 8192.0},
+					"image":     map[string]interface{}{"kind": "DOCKER", "id": "docker.io/library/kafka:0.9"},
+				},
+				map[string]interface{}{
+					"name":      "exporter",
+					"resources": map[string]interface{}{"cpus": 0.1, "mem": 128.0},
+					"image":     map[string]interface{}{"kind": "DOCKER", "id": "registry.example.com/kafka-exporter:1.0"},
+				},
+			},
+		},
+	}}
+
+	violations, err := inst.deploymentViolations(pod, policyPackage("kafka", `"database"`))
+	assert.NoError(t, err)
+	assert.Equal(t, []*PolicyViolation{
+		{Rule: "no-host-network", Message: "container broker: container.docker.network must not be HOST, found HOST"},
+		{Rule: "no-host-network", Message: "container exporter: container.docker.network must not be HOST, found HOST"},
+		{Rule: "registry", Message: "container broker: images must come from registry.example.com"},
+		{Rule: "memory", Message: "container broker: mem must be at most 4096, found 8192"},
+		{Rule: "labels", Message: "labels.OWNER must be set"},
+	}, violations)
+}
+
+func TestParsePolicies(t *testing.T) {
+	t.Parallel()
+
+	rules, err := ParsePolicies(map[string]interface{}{
+		"registry": map[string]interface{}{"field": "container.docker.image", "operator": "prefix", "value": "registry.example.com/"},
+		"memory":   map[string]interface{}{"field": "mem", "operator": "max", "value": 4096, "packages": []interface{}{"kafka"}},
+	})
+	assert.NoError(t, err)
+	if assert.Len(t, rules, 2) {
+		assert.Equal(t, "memory", rules[0].Name)
+		assert.Equal(t, []string{"kafka"}, rules[0].Packages)
+		assert.Equal(t, "registry", rules[1].Name)
+	}
+
+	// a list written as a string must not drop the rule
+	_, err = ParsePolicies(map[string]interface{}{
+		"memory": map[string]interface{}{"field": "mem", "operator": "max", "value": 4096, "packages": "kafka"},
+	})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Could not parse policy memory")
+	}
+
+	_, err = ParsePolicies(map[string]interface{}{
+		"memory": map[string]interface{}{"field": "mem", "operator": "at-most", "value": 4096},
+	})
+	assert.EqualError(t, err, `Policy memory has an unknown operator "at-most"`)
+}
+
+func TestPoliciesFromConsul(t *testing.T) {
+	t.Parallel()
+	ts, kv, inst := fakeConsul()
+	defer ts.Close()
+
+	kv.put(PoliciesRoot+"require-health-checks", []byte(`{"field": "healthChecks", "operator": "exists"}`))
+	kv.put(PoliciesRoot+"groups", []byte(`{"field": "id", "operator": "matches", "value": "/[a-z-]+/.+", "message": "apps must be deployed in a group"}`))
+
+	app := policyApp()
+	err := inst.checkPolicies(&packageDeployment{App: app}, policyPackage("kafka", ""))
+	if assert.IsType(t, &PolicyError{}, err) {
+		assert.Equal(t, "Package kafka violates policies: groups: apps must be deployed in a group; require-health-checks: healthChecks must be set", err.Error())
+	}
+
+	kv.put(PoliciesRoot+"invalid", []byte(`{"field": "mem", "operator": "max", "value": "a lot"}`))
+	err = inst.checkPolicies(&packageDeployment{App: app}, policyPackage("kafka", ""))
+	assert.EqualError(t, err, "Policy invalid needs a numeric value")
+}
+
+func TestPolicyValues(t *testing.T) {
+	t.Parallel()
+
+	app := map[string]interface{}{
+		"container": map[string]interface{}{
+			"volumes": []interface{}{
+				map[string]interface{}{"hostPath": "/var/run/docker.sock"},
+				map[string]interface{}{"containerPath": "/data"},
+			},
+		},
+	}
+
+	assert.Equal(t, []interface{}{"/var/run/docker.sock"}, policyValues(app, []string{"container", "volumes", "hostPath"}))
+	assert.Nil(t, policyValues(app, []string{"container", "docker", "image"}))
+
+	rule := &PolicyRule{Name: "docker-socket", Field: "container.volumes.hostPath", Operator: PolicyNotIn, Value: []interface{}{"/var/run/docker.sock"}}
+	assert.NotNil(t, rule.check(app))
+}
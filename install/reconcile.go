@@ -0,0 +1,335 @@
+package install
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/CiscoCloud/mantl-api/marathon"
+	log "github.com/Sirupsen/logrus"
+)
+
+const DesiredRoot = "mantl-install/desired/"
+
+const (
+	ReconcileInstall   = "install"
+	ReconcileUpgrade   = "upgrade"
+	ReconcileUninstall = "uninstall"
+	ReconcileSkip      = "skip"
+)
+
+type ReconcileAction struct {
+	Action           string `json:"action"`
+	Name             string `json:"name"`
+	AppID            string `json:"id,omitempty"`
+	Version          string `json:"version,omitempty"`
+	InstalledVersion string `json:"installedVersion,omitempty"`
+	Reason           string `json:"reason"`
+	Applied          bool   `json:"applied"`
+	Error            string `json:"error,omitempty"`
+	request          *PackageRequest
+	app              *marathon.App
+}
+
+type Reconciler struct {
+	install    *Install
+	File       string
+	Prune      bool
+	ReportOnly bool
+}
+
+type desiredPackage struct {
+	request *PackageRequest
+	version string
+	err     error
+}
+
+func NewReconciler(install *Install, file string, prune bool, reportOnly bool) *Reconciler {
+	return &Reconciler{install, file, prune, reportOnly}
+}
+
+func (r *Reconciler) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := r.Reconcile(); err != nil {
+			log.Errorf("Could not reconcile desired state: %v", err)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *Reconciler) Reconcile() ([]*ReconcileAction, error) {
+	actions, err := r.Plan()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, action := range actions {
+		if action.Action == ReconcileSkip {
+			log.Warnf("Skipping %s package: %s", action.Name, action.Reason)
+		} else {
+			log.Infof("Planned %s of %s package: %s", action.Action, action.Name, action.Reason)
+		}
+	}
+
+	if r.ReportOnly {
+		return actions, nil
+	}
+
+	return actions, r.install.applyReconcile(actions)
+}
+
+func (r *Reconciler) Plan() ([]*ReconcileAction, error) {
+	requests, err := r.DesiredState()
+	if err != nil {
+		return nil, err
+	}
+
+	desired, err := r.install.resolveDesired(requests)
+	if err != nil {
+		return nil, err
+	}
+
+	installed, err := r.install.installedApps()
+	if err != nil {
+		return nil, err
+	}
+
+	prune := r.Prune
+	if prune && len(desired) == 0 {
+		// an empty desired state is far more likely to be a misconfiguration
+		// than a request to remove every package
+		log.Warnf("Desired state is empty, not uninstalling any packages")
+		prune = false
+	}
+
+	return planReconcile(desired, installed, prune), nil
+}
+
+func (r *Reconciler) DesiredState() ([]*PackageRequest, error) {
+	if r.File != "" {
+		return desiredStateFromFile(r.File)
+	}
+	return r.install.desiredStateFromKV(DesiredRoot)
+}
+
+func desiredStateFromFile(file string) ([]*PackageRequest, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Errorf("Could not read desired state from %s: %v", file, err)
+		return nil, err
+	}
+
+	var requests []*PackageRequest
+	err = json.Unmarshal(data, &requests)
+	if err != nil {
+		log.Errorf("Could not unmarshal desired state from %s: %v", file, err)
+		return nil, err
+	}
+
+	for i, request := range requests {
+		if request.Name == "" {
+			return nil, errors.New(fmt.Sprintf("Name is required for package %d in %s", i, file))
+		}
+	}
+
+	return requests, nil
+}
+
+func (install *Install) desiredStateFromKV(prefix string) ([]*PackageRequest, error) {
+	kvps, _, err := install.kv.List(prefix, nil)
+	if err != nil {
+		log.Errorf("Could not retrieve %s keys: %v", prefix, err)
+		return nil, err
+	}
+
+	var requests []*PackageRequest
+	for _, kvp := range kvps {
+		name := strings.TrimPrefix(kvp.Key, prefix)
+		if name == "" || strings.HasSuffix(name, "/") {
+			continue
+		}
+
+		request := &PackageRequest{}
+		if len(kvp.Value) > 0 {
+			if err := json.Unmarshal(kvp.Value, request); err != nil {
+				return nil, errors.New(fmt.Sprintf("Could not parse desired package from %s: %v", kvp.Key, err))
+			}
+		}
+
+		// the key name doubles as the package name
+		if request.Name == "" {
+			request.Name = path.Base(name)
+		}
+
+		requests = append(requests, request)
+	}
+
+	return requests, nil
+}
+
+func (install *Install) resolveDesired(requests []*PackageRequest) ([]*desiredPackage, error) {
+	packages, err := install.getPackages()
+	if err != nil {
+		return nil, err
+	}
+
+	desired := make([]*desiredPackage, len(requests))
+	for i, request := range requests {
+		d := &desiredPackage{request: request}
+		desired[i] = d
+
+		var pkg *Package
+		for _, p := range packages {
+			if strings.EqualFold(strings.TrimSpace(request.Name), p.Name) {
+				pkg = p
+				break
+			}
+		}
+
+		if pkg == nil {
+			d.err = errors.New(fmt.Sprintf("Could not find %s package", request.Name))
+			continue
+		}
+
+		if request.Repository != "" {
+			var err error
+			pkg, err = pkg.FromRepository(request.Repository)
+			if err != nil {
+				d.err = err
+				continue
+			}
+		}
+
+		pkgVersion, err := pkg.ResolvePackageVersion(request.Version)
+		if err != nil {
+			d.err = err
+			continue
+		}
+		d.version = pkgVersion.Version
+	}
+
+	return desired, nil
+}
+
+func planReconcile(desired []*desiredPackage, installed []*marathon.App, prune bool) []*ReconcileAction {
+	actions := []*ReconcileAction{}
+	claimed := make(map[string]bool)
+
+	for _, d := range desired {
+		req := d.request
+		matching := filterByPackageName(req.Name, installed)
+		if req.AppID != "" {
+			matching = filterByID(req.AppID, matching)
+		}
+
+		for _, app := range matching {
+			claimed[app.ID] = true
+		}
+
+		action := &ReconcileAction{
+			Name:    req.Name,
+			AppID:   req.AppID,
+			Version: d.version,
+			request: req,
+		}
+
+		if d.err != nil {
+			action.Action = ReconcileSkip
+			action.Reason = d.err.Error()
+			actions = append(actions, action)
+			continue
+		}
+
+		switch len(matching) {
+		case 0:
+			action.Action = ReconcileInstall
+			action.Reason = "not installed"
+		case 1:
+			app := matching[0]
+			action.app = app
+			action.AppID = app.ID
+			action.InstalledVersion = app.Labels[packageVersionKey]
+
+			if action.InstalledVersion != d.version {
+				action.Action = ReconcileUpgrade
+				action.Reason = fmt.Sprintf("installed version %s differs from %s", action.InstalledVersion, d.version)
+			} else if hash, ok := app.Labels[packageConfigHashKey]; ok && hash != configHash(req.Config) {
+				action.Action = ReconcileUpgrade
+				action.Reason = "configuration changed"
+			} else {
+				continue
+			}
+		default:
+			action.Action = ReconcileSkip
+			action.Reason = fmt.Sprintf("there are %d instances of the %s package installed; include the application id", len(matching), req.Name)
+		}
+
+		actions = append(actions, action)
+	}
+
+	if prune {
+		for _, app := range filterPackages(installed) {
+			if claimed[app.ID] {
+				continue
+			}
+
+			actions = append(actions, &ReconcileAction{
+				Action:           ReconcileUninstall,
+				Name:             app.Labels[packageNameKey],
+				AppID:            app.ID,
+				InstalledVersion: app.Labels[packageVersionKey],
+				Reason:           "not in desired state",
+				app:              app,
+			})
+		}
+	}
+
+	return actions
+}
+
+func (install *Install) applyReconcile(actions []*ReconcileAction) error {
+	failed := 0
+	for _, action := range actions {
+		var err error
+		switch action.Action {
+		case ReconcileInstall:
+			_, _, err = install.InstallPackage(action.request)
+		case ReconcileUpgrade:
+			_, _, err = install.UpgradePackage(action.request, action.app)
+		case ReconcileUninstall:
+			err = install.CheckDependents(action.app)
+			if err == nil {
+				err = install.UninstallPackage(action.app)
+			}
+		default:
+			continue
+		}
+
+		if err != nil {
+			log.Errorf("Could not %s %s package: %v", action.Action, action.Name, err)
+			action.Error = err.Error()
+			failed++
+			continue
+		}
+
+		action.Applied = true
+	}
+
+	if failed > 0 {
+		return errors.New(fmt.Sprintf("%d of %d reconcile actions failed", failed, len(actions)))
+	}
+
+	return nil
+}
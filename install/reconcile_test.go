@@ -0,0 +1,107 @@
+package install
+
+import (
+	"errors"
+	"github.com/CiscoCloud/mantl-api/marathon"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+var installedApps = []*marathon.App{
+	&marathon.App{
+		ID: "/kafka",
+		Labels: map[string]string{
+			packageNameKey:    "kafka",
+			packageVersionKey: "0.9.4.0",
+		},
+	},
+	&marathon.App{
+		ID: "/elasticsearch",
+		Labels: map[string]string{
+			packageNameKey:       "elasticsearch",
+			packageVersionKey:    "0.4.0",
+			packageConfigHashKey: configHash(map[string]interface{}{"nodes": 3}),
+		},
+	},
+	&marathon.App{
+		ID: "/notapackage",
+	},
+}
+
+func desired(name string, version string, config map[string]interface{}) *desiredPackage {
+	return &desiredPackage{
+		request: &PackageRequest{Name: name, Config: config},
+		version: version,
+	}
+}
+
+func actionsByName(actions []*ReconcileAction) map[string]*ReconcileAction {
+	m := make(map[string]*ReconcileAction)
+	for _, action := range actions {
+		m[action.Name] = action
+	}
+	return m
+}
+
+func TestPlanReconcileConverged(t *testing.T) {
+	t.Parallel()
+	actions := planReconcile([]*desiredPackage{
+		desired("kafka", "0.9.4.0", nil),
+		desired("elasticsearch", "0.4.0", map[string]interface{}{"nodes": 3}),
+	}, installedApps, true)
+	assert.Equal(t, 0, len(actions))
+}
+
+func TestPlanReconcileInstall(t *testing.T) {
+	t.Parallel()
+	actions := planReconcile([]*desiredPackage{
+		desired("kafka", "0.9.4.0", nil),
+		desired("elasticsearch", "0.4.0", map[string]interface{}{"nodes": 3}),
+		desired("cassandra", "0.2.0", nil),
+	}, installedApps, true)
+	if assert.Equal(t, 1, len(actions)) {
+		assert.Equal(t, ReconcileInstall, actions[0].Action)
+		assert.Equal(t, "cassandra", actions[0].Name)
+	}
+}
+
+func TestPlanReconcileUpgrade(t *testing.T) {
+	t.Parallel()
+	actions := actionsByName(planReconcile([]*desiredPackage{
+		desired("kafka", "0.9.5.0", nil),
+		desired("elasticsearch", "0.4.0", map[string]interface{}{"nodes": 5}),
+	}, installedApps, true))
+	assert.Equal(t, 2, len(actions))
+	assert.Equal(t, ReconcileUpgrade, actions["kafka"].Action)
+	assert.Equal(t, "0.9.4.0", actions["kafka"].InstalledVersion)
+	assert.Equal(t, "/kafka", actions["kafka"].AppID)
+	assert.Equal(t, ReconcileUpgrade, actions["elasticsearch"].Action)
+	assert.Equal(t, "configuration changed", actions["elasticsearch"].Reason)
+}
+
+func TestPlanReconcilePrune(t *testing.T) {
+	t.Parallel()
+	pkgs := []*desiredPackage{desired("kafka", "0.9.4.0", nil)}
+
+	actions := planReconcile(pkgs, installedApps, true)
+	if assert.Equal(t, 1, len(actions)) {
+		assert.Equal(t, ReconcileUninstall, actions[0].Action)
+		assert.Equal(t, "/elasticsearch", actions[0].AppID)
+	}
+
+	actions = planReconcile(pkgs, installedApps, false)
+	assert.Equal(t, 0, len(actions))
+}
+
+func TestPlanReconcileSkip(t *testing.T) {
+	t.Parallel()
+	unresolved := desired("missing", "", nil)
+	unresolved.err = errors.New("Could not find missing package")
+
+	actions := actionsByName(planReconcile([]*desiredPackage{
+		unresolved,
+		desired("example", "1.0", nil),
+	}, apps, false))
+	assert.Equal(t, ReconcileSkip, actions["missing"].Action)
+	assert.Equal(t, ReconcileSkip, actions["example"].Action)
+}
@@ -1,6 +1,7 @@
 package install
 
 import (
+	"errors"
 	"fmt"
 	"path"
 	"sort"
@@ -8,26 +9,48 @@ import (
 	"strings"
 
 	log "github.com/Sirupsen/logrus"
+	consul "github.com/hashicorp/consul/api"
 )
 
 const (
 	RepositoryRoot = "mantl-install/repository"
 	AppsRoot       = "mantl-install/apps/"
+	StatusRoot     = "mantl-install/status/"
+	FailedRoot     = "mantl-install/failed/"
 )
 
 type Repository struct {
-	Name  string
-	Index int
+	Name       string
+	Index      int
+	Generation string
 }
 
 type RepositoryCollection []*Repository
 
 func (r Repository) PackagesKey() string {
-	return path.Join(
-		RepositoryRoot,
-		fmt.Sprintf("%d", r.Index),
-		"repo/packages",
-	)
+	// repositories synced before catalog generations were introduced
+	// keep their packages directly under the repository root
+	if r.Generation == "" {
+		return path.Join(repositoryKey(r.Index), "repo/packages")
+	}
+
+	return path.Join(generationKey(r.Index, r.Generation), "repo/packages")
+}
+
+func repositoryKey(idx int) string {
+	return path.Join(RepositoryRoot, fmt.Sprintf("%d", idx))
+}
+
+func generationKey(idx int, generation string) string {
+	return path.Join(repositoryKey(idx), "versions", generation)
+}
+
+func activeGenerationKey(idx int) string {
+	return path.Join(repositoryKey(idx), "active")
+}
+
+func previousGenerationKey(idx int) string {
+	return path.Join(repositoryKey(idx), "previous")
 }
 
 func (install *Install) getRepositories() (RepositoryCollection, error) {
@@ -44,9 +67,16 @@ func (install *Install) getRepositories() (RepositoryCollection, error) {
 			continue
 		}
 
+		generation, err := install.repositoryGeneration(idx)
+		if err != nil {
+			log.Warnf("Could not find active generation for repository %d: %v", idx, err)
+			continue
+		}
+
 		repositories = append(repositories, &Repository{
-			Index: idx,
-			Name:  name,
+			Index:      idx,
+			Name:       name,
+			Generation: generation,
 		})
 	}
 
@@ -54,7 +84,7 @@ func (install *Install) getRepositories() (RepositoryCollection, error) {
 }
 
 func (install *Install) repositoryName(idx int) (string, error) {
-	key := path.Join(RepositoryRoot, fmt.Sprintf("%d", idx), "name")
+	key := path.Join(repositoryKey(idx), "name")
 	kp, _, err := install.kv.Get(key, nil)
 	if err != nil || kp == nil {
 		log.Errorf("Could not retrieve repository name from %s: %v", key, err)
@@ -64,6 +94,90 @@ func (install *Install) repositoryName(idx int) (string, error) {
 	return string(kp.Value), nil
 }
 
+func (install *Install) repositoryGeneration(idx int) (string, error) {
+	kp, _, err := install.kv.Get(activeGenerationKey(idx), nil)
+	if err != nil || kp == nil {
+		return "", err
+	}
+
+	return string(kp.Value), nil
+}
+
+func (install *Install) repositoryGenerations(idx int) ([]string, error) {
+	prefix := path.Join(repositoryKey(idx), "versions") + "/"
+	keys, _, err := install.kv.Keys(prefix, "/", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var generations []string
+	for _, key := range keys {
+		generations = append(generations, strings.TrimSuffix(strings.TrimPrefix(key, prefix), "/"))
+	}
+
+	return generations, nil
+}
+
+// RestoreRepository makes the previous catalog generation of a repository
+// active again. The replaced generation becomes the previous one, so a
+// restore can itself be undone.
+func (install *Install) RestoreRepository(idx int) error {
+	active, _, err := install.kv.Get(activeGenerationKey(idx), nil)
+	if err != nil {
+		return err
+	}
+
+	previous, _, err := install.kv.Get(previousGenerationKey(idx), nil)
+	if err != nil {
+		return err
+	}
+
+	if active == nil || previous == nil || len(previous.Value) == 0 {
+		return errors.New(fmt.Sprintf("Repository %d has no previous generation to restore", idx))
+	}
+
+	ops := consul.KVTxnOps{
+		&consul.KVTxnOp{
+			Verb:  consul.KVCAS,
+			Key:   active.Key,
+			Value: previous.Value,
+			Index: active.ModifyIndex,
+		},
+		&consul.KVTxnOp{
+			Verb:  string(consul.KVSet),
+			Key:   previous.Key,
+			Value: active.Value,
+		},
+	}
+
+	err = install.commitTxn(ops)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Restored generation %s of repository %d (replacing %s)", previous.Value, idx, active.Value)
+	return nil
+}
+
+func (install *Install) commitTxn(ops consul.KVTxnOps) error {
+	ok, response, _, err := install.kv.Txn(ops, nil)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		var errs []string
+		if response != nil {
+			for _, txnErr := range response.Errors {
+				errs = append(errs, fmt.Sprintf("%s: %s", ops[txnErr.OpIndex].Key, txnErr.What))
+			}
+		}
+		return errors.New(fmt.Sprintf("Consul transaction rolled back: %s", strings.Join(errs, ", ")))
+	}
+
+	return nil
+}
+
 func (install *Install) repositoryIndexes() ([]int, error) {
 	// retrieves repository indexes like [0, 1, ...] from mantl-install/repository/
 	indexes, _, err := install.kv.Keys(RepositoryRoot+"/", "/", nil)
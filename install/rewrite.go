@@ -0,0 +1,175 @@
+package install
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/CiscoCloud/mantl-api/marathon"
+	log "github.com/Sirupsen/logrus"
+)
+
+// RewriteRule replaces the From prefix of an image or url with To.
+type RewriteRule struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Rewrites map Docker registries and artifact urls to mirrors, for clusters
+// that can't reach the internet.
+type Rewrites struct {
+	Images []RewriteRule `json:"images"`
+	URLs   []RewriteRule `json:"urls"`
+}
+
+// AppliedRewrite records a single rewrite of a package.
+type AppliedRewrite struct {
+	Field string `json:"field"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+}
+
+type appliedRewrites struct {
+	list []*AppliedRewrite
+}
+
+func (a *appliedRewrites) add(field string, from string, to string) {
+	if a == nil {
+		return
+	}
+	for _, r := range a.list {
+		if r.Field == field && r.From == from {
+			return
+		}
+	}
+	log.Infof("Rewriting %s from %s to %s", field, from, to)
+	a.list = append(a.list, &AppliedRewrite{Field: field, From: from, To: to})
+}
+
+func (r Rewrites) IsEmpty() bool {
+	return len(r.Images) == 0 && len(r.URLs) == 0
+}
+
+// rewrite applies the rule with the longest matching prefix.
+func rewrite(rules []RewriteRule, candidates ...string) (string, bool) {
+	var match *RewriteRule
+	var rest string
+	for i, rule := range rules {
+		if rule.From == "" {
+			continue
+		}
+		for _, candidate := range candidates {
+			if strings.HasPrefix(candidate, rule.From) && (match == nil || len(rule.From) > len(match.From)) {
+				match = &rules[i]
+				rest = strings.TrimPrefix(candidate, rule.From)
+			}
+		}
+	}
+
+	if match == nil {
+		return "", false
+	}
+	return match.To + rest, true
+}
+
+// Image rewrites a Docker image. Images without a registry are on Docker
+// Hub, so rules for docker.io/ match them as well.
+func (r Rewrites) Image(image string) (string, bool) {
+	return rewrite(r.Images, image, qualifiedImage(image))
+}
+
+func (r Rewrites) URL(url string) (string, bool) {
+	return rewrite(r.URLs, url)
+}
+
+// qualifiedImage adds the implicit docker.io registry and library namespace
+// to an image name.
+func qualifiedImage(image string) string {
+	parts := strings.SplitN(image, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		return image
+	}
+	if len(parts) == 1 {
+		return "docker.io/library/" + image
+	}
+	return "docker.io/" + image
+}
+
+// rewriteApp rewrites the Docker image, uris, fetch uris and store urls of
+// app.
+func (d packageDefinition) rewriteApp(app *marathon.App) {
+	if d.rewrites.IsEmpty() {
+		return
+	}
+
+	if app.Container != nil && app.Container.Docker != nil {
+		if image, ok := d.rewrites.Image(app.Container.Docker.Image); ok {
+			d.applied.add("container.docker.image", app.Container.Docker.Image, image)
+			app.Container.Docker.Image = image
+		}
+	}
+
+	for i, uri := range app.Uris {
+		if rewritten, ok := d.rewrites.URL(uri); ok {
+			d.applied.add(fmt.Sprintf("uris.%d", i), uri, rewritten)
+			app.Uris[i] = rewritten
+		}
+	}
+
+	for i, fetch := range app.Fetch {
+		if rewritten, ok := d.rewrites.URL(fetch.URI); ok {
+			d.applied.add(fmt.Sprintf("fetch.%d.uri", i), fetch.URI, rewritten)
+			app.Fetch[i].URI = rewritten
+		}
+	}
+
+	for i, url := range app.StoreUrls {
+		if rewritten, ok := d.rewrites.URL(url); ok {
+			d.applied.add(fmt.Sprintf("storeUrls.%d", i), url, rewritten)
+			app.StoreUrls[i] = rewritten
+		}
+	}
+}
+
+// rewriteResource rewrites the images and urls in the resource.json of a
+// package before it is rendered into the templates.
+func (d packageDefinition) rewriteResource(v interface{}, field string, image bool) interface{} {
+	return walkReferences(v, field, image, func(field string, value string, image bool) string {
+		rewrite := d.rewrites.URL
+		if image {
+			rewrite = d.rewrites.Image
+		}
+		if rewritten, ok := rewrite(value); ok {
+			d.applied.add(field, value, rewritten)
+			return rewritten
+		}
+		return value
+	})
+}
+
+// walkReferences calls fn with every image and url in v and replaces them
+// with its result. Strings below a docker key are images, other strings are
+// urls when they contain a scheme.
+func walkReferences(v interface{}, field string, image bool, fn func(field string, value string, image bool) string) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, item := range val {
+			val[k] = walkReferences(item, joinField(field, k), image || k == "docker", fn)
+		}
+	case []interface{}:
+		for i, item := range val {
+			val[i] = walkReferences(item, joinField(field, fmt.Sprintf("%d", i)), image, fn)
+		}
+	case string:
+		if image || strings.Contains(val, "://") {
+			return fn(field, val, image)
+		}
+	}
+	return v
+}
+
+func joinField(field string, key string) string {
+	if field == "" {
+		return key
+	}
+	return field + "." + key
+}
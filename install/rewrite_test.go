@@ -0,0 +1,81 @@
+package install
+
+import (
+	"testing"
+
+	"github.com/CiscoCloud/mantl-api/marathon"
+	"github.com/stretchr/testify/assert"
+)
+
+var testRewrites = Rewrites{
+	Images: []RewriteRule{
+		{From: "docker.io/", To: "registry.example.com/dockerhub/"},
+		{From: "docker.io/library/", To: "registry.example.com/library/"},
+		{From: "quay.io/", To: "registry.example.com/quay/"},
+	},
+	URLs: []RewriteRule{
+		{From: "https://downloads.mesosphere.com/", To: "http://mirror.example.com/mesosphere/"},
+	},
+}
+
+func TestRewriteImage(t *testing.T) {
+	t.Parallel()
+
+	for image, expected := range map[string]string{
+		"kafka:0.9":                      "registry.example.com/library/kafka:0.9",
+		"ciscocloud/mesos-kafka:0.9":     "registry.example.com/dockerhub/ciscocloud/mesos-kafka:0.9",
+		"docker.io/library/kafka":        "registry.example.com/library/kafka",
+		"quay.io/coreos/etcd:v2.3":       "registry.example.com/quay/coreos/etcd:v2.3",
+		"localhost:5000/kafka":           "",
+		"registry.example.com/kafka:0.9": "",
+	} {
+		rewritten, ok := testRewrites.Image(image)
+		assert.Equal(t, expected != "", ok, image)
+		assert.Equal(t, expected, rewritten, image)
+	}
+}
+
+func TestRewriteApp(t *testing.T) {
+	t.Parallel()
+
+	pkgDef := packageDefinition{rewrites: testRewrites, applied: &appliedRewrites{}}
+	app := &marathon.App{
+		Container: &marathon.Container{Docker: &marathon.Docker{Image: "mesosphere/kafka:1.0"}},
+		Uris:      []string{"https://downloads.mesosphere.com/kafka/scheduler.tgz", "http://example.com/config.json"},
+		StoreUrls: []string{"https://downloads.mesosphere.com/kafka/store"},
+	}
+	pkgDef.rewriteApp(app)
+
+	assert.Equal(t, "registry.example.com/dockerhub/mesosphere/kafka:1.0", app.Container.Docker.Image)
+	assert.Equal(t, []string{"http://mirror.example.com/mesosphere/kafka/scheduler.tgz", "http://example.com/config.json"}, app.Uris)
+	assert.Equal(t, []string{"http://mirror.example.com/mesosphere/kafka/store"}, app.StoreUrls)
+	assert.Equal(t, []*AppliedRewrite{
+		{Field: "container.docker.image", From: "mesosphere/kafka:1.0", To: "registry.example.com/dockerhub/mesosphere/kafka:1.0"},
+		{Field: "uris.0", From: "https://downloads.mesosphere.com/kafka/scheduler.tgz", To: "http://mirror.example.com/mesosphere/kafka/scheduler.tgz"},
+		{Field: "storeUrls.0", From: "https://downloads.mesosphere.com/kafka/store", To: "http://mirror.example.com/mesosphere/kafka/store"},
+	}, pkgDef.applied.list)
+}
+
+func TestRewriteResource(t *testing.T) {
+	t.Parallel()
+
+	pkgDef := packageDefinition{rewrites: testRewrites, applied: &appliedRewrites{}}
+	resource := map[string]interface{}{
+		"assets": map[string]interface{}{
+			"uris": map[string]interface{}{
+				"scheduler": "https://downloads.mesosphere.com/kafka/scheduler.tgz",
+			},
+			"container": map[string]interface{}{
+				"docker": map[string]interface{}{"kafka": "mesosphere/kafka:1.0"},
+			},
+		},
+		"name": "kafka",
+	}
+
+	rewritten := pkgDef.rewriteResource(resource, "resource", false).(map[string]interface{})
+	assets := rewritten["assets"].(map[string]interface{})
+	assert.Equal(t, "http://mirror.example.com/mesosphere/kafka/scheduler.tgz", assets["uris"].(map[string]interface{})["scheduler"])
+	assert.Equal(t, "registry.example.com/dockerhub/mesosphere/kafka:1.0", assets["container"].(map[string]interface{})["docker"].(map[string]interface{})["kafka"])
+	assert.Equal(t, "kafka", rewritten["name"])
+	assert.Len(t, pkgDef.applied.list, 2)
+}
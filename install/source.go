@@ -1,13 +1,16 @@
 package install
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
+	"strconv"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -17,30 +20,212 @@ import (
 const (
 	FileSystem = iota
 	Git
+	HTTP
 )
 
 type SourceType uint8
 
 type Source struct {
-	Name       string
-	Path       string
-	SourceType SourceType
-	Branch     string
-	Index      int
+	Name            string
+	Path            string
+	SourceType      SourceType
+	Branch          string
+	Index           int
+	RefreshInterval time.Duration
+	SHA256          string
+	Ref             string
+	Subdirectory    string
+	SSHKey          string
+	Token           string
+	// Timeout and MaxSize limit the download of http sources; zero values
+	// use the defaults
+	Timeout time.Duration
+	MaxSize int64
+}
+
+const (
+	defaultDownloadTimeout = 5 * time.Minute
+	defaultMaxSourceSize   = 512 << 20
+)
+
+func (source *Source) downloadTimeout() time.Duration {
+	if source.Timeout > 0 {
+		return source.Timeout
+	}
+	return defaultDownloadTimeout
+}
+
+// maxSize is the limit of both the download and the extracted content of an
+// http source.
+func (source *Source) maxSize() int64 {
+	if source.MaxSize > 0 {
+		return source.MaxSize
+	}
+	return defaultMaxSourceSize
+}
+
+type fetchedSource struct {
+	path      string
+	meta      map[string]string
+	unchanged bool
+	cleanup   func()
 }
 
 func (s Source) IsValid() bool {
 	return (s.Name != "" && s.Path != "")
 }
 
-func (install *Install) syncSource(source *Source) error {
+// syncSource fetches the source and writes it to a new catalog generation.
+// Unless force is set, nothing is written when the fetched content matches
+// the hash recorded by the last sync. It reports whether a sync happened.
+func (install *Install) syncSource(source *Source, force bool, lock *sourceLock) (bool, error) {
+	fetched, err := install.fetchSource(source, force)
+	if err != nil {
+		return false, err
+	}
+	defer fetched.cleanup()
+
+	if fetched.unchanged {
+		log.Debugf("%s source is unchanged", source.Name)
+		return false, nil
+	}
+
+	sourcePath := fetched.path
+	if info, err := os.Stat(sourcePath); err == nil && info.Mode().IsRegular() {
+		converted, cleanup, err := fileSource(sourcePath)
+		if err != nil {
+			return false, err
+		}
+		defer cleanup()
+		sourcePath = converted
+	}
+
+	hash, err := hashSource(sourcePath)
+	if err != nil {
+		return false, err
+	}
+
+	if !force {
+		current, err := install.sourceMeta(source, "hash")
+		if err != nil {
+			return false, err
+		}
+		if current == hash {
+			log.Debugf("%s source is unchanged (%s)", source.Name, hash)
+			return false, nil
+		}
+	}
+
+	// empty values clear meta data left behind by a different source type
+	meta := map[string]string{
+		"hash":          hash,
+		"commit":        "",
+		"etag":          "",
+		"last-modified": "",
+		"sha256":        "",
+	}
+	for k, v := range fetched.meta {
+		meta[k] = v
+	}
+	return true, install.sync(source, sourcePath, meta, lock)
+}
+
+func (install *Install) fetchSource(source *Source, force bool) (*fetchedSource, error) {
 	switch source.SourceType {
 	case FileSystem:
-		return install.sync(source, source.Path)
+		return &fetchedSource{path: source.Path, cleanup: func() {}}, nil
 	case Git:
-		return install.syncGitSource(source)
+		return install.fetchGitSource(source)
+	case HTTP:
+		return install.fetchHTTPSource(source, force)
 	}
-	return errors.New("Unknown source type")
+	return nil, errors.New("Unknown source type")
+}
+
+// RefreshSources periodically syncs every source that has a refresh
+// interval until stop is closed.
+func (install *Install) RefreshSources(sources []*Source, stop <-chan struct{}) {
+	var wg sync.WaitGroup
+	for _, source := range sources {
+		if source.RefreshInterval <= 0 {
+			continue
+		}
+
+		wg.Add(1)
+		go func(source *Source) {
+			defer wg.Done()
+			install.refreshSource(source, stop)
+		}(source)
+	}
+	wg.Wait()
+}
+
+func (install *Install) refreshSource(source *Source, stop <-chan struct{}) {
+	log.Infof("Refreshing %s source every %v", source.Name, source.RefreshInterval)
+	ticker := time.NewTicker(source.RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		lock, err := install.lockSource(source)
+		if err != nil {
+			log.Warnf("Skipping refresh of %s source: %v", source.Name, err)
+			continue
+		}
+
+		synced, err := install.syncSource(source, false, lock)
+		install.unlockSource(source, lock)
+
+		if err != nil {
+			log.Errorf("Could not refresh %s source from %s: %v", source.Name, source.displayPath(), err)
+		} else if synced {
+			log.Infof("Refreshed %s source from %s", source.Name, source.displayPath())
+		}
+	}
+}
+
+func (install *Install) sourceMeta(source *Source, name string) (string, error) {
+	kp, _, err := install.kv.Get(path.Join(source.rootKey(), name), nil)
+	if err != nil || kp == nil {
+		return "", err
+	}
+	return string(kp.Value), nil
+}
+
+// hashSource computes a digest over the paths and contents of every artifact
+// that a sync would write.
+func hashSource(sourcePath string) (string, error) {
+	hash := sha256.New()
+	err := filepath.Walk(sourcePath, func(filePath string, f os.FileInfo, e error) error {
+		if e != nil || f.IsDir() || filepath.Ext(filePath) != ".json" {
+			return e
+		}
+
+		relkey, err := filepath.Rel(sourcePath, filePath)
+		if err != nil {
+			return err
+		}
+
+		data, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(hash, "%s\x00%d\x00", filepath.ToSlash(relkey), len(data))
+		hash.Write(data)
+		return nil
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
 func (install *Install) sourceLastUpdated(source *Source) (time.Time, error) {
@@ -57,9 +242,20 @@ func (install *Install) sourceLastUpdated(source *Source) (time.Time, error) {
 	return ts, nil
 }
 
-func (install *Install) sync(source *Source, sourcePath string) error {
-	// TODO: lock or something to prevent simultaneous syncs?
-	err := filepath.Walk(sourcePath, func(filePath string, f os.FileInfo, e error) error {
+func (install *Install) sync(source *Source, sourcePath string, meta map[string]string, lock *sourceLock) error {
+	active, _, err := install.kv.Get(activeGenerationKey(source.Index), nil)
+	if err != nil {
+		return err
+	}
+
+	generation, err := install.nextGeneration(source)
+	if err != nil {
+		return err
+	}
+
+	// stage the new catalog where readers won't see it until it is activated
+	stagingKey := generationKey(source.Index, generation)
+	err = filepath.Walk(sourcePath, func(filePath string, f os.FileInfo, e error) error {
 		var err error
 		var relkey string
 		if isSourceArtifact(filePath) {
@@ -68,7 +264,7 @@ func (install *Install) sync(source *Source, sourcePath string) error {
 			if err == nil {
 				data, err = ioutil.ReadFile(filePath)
 				if err == nil {
-					key := path.Join(source.rootKey(), relkey)
+					key := path.Join(stagingKey, relkey)
 					err = install.addSourceArtifact(key, data)
 				} else {
 					log.Errorf("Could not read file %v: %v", filePath, err)
@@ -78,75 +274,124 @@ func (install *Install) sync(source *Source, sourcePath string) error {
 		return err
 	})
 
-	if err != nil {
-		return err
+	if err == nil {
+		err = install.activateGeneration(source, active, generation, meta, lock)
 	}
 
-	err = install.setName(source)
 	if err != nil {
-		log.Errorf("Could not write %s name: %v", source.Name, err)
+		log.Errorf("Could not sync %s source, discarding generation %s: %v", source.Name, generation, err)
+		if _, delErr := install.kv.DeleteTree(stagingKey+"/", nil); delErr != nil {
+			log.Warnf("Could not delete %s: %v", stagingKey, delErr)
+		}
 		return err
 	}
 
-	err = install.setTimestamp(source)
+	log.Infof("Activated generation %s of %s source", generation, source.Name)
+	return nil
+}
+
+func (install *Install) nextGeneration(source *Source) (string, error) {
+	generations, err := install.repositoryGenerations(source.Index)
 	if err != nil {
-		log.Errorf("Could not write %s timestamp: %v", source.Name, err)
-		return err
+		return "", err
 	}
 
-	return nil
+	next := 1
+	for _, generation := range generations {
+		if n, err := strconv.Atoi(generation); err == nil && n >= next {
+			next = n + 1
+		}
+	}
+
+	return strconv.Itoa(next), nil
 }
 
-func (install *Install) syncGitSource(source *Source) error {
-	temp, err := ioutil.TempDir(os.TempDir(), "mantl-install")
-	if err != nil {
-		return err
+// activateGeneration atomically points the repository at the staged
+// generation, keeping the one it replaces as the previous generation and
+// removing everything older. The transaction fails if the sync lock was
+// lost, so a sync that was taken over can't activate a stale generation.
+func (install *Install) activateGeneration(source *Source, active *consul.KVPair, generation string, meta map[string]string, lock *sourceLock) error {
+	if !lock.held() {
+		return errors.New(fmt.Sprintf("Lost %s source sync lock", source.Name))
 	}
-	defer os.RemoveAll(temp)
 
-	dest := path.Join(temp, source.Name)
-	log.Debugf("Cloning %s into %s", source.Path, dest)
-	// only clone a single commit from master, rather than all branches
-	gitArgs := []string{
-		"clone", source.Path, dest,
-		"--single-branch", "--depth", "1",
+	ts := time.Now().UTC().Format(time.UnixDate)
+	root := source.rootKey()
+
+	var activeIndex uint64
+	keep := map[string]bool{generation: true}
+	ops := consul.KVTxnOps{}
+	if fence := lock.fence(); fence != nil {
+		ops = append(ops, fence)
 	}
 
-	if source.Branch != "" {
-		gitArgs = append(gitArgs, "--branch", source.Branch)
+	if active != nil {
+		activeIndex = active.ModifyIndex
+		keep[string(active.Value)] = true
+		ops = append(ops, &consul.KVTxnOp{
+			Verb:  string(consul.KVSet),
+			Key:   previousGenerationKey(source.Index),
+			Value: active.Value,
+		})
 	}
 
-	log.Debugf("Running git with args: %v", gitArgs)
-	err = exec.Command("git", gitArgs...).Run()
+	ops = append(ops,
+		&consul.KVTxnOp{
+			Verb:  consul.KVCAS,
+			Key:   activeGenerationKey(source.Index),
+			Value: []byte(generation),
+			Index: activeIndex,
+		},
+		&consul.KVTxnOp{
+			Verb:  string(consul.KVSet),
+			Key:   path.Join(root, "name"),
+			Value: []byte(source.Name),
+		},
+		&consul.KVTxnOp{
+			Verb:  string(consul.KVSet),
+			Key:   sourceTimestampKey(source),
+			Value: []byte(ts),
+		},
+		&consul.KVTxnOp{
+			// packages synced before generations were introduced
+			Verb: consul.KVDeleteTree,
+			Key:  path.Join(root, "repo") + "/",
+		},
+	)
+
+	for name, value := range meta {
+		op := &consul.KVTxnOp{Verb: string(consul.KVSet), Key: path.Join(root, name), Value: []byte(value)}
+		if value == "" {
+			op = &consul.KVTxnOp{Verb: consul.KVDelete, Key: path.Join(root, name)}
+		}
+		ops = append(ops, op)
+	}
+
+	generations, err := install.repositoryGenerations(source.Index)
 	if err != nil {
 		return err
 	}
 
-	os.RemoveAll(path.Join(dest, ".git"))
+	for _, g := range generations {
+		if !keep[g] {
+			ops = append(ops, &consul.KVTxnOp{
+				Verb: consul.KVDeleteTree,
+				Key:  generationKey(source.Index, g) + "/",
+			})
+		}
+	}
 
-	return install.sync(source, dest)
+	return install.commitTxn(ops)
 }
 
 func (source *Source) rootKey() string {
-	return path.Join(RepositoryRoot, fmt.Sprintf("%d", source.Index))
+	return repositoryKey(source.Index)
 }
 
 func sourceTimestampKey(source *Source) string {
 	return path.Join(source.rootKey(), "updated")
 }
 
-func (install *Install) setName(source *Source) error {
-	key := path.Join(source.rootKey(), "name")
-	_, err := install.kv.Put(&consul.KVPair{Key: key, Value: []byte(source.Name)}, nil)
-	return err
-}
-
-func (install *Install) setTimestamp(source *Source) error {
-	ts := time.Now().UTC().Format(time.UnixDate)
-	_, err := install.kv.Put(&consul.KVPair{Key: sourceTimestampKey(source), Value: []byte(ts)}, nil)
-	return err
-}
-
 func (install *Install) addSourceArtifact(key string, data []byte) error {
 	kp := &consul.KVPair{Key: key, Value: data}
 	_, err := install.kv.Put(kp, nil)
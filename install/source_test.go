@@ -0,0 +1,177 @@
+package install
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeSourceFile(t *testing.T, root string, rel string, content string) {
+	file := filepath.Join(root, rel)
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func packageNames(t *testing.T, inst *Install) []string {
+	packages, err := inst.getPackages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, pkg := range packages {
+		names = append(names, pkg.Name)
+	}
+	return names
+}
+
+func TestSyncGenerations(t *testing.T) {
+	t.Parallel()
+	ts, kv, inst := fakeConsul()
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "mantl-install-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeSourceFile(t, dir, "repo/packages/K/kafka/0/package.json", `{"name": "kafka", "version": "0.9.4.0"}`)
+	writeSourceFile(t, dir, "repo/packages/S/spark/0/package.json", `{"name": "spark", "version": "1.6.0"}`)
+	source := &Source{Name: "test", Path: dir, Index: 0}
+
+	// a repository synced before generations existed
+	kv.put("mantl-install/repository/0/repo/packages/C/cassandra/0/package.json", []byte(`{"name": "cassandra", "version": "0.2.0"}`))
+
+	assert.Nil(t, inst.sync(source, dir, nil, nil))
+	active, _ := kv.get("mantl-install/repository/0/active")
+	assert.Equal(t, "1", string(active))
+	assert.Equal(t, []string{"kafka", "spark"}, packageNames(t, inst))
+	assert.Empty(t, kv.keys("mantl-install/repository/0/repo/"))
+
+	// packages removed upstream disappear from the catalog
+	os.RemoveAll(filepath.Join(dir, "repo/packages/S"))
+	assert.Nil(t, inst.sync(source, dir, nil, nil))
+	active, _ = kv.get("mantl-install/repository/0/active")
+	previous, _ := kv.get("mantl-install/repository/0/previous")
+	assert.Equal(t, "2", string(active))
+	assert.Equal(t, "1", string(previous))
+	assert.Equal(t, []string{"kafka"}, packageNames(t, inst))
+
+	// only the active and previous generations are kept
+	assert.Nil(t, inst.sync(source, dir, nil, nil))
+	assert.Empty(t, kv.keys("mantl-install/repository/0/versions/1/"))
+	assert.NotEmpty(t, kv.keys("mantl-install/repository/0/versions/2/"))
+
+	assert.Nil(t, inst.RestoreRepository(0))
+	active, _ = kv.get("mantl-install/repository/0/active")
+	previous, _ = kv.get("mantl-install/repository/0/previous")
+	assert.Equal(t, "2", string(active))
+	assert.Equal(t, "3", string(previous))
+}
+
+func TestSyncFencedByLock(t *testing.T) {
+	t.Parallel()
+	ts, kv, inst := fakeConsul()
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "mantl-install-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeSourceFile(t, dir, "repo/packages/K/kafka/0/package.json", `{"name": "kafka", "version": "0.9.4.0"}`)
+	source := &Source{Name: "test", Path: dir, Index: 0}
+	lost := make(chan struct{})
+	lock := &sourceLock{key: source.lockKey(), session: "session-1", lost: lost}
+
+	kv.Lock()
+	kv.sessions[lock.key] = "session-1"
+	kv.Unlock()
+	assert.Nil(t, inst.sync(source, dir, nil, lock))
+
+	// another instance took the lock over
+	kv.Lock()
+	kv.sessions[lock.key] = "session-2"
+	kv.Unlock()
+	err = inst.sync(source, dir, nil, lock)
+	assert.EqualError(t, err, "Consul transaction rolled back: mantl-install/locks/sync/0: lock is not held")
+	active, _ := kv.get("mantl-install/repository/0/active")
+	assert.Equal(t, "1", string(active))
+	assert.Empty(t, kv.keys("mantl-install/repository/0/versions/2/"))
+
+	close(lost)
+	assert.EqualError(t, inst.sync(source, dir, nil, lock), "Lost test source sync lock")
+}
+
+func TestRestoreRepositoryWithoutPrevious(t *testing.T) {
+	t.Parallel()
+	ts, _, inst := fakeConsul()
+	defer ts.Close()
+
+	err := inst.RestoreRepository(0)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "Repository 0 has no previous generation to restore", err.Error())
+	}
+}
+
+func TestSyncSourceSkipsUnchanged(t *testing.T) {
+	t.Parallel()
+	ts, kv, inst := fakeConsul()
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "mantl-install-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeSourceFile(t, dir, "repo/packages/K/kafka/0/package.json", `{"name": "kafka", "version": "0.9.4.0"}`)
+	source := &Source{Name: "test", Path: dir, Index: 0}
+
+	synced, err := inst.syncSource(source, false, nil)
+	assert.Nil(t, err)
+	assert.True(t, synced)
+	hash, _ := kv.get("mantl-install/repository/0/hash")
+	assert.Len(t, string(hash), 64)
+
+	synced, err = inst.syncSource(source, false, nil)
+	assert.Nil(t, err)
+	assert.False(t, synced)
+
+	synced, err = inst.syncSource(source, true, nil)
+	assert.Nil(t, err)
+	assert.True(t, synced)
+
+	writeSourceFile(t, dir, "repo/packages/K/kafka/0/config.json", `{}`)
+	synced, err = inst.syncSource(source, false, nil)
+	assert.Nil(t, err)
+	assert.True(t, synced)
+	active, _ := kv.get("mantl-install/repository/0/active")
+	assert.Equal(t, "3", string(active))
+}
+
+func TestHashSourceIgnoresOtherFiles(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "mantl-install-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeSourceFile(t, dir, "repo/packages/K/kafka/0/package.json", `{"name": "kafka"}`)
+	before, err := hashSource(dir)
+	assert.Nil(t, err)
+
+	writeSourceFile(t, dir, "README.md", "docs")
+	after, err := hashSource(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, before, after)
+}
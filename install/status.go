@@ -0,0 +1,94 @@
+package install
+
+import (
+	"encoding/json"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/consul/api"
+)
+
+const (
+	RequestSucceeded = "succeeded"
+	RequestRetrying  = "retrying"
+	RequestFailed    = "failed"
+)
+
+const (
+	defaultRequestAttempts = 5
+	requestMinBackoff      = 30 * time.Second
+	requestMaxBackoff      = 10 * time.Minute
+)
+
+type RequestStatus struct {
+	Name         string    `json:"name"`
+	Action       string    `json:"action,omitempty"`
+	Status       string    `json:"status"`
+	AppID        string    `json:"appId,omitempty"`
+	Version      string    `json:"version,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	Attempts     int       `json:"attempts"`
+	NextAttempt  time.Time `json:"nextAttempt,omitempty"`
+	Updated      time.Time `json:"updated"`
+	RequestIndex uint64    `json:"requestIndex"`
+}
+
+func (inst *Install) requestStatus(name string, kvp *api.KVPair) *RequestStatus {
+	fresh := &RequestStatus{Name: name, RequestIndex: kvp.ModifyIndex}
+
+	kp, _, err := inst.kv.Get(StatusRoot+name, nil)
+	if err != nil {
+		log.Warnf("Could not retrieve status for %s: %v", name, err)
+		return fresh
+	}
+	if kp == nil {
+		return fresh
+	}
+
+	status := &RequestStatus{}
+	if err := json.Unmarshal(kp.Value, status); err != nil {
+		log.Warnf("Could not unmarshal status for %s: %v", name, err)
+		return fresh
+	}
+
+	// a rewritten request key is a new request, not a retry of the old one
+	if status.RequestIndex != kvp.ModifyIndex {
+		return fresh
+	}
+
+	return status
+}
+
+func (inst *Install) setRequestStatus(status *RequestStatus) {
+	blob, err := json.Marshal(status)
+	if err != nil {
+		log.Errorf("Could not marshal status for %s: %v", status.Name, err)
+		return
+	}
+
+	_, err = inst.kv.Put(&api.KVPair{Key: StatusRoot + status.Name, Value: blob}, nil)
+	if err != nil {
+		log.Errorf("Could not write status for %s: %v", status.Name, err)
+	}
+}
+
+func requestRetryBackoff(attempts int) time.Duration {
+	backoff := requestMinBackoff
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= requestMaxBackoff {
+			return requestMaxBackoff
+		}
+	}
+	return backoff
+}
+
+func marathonAppID(response string) string {
+	app := struct {
+		ID string `json:"id"`
+	}{}
+	if err := json.Unmarshal([]byte(response), &app); err != nil {
+		log.Warnf("Could not find app id in marathon response: %v", err)
+	}
+	return app.ID
+}
@@ -0,0 +1,365 @@
+package install
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/Wuvist/mustache"
+)
+
+// TemplateError lists the variables of a package template that could not be
+// resolved in strict mode.
+type TemplateError struct {
+	Template   string
+	Unresolved []string
+}
+
+func (e *TemplateError) Error() string {
+	return fmt.Sprintf("Unresolved variables in %s: %s", e.Template, strings.Join(e.Unresolved, ", "))
+}
+
+// TemplateJSONError is returned when a rendered template is not valid JSON.
+// Line and Column point into the template rather than the rendered output.
+type TemplateJSONError struct {
+	Template string
+	Line     int
+	Column   int
+	Message  string
+}
+
+func (e *TemplateJSONError) Error() string {
+	return fmt.Sprintf("Invalid JSON rendered from %s at line %d, column %d: %s", e.Template, e.Line, e.Column, e.Message)
+}
+
+const (
+	templateText = iota
+	templateVariable
+	templateSection
+	templateInverted
+	templateComment
+	templatePartial
+)
+
+type templateNode struct {
+	kind     int
+	name     string
+	start    int // offset of the node in the template
+	end      int
+	children []*templateNode
+}
+
+var errUnsupportedTemplate = errors.New("Unsupported mustache tag")
+
+// parseTemplate splits a mustache template into its tags and sections. It
+// only understands the tags that the package templates use, and returns
+// errUnsupportedTemplate for delimiter changes.
+func parseTemplate(template string) ([]*templateNode, error) {
+	var stack []*templateNode
+	root := &templateNode{kind: templateSection}
+	current := root
+	pos := 0
+
+	for pos < len(template) {
+		open := strings.Index(template[pos:], "{{")
+		if open < 0 {
+			current.children = append(current.children, &templateNode{kind: templateText, start: pos, end: len(template)})
+			break
+		}
+		open += pos
+		if open > pos {
+			current.children = append(current.children, &templateNode{kind: templateText, start: pos, end: open})
+		}
+
+		closeTag := "}}"
+		if strings.HasPrefix(template[open:], "{{{") {
+			closeTag = "}}}"
+		}
+		end := strings.Index(template[open:], closeTag)
+		if end < 0 {
+			return nil, errors.New(fmt.Sprintf("Unclosed tag at line %d", lineColumn(template, open).line))
+		}
+		end += open + len(closeTag)
+		tag := strings.TrimSpace(template[open+2 : end-2])
+
+		node := &templateNode{kind: templateVariable, start: open, end: end}
+		if closeTag == "}}}" {
+			tag = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(tag, "{"), "}"))
+		} else if len(tag) > 0 {
+			switch tag[0] {
+			case '#':
+				node.kind = templateSection
+			case '^':
+				node.kind = templateInverted
+			case '!':
+				node.kind = templateComment
+			case '>':
+				node.kind = templatePartial
+			case '&':
+			case '=':
+				return nil, errUnsupportedTemplate
+			case '/':
+				name := strings.TrimSpace(tag[1:])
+				if current == root || current.name != name {
+					return nil, errors.New(fmt.Sprintf("Unexpected section end %s at line %d", name, lineColumn(template, open).line))
+				}
+				current.end = end
+				current = stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				pos = end
+				continue
+			}
+			if node.kind != templateVariable || tag[0] == '&' {
+				tag = strings.TrimSpace(tag[1:])
+			}
+		}
+		node.name = tag
+
+		current.children = append(current.children, node)
+		if node.kind == templateSection || node.kind == templateInverted {
+			stack = append(stack, current)
+			current = node
+		}
+		pos = end
+	}
+
+	if current != root {
+		return nil, errors.New(fmt.Sprintf("Unclosed section %s at line %d", current.name, lineColumn(template, current.start).line))
+	}
+
+	return root.children, nil
+}
+
+// unresolvedVariables walks the template like mustache would render it and
+// collects the variables that resolve to nothing. Sections that aren't
+// rendered are skipped, so optional values guarded by a section are fine.
+func unresolvedVariables(template string, nodes []*templateNode, context interface{}) []string {
+	var unresolved []string
+	seen := make(map[string]bool)
+
+	var walk func(nodes []*templateNode, chain []reflect.Value)
+	walk = func(nodes []*templateNode, chain []reflect.Value) {
+		for _, node := range nodes {
+			switch node.kind {
+			case templateVariable:
+				if v, ok := templateLookup(chain, node.name); !ok || isNilValue(v) {
+					pos := lineColumn(template, node.start)
+					entry := fmt.Sprintf("%s (line %d, column %d)", node.name, pos.line, pos.column)
+					if !seen[entry] {
+						seen[entry] = true
+						unresolved = append(unresolved, entry)
+					}
+				}
+			case templateSection:
+				v, _ := templateLookup(chain, node.name)
+				if isEmptyValue(v) {
+					continue
+				}
+				v = indirectValue(v)
+				switch v.Kind() {
+				case reflect.Slice, reflect.Array:
+					for i := 0; i < v.Len(); i++ {
+						walk(node.children, append([]reflect.Value{v.Index(i)}, chain...))
+					}
+				case reflect.Map:
+					walk(node.children, append([]reflect.Value{v}, chain...))
+				default:
+					walk(node.children, chain)
+				}
+			case templateInverted:
+				if v, _ := templateLookup(chain, node.name); isEmptyValue(v) {
+					walk(node.children, chain)
+				}
+			}
+		}
+	}
+
+	walk(nodes, []reflect.Value{reflect.ValueOf(context)})
+	return unresolved
+}
+
+// templateLookup resolves a possibly dotted name the way mustache does: the
+// first part is looked up through the context chain, the remaining parts in
+// the value found.
+func templateLookup(chain []reflect.Value, name string) (reflect.Value, bool) {
+	if name == "." {
+		return chain[0], true
+	}
+
+	parts := strings.Split(name, ".")
+	var v reflect.Value
+	found := false
+	for _, ctx := range chain {
+		if v, found = mapIndex(ctx, parts[0]); found {
+			break
+		}
+	}
+
+	for _, part := range parts[1:] {
+		if !found {
+			break
+		}
+		v, found = mapIndex(v, part)
+	}
+
+	return v, found
+}
+
+func mapIndex(v reflect.Value, key string) (reflect.Value, bool) {
+	v = indirectValue(v)
+	if v.Kind() != reflect.Map || v.Type().Key().Kind() != reflect.String {
+		return reflect.Value{}, false
+	}
+	value := v.MapIndex(reflect.ValueOf(key).Convert(v.Type().Key()))
+	return value, value.IsValid()
+}
+
+func indirectValue(v reflect.Value) reflect.Value {
+	for v.IsValid() && (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) {
+		v = v.Elem()
+	}
+	return v
+}
+
+func isNilValue(v reflect.Value) bool {
+	return !indirectValue(v).IsValid()
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	v = indirectValue(v)
+	if !v.IsValid() {
+		return true
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Slice:
+		return v.Len() == 0
+	case reflect.String:
+		return len(strings.TrimSpace(v.String())) == 0
+	}
+	return false
+}
+
+type templatePosition struct {
+	line   int
+	column int
+}
+
+func lineColumn(s string, offset int) templatePosition {
+	if offset > len(s) {
+		offset = len(s)
+	}
+	before := s[:offset]
+	line := strings.Count(before, "\n") + 1
+	column := offset - strings.LastIndex(before, "\n")
+	return templatePosition{line, column}
+}
+
+// renderedSegment maps a part of the rendered output back to the template
+type renderedSegment struct {
+	node   *templateNode
+	output int
+}
+
+// renderTemplate renders a package template. In strict mode, variables that
+// don't resolve are an error. When the template renders to something other
+// than whitespace, the output must be valid JSON; syntax errors are reported
+// at their position in the template.
+func renderTemplate(name string, template string, context interface{}, strict bool) (string, error) {
+	nodes, err := parseTemplate(template)
+	if err == errUnsupportedTemplate {
+		// render as a whole, without strict checks or template positions
+		tmpl, err := mustache.ParseString(template)
+		if err != nil {
+			return "", err
+		}
+		return validateRenderedJson(name, template, tmpl.Render(context), nil)
+	} else if err != nil {
+		return "", errors.New(fmt.Sprintf("Could not parse %s: %v", name, err))
+	}
+
+	if strict {
+		if unresolved := unresolvedVariables(template, nodes, context); len(unresolved) > 0 {
+			return "", &TemplateError{Template: name, Unresolved: unresolved}
+		}
+	}
+
+	// render each top level element on its own to know where its output
+	// came from
+	var rendered bytes.Buffer
+	segments := make([]renderedSegment, 0, len(nodes))
+	for _, node := range nodes {
+		segments = append(segments, renderedSegment{node, rendered.Len()})
+		if node.kind == templateText {
+			rendered.WriteString(template[node.start:node.end])
+			continue
+		}
+
+		tmpl, err := mustache.ParseString(template[node.start:node.end])
+		if err != nil {
+			return "", errors.New(fmt.Sprintf("Could not parse %s: %v", name, err))
+		}
+		rendered.WriteString(tmpl.Render(context))
+	}
+
+	return validateRenderedJson(name, template, rendered.String(), segments)
+}
+
+func validateRenderedJson(name string, template string, rendered string, segments []renderedSegment) (string, error) {
+	if strings.TrimSpace(rendered) == "" {
+		return rendered, nil
+	}
+
+	var v interface{}
+	err := json.Unmarshal([]byte(rendered), &v)
+	if err == nil {
+		return rendered, nil
+	}
+
+	offset := len(rendered)
+	if syntaxErr, ok := err.(*json.SyntaxError); ok {
+		// the offset is just past the offending character
+		offset = int(syntaxErr.Offset) - 1
+		if offset < 0 {
+			offset = 0
+		}
+	}
+
+	pos := lineColumn(rendered, offset)
+	if segments != nil {
+		pos = templateOffset(template, segments, offset)
+	}
+
+	return "", &TemplateJSONError{Template: name, Line: pos.line, Column: pos.column, Message: err.Error()}
+}
+
+// templateOffset finds the template position that produced an offset of
+// the rendered output. Text maps back exactly; output of a tag or section
+// maps to the start of the tag.
+func templateOffset(template string, segments []renderedSegment, offset int) templatePosition {
+	if len(segments) == 0 {
+		return lineColumn(template, 0)
+	}
+
+	segment := segments[0]
+	for _, s := range segments {
+		if s.output > offset {
+			break
+		}
+		segment = s
+	}
+
+	if segment.node.kind == templateText {
+		pos := segment.node.start + offset - segment.output
+		if pos > segment.node.end {
+			pos = segment.node.end
+		}
+		return lineColumn(template, pos)
+	}
+
+	return lineColumn(template, segment.node.start)
+}
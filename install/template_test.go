@@ -0,0 +1,103 @@
+package install
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	t.Parallel()
+
+	context := map[string]interface{}{
+		"kafka": map[string]interface{}{"name": "kafka", "brokers": []interface{}{"a", "b"}},
+	}
+	template := `{"id": "{{kafka.name}}", "args": [{{#kafka.brokers}}"{{.}}",{{/kafka.brokers}}"end"]}`
+
+	rendered, err := renderTemplate("marathon.json", template, context, true)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"id": "kafka", "args": ["a","b","end"]}`, rendered)
+}
+
+func TestRenderTemplateUnresolved(t *testing.T) {
+	t.Parallel()
+
+	context := map[string]interface{}{
+		"kafka": map[string]interface{}{"name": "kafka"},
+	}
+	template := "{\n  \"id\": \"{{kafka.name}}\",\n  \"cmd\": \"{{kafka.cmd}} {{missing}}\"{{#kafka.docker}},\n  \"image\": \"{{kafka.docker.image}}\"{{/kafka.docker}}\n}"
+
+	rendered, err := renderTemplate("marathon.json", template, context, false)
+	assert.NoError(t, err)
+	assert.Contains(t, rendered, `"cmd": " "`)
+
+	_, err = renderTemplate("marathon.json", template, context, true)
+	if assert.IsType(t, &TemplateError{}, err) {
+		assert.Equal(t, []string{
+			"kafka.cmd (line 3, column 11)",
+			"missing (line 3, column 25)",
+		}, err.(*TemplateError).Unresolved)
+	}
+}
+
+func TestRenderTemplateInvertedSection(t *testing.T) {
+	t.Parallel()
+
+	template := `{"port": {{^port}}{{default}}{{/port}}{{port}}}`
+
+	_, err := renderTemplate("marathon.json", template, map[string]interface{}{"port": 80}, true)
+	assert.NoError(t, err)
+
+	_, err = renderTemplate("marathon.json", template, map[string]interface{}{}, true)
+	if assert.IsType(t, &TemplateError{}, err) {
+		assert.Len(t, err.(*TemplateError).Unresolved, 2)
+	}
+}
+
+func TestRenderTemplateInvalidJson(t *testing.T) {
+	t.Parallel()
+
+	context := map[string]interface{}{"cpus": ""}
+
+	template := "{\n  \"id\": \"kafka\",\n  \"cpus\": {{cpus}}\n}"
+	_, err := renderTemplate("marathon.json", template, context, false)
+	if assert.IsType(t, &TemplateJSONError{}, err) {
+		jsonErr := err.(*TemplateJSONError)
+		assert.Equal(t, "marathon.json", jsonErr.Template)
+		assert.Equal(t, 4, jsonErr.Line)
+		assert.Equal(t, 1, jsonErr.Column)
+	}
+
+	template = "{\n  \"id\": \"kafka\"\n  \"cpus\": 1\n}"
+	_, err = renderTemplate("marathon.json", template, context, false)
+	if assert.IsType(t, &TemplateJSONError{}, err) {
+		jsonErr := err.(*TemplateJSONError)
+		assert.Equal(t, 3, jsonErr.Line)
+		assert.Equal(t, 3, jsonErr.Column)
+	}
+}
+
+func TestRenderTemplateEmpty(t *testing.T) {
+	t.Parallel()
+
+	rendered, err := renderTemplate("uninstall.json", "\n", nil, true)
+	assert.NoError(t, err)
+	assert.Equal(t, "\n", rendered)
+}
+
+func TestStrictMarathon(t *testing.T) {
+	t.Parallel()
+
+	pkgDef := &packageDefinition{
+		configJson:        []byte(configJson),
+		optionsJson:       []byte(optionsJson),
+		marathonJson:      []byte(marathonJson),
+		apiConfig:         localApiConfig,
+		strict:            true,
+		valueTransformers: valueTransformers,
+	}
+
+	marathon, err := pkgDef.MarathonAppJson()
+	assert.NoError(t, err)
+	assert.Contains(t, marathon, "\"id\": \"/cassandra/dcos-test\",")
+}
@@ -1,45 +1,184 @@
 package install
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"sort"
 	"strings"
 )
 
-type valueTransformer func(interface{}, packageDefinition) string
+// valueTransformer converts a config value of a schema type, e.g. to the
+// string that is rendered into the templates.
+type valueTransformer func(interface{}, packageDefinition) (interface{}, error)
 
-func zookeeperHosts(v interface{}, d packageDefinition) string {
+// valueResolver resolves the expression of a config value like
+// consul-service:kafka. It is called with the part after the prefix.
+type valueResolver func(string, packageDefinition) (string, error)
+
+var valueTransformers = map[string][]valueTransformer{}
+
+var valueResolvers = map[string]valueResolver{}
+
+// requestCheck decides whether the config of an install request may use a
+// resolver expression. It is called with the part after the prefix.
+type requestCheck func(string, packageDefinition) error
+
+// requestResolvers holds the checks of the prefixes that are resolved in the
+// config of install requests. The others can read anything mantl-api has
+// access to, so they only resolve values from config.json and mantl.json.
+var requestResolvers = map[string]requestCheck{}
+
+func init() {
+	registerValueTransformer("string", zookeeperHosts)
+	registerValueTransformer("integer", intTransformer)
+	registerValueTransformer("number", numberTransformer)
+
+	registerValueResolver("consul-service", consulServiceResolver, allowedInRequests)
+	registerValueResolver("consul-kv", consulKVResolver, nil)
+	registerValueResolver("env", envResolver, nil)
+	registerValueResolver("vault", vaultResolver, vaultRequestCheck)
+}
+
+// registerValueTransformer adds a transformer for config values of a schema
+// type. Transformers of a type run in the order they were registered.
+func registerValueTransformer(typ string, fn valueTransformer) {
+	valueTransformers[typ] = append(valueTransformers[typ], fn)
+}
+
+// registerValueResolver makes config values that start with prefix followed
+// by a colon resolve through fn. Install requests can use the prefix when
+// check allows it; a nil check keeps it out of requests.
+func registerValueResolver(prefix string, fn valueResolver, check requestCheck) {
+	valueResolvers[prefix] = fn
+	requestResolvers[prefix] = check
+}
+
+func allowedInRequests(string, packageDefinition) error {
+	return nil
+}
+
+// resolveValue resolves a string config value that is a resolver expression.
+// Other values are returned unchanged. Values from requests that use a
+// prefix that isn't allowed there are an error.
+func (d packageDefinition) resolveValue(v interface{}, fromRequest bool) (interface{}, error) {
+	strval, ok := v.(string)
+	if !ok {
+		return v, nil
+	}
+
+	parts := strings.SplitN(strval, ":", 2)
+	if len(parts) != 2 {
+		return v, nil
+	}
+
+	resolver, ok := d.valueResolvers[parts[0]]
+	if !ok {
+		return v, nil
+	}
+
+	if fromRequest {
+		check := requestResolvers[parts[0]]
+		if check == nil {
+			return nil, errors.New(fmt.Sprintf("%s: references are not allowed in request config", parts[0]))
+		}
+		if err := check(parts[1], d); err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not resolve %s: %v", strval, err))
+		}
+	}
+
+	resolved, err := resolver(parts[1], d)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not resolve %s: %v", strval, err))
+	}
+	return resolved, nil
+}
+
+func zookeeperHosts(v interface{}, d packageDefinition) (interface{}, error) {
 	zkVal := "zookeeper.service.consul:2181"
-	strval := v.(string)
+	strval, ok := v.(string)
+	if !ok {
+		return v, nil
+	}
 	if zkHosts, ok := getConfigVal(d.apiConfig, "mantl", "zookeeper", "hosts").(string); ok {
 		if strings.Contains(strval, zkVal) {
 			strval = strings.Replace(strval, zkVal, zkHosts, -1)
 		}
 	}
-	return strval
+	return strval, nil
 }
 
-func intTransformer(v interface{}, d packageDefinition) string {
+func intTransformer(v interface{}, d packageDefinition) (interface{}, error) {
 	if strval, ok := v.(string); ok { // already been converted
-		return strval
+		return strval, nil
 	}
-	return fmt.Sprintf("%d", int(v.(float64)))
+	f, ok := v.(float64)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("%v is not an integer", v))
+	}
+	return fmt.Sprintf("%d", int(f)), nil
 }
 
-func numberTransformer(v interface{}, d packageDefinition) string {
+func numberTransformer(v interface{}, d packageDefinition) (interface{}, error) {
 	if strval, ok := v.(string); ok { // already been converted
-		return strval
+		return strval, nil
+	}
+	f, ok := v.(float64)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("%v is not a number", v))
+	}
+	return fmt.Sprintf("%0.2f", f), nil
+}
+
+// consulServiceResolver resolves a service name to a comma separated list
+// of the host:port of each of its instances in the Consul catalog.
+func consulServiceResolver(name string, d packageDefinition) (string, error) {
+	if d.consul == nil {
+		return "", errors.New("Consul is not available")
+	}
+
+	services, _, err := d.consul.Catalog().Service(name, "", nil)
+	if err != nil {
+		return "", err
+	}
+
+	var hosts []string
+	for _, svc := range services {
+		host := svc.ServiceAddress
+		if host == "" {
+			host = svc.Node
+		}
+		hosts = append(hosts, fmt.Sprintf("%s:%d", host, svc.ServicePort))
+	}
+
+	if len(hosts) == 0 {
+		return "", errors.New(fmt.Sprintf("No instances of the %s service are registered", name))
+	}
+
+	sort.Strings(hosts)
+	return strings.Join(hosts, ","), nil
+}
+
+func consulKVResolver(key string, d packageDefinition) (string, error) {
+	if d.consul == nil {
+		return "", errors.New("Consul is not available")
+	}
+
+	kp, _, err := d.consul.KV().Get(strings.TrimPrefix(key, "/"), nil)
+	if err != nil {
+		return "", err
 	}
-	return fmt.Sprintf("%0.2f", v.(float64))
+	if kp == nil {
+		return "", errors.New(fmt.Sprintf("Key %s does not exist", key))
+	}
+
+	return string(kp.Value), nil
 }
 
-var valueTransformers = map[string][]valueTransformer{
-	"string": []valueTransformer{
-		zookeeperHosts,
-	},
-	"integer": []valueTransformer{
-		intTransformer,
-	},
-	"number": []valueTransformer{
-		numberTransformer,
-	},
+func envResolver(name string, d packageDefinition) (string, error) {
+	val, ok := os.LookupEnv(name)
+	if !ok {
+		return "", errors.New(fmt.Sprintf("Environment variable %s is not set", name))
+	}
+	return val, nil
 }
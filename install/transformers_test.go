@@ -0,0 +1,149 @@
+package install
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func resolverDefinition(client *consul.Client) packageDefinition {
+	return packageDefinition{
+		consul:            client,
+		valueTransformers: valueTransformers,
+		valueResolvers:    valueResolvers,
+	}
+}
+
+func TestConsulServiceResolver(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/catalog/service/kafka":
+			w.Write([]byte(`[
+				{"Node": "worker-02", "ServiceAddress": "", "ServicePort": 9092},
+				{"Node": "worker-01", "ServiceAddress": "10.0.0.1", "ServicePort": 9092}
+			]`))
+		default:
+			w.Write([]byte(`[]`))
+		}
+	}))
+	defer ts.Close()
+
+	config := consul.DefaultConfig()
+	config.Address = strings.TrimPrefix(ts.URL, "http://")
+	client, _ := consul.NewClient(config)
+	d := resolverDefinition(client)
+
+	val, err := d.transformedConfigValue("consul-service:kafka", "string", true)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1:9092,worker-02:9092", val)
+
+	_, err = d.transformedConfigValue("consul-service:missing", "string", true)
+	assert.EqualError(t, err, "Could not resolve consul-service:missing: No instances of the missing service are registered")
+}
+
+func TestConsulKVResolver(t *testing.T) {
+	t.Parallel()
+	ts, kv, inst := fakeConsul()
+	defer ts.Close()
+
+	kv.put("config/kafka/brokers", []byte("3"))
+	d := resolverDefinition(inst.consul)
+
+	val, err := d.transformedConfigValue("consul-kv:config/kafka/brokers", "integer", true)
+	assert.NoError(t, err)
+	assert.Equal(t, "3", val)
+
+	_, err = d.transformedConfigValue("consul-kv:config/kafka/missing", "integer", true)
+	assert.Error(t, err)
+}
+
+func TestEnvResolver(t *testing.T) {
+	t.Parallel()
+
+	os.Setenv("MANTL_TEST_RESOLVER", "value")
+	d := resolverDefinition(nil)
+
+	val, err := d.transformedConfigValue("env:MANTL_TEST_RESOLVER", "string", true)
+	assert.NoError(t, err)
+	assert.Equal(t, "value", val)
+
+	_, err = d.transformedConfigValue("env:MANTL_TEST_RESOLVER_UNSET", "string", true)
+	assert.EqualError(t, err, "Could not resolve env:MANTL_TEST_RESOLVER_UNSET: Environment variable MANTL_TEST_RESOLVER_UNSET is not set")
+
+	// values without a registered prefix are left alone
+	val, err = d.transformedConfigValue("http://example.com", "string", true)
+	assert.NoError(t, err)
+	assert.Equal(t, "http://example.com", val)
+}
+
+func TestResolverErrorFailsRendering(t *testing.T) {
+	t.Parallel()
+
+	pkgDef := &packageDefinition{
+		configJson:        []byte(configJson),
+		optionsJson:       []byte(strings.Replace(optionsJson, `"dcos-test"`, `"env:MANTL_TEST_RESOLVER_CLUSTER_UNSET"`, 1)),
+		marathonJson:      []byte(marathonJson),
+		apiConfig:         localApiConfig,
+		valueTransformers: valueTransformers,
+		valueResolvers:    valueResolvers,
+	}
+
+	_, err := pkgDef.MarathonAppJson()
+	assert.EqualError(t, err, "Could not resolve env:MANTL_TEST_RESOLVER_CLUSTER_UNSET: Environment variable MANTL_TEST_RESOLVER_CLUSTER_UNSET is not set")
+}
+
+func TestRequestResolvers(t *testing.T) {
+	t.Parallel()
+	ts, kv, inst := fakeConsul()
+	defer ts.Close()
+
+	os.Setenv("MANTL_TEST_RESOLVER_SECRET", "s3cret")
+	kv.put("config/secret", []byte("s3cret"))
+
+	pkgDef := &packageDefinition{
+		configJson:        []byte(configJson),
+		optionsJson:       []byte(strings.Replace(optionsJson, `"dcos-test"`, `"env:MANTL_TEST_RESOLVER_SECRET"`, 1)),
+		apiConfig:         localApiConfig,
+		consul:            inst.consul,
+		valueTransformers: valueTransformers,
+		valueResolvers:    valueResolvers,
+	}
+
+	// mantl.json can read the environment
+	merged, err := pkgDef.MergedConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, "s3cret", getConfigVal(merged, "cassandra", "cluster-name"))
+
+	// requests can't
+	pkgDef.userConfig = map[string]interface{}{
+		"cassandra": map[string]interface{}{"zk": "env:MANTL_TEST_RESOLVER_SECRET"},
+	}
+	_, err = pkgDef.MergedConfig()
+	assert.EqualError(t, err, "env: references are not allowed in request config")
+
+	pkgDef.userConfig = map[string]interface{}{
+		"cassandra": map[string]interface{}{
+			"framework": map[string]interface{}{
+				"authentication": map[string]interface{}{
+					"secret": "consul-kv:config/secret",
+				},
+			},
+		},
+	}
+	_, err = pkgDef.MergedConfig()
+	assert.EqualError(t, err, "consul-kv: references are not allowed in request config")
+
+	// values that only look like a reference are fine
+	pkgDef.userConfig = map[string]interface{}{
+		"cassandra": map[string]interface{}{"zk": "zk://zookeeper.service.consul:2181/cassandra"},
+	}
+	_, err = pkgDef.MergedConfig()
+	assert.NoError(t, err)
+}
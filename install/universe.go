@@ -0,0 +1,156 @@
+package install
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// universeMediaTypes are the media types of single file Universe
+// repositories, most recent first
+var universeMediaTypes = []string{
+	"application/vnd.dcos.universe.repo+json;charset=utf-8;version=v4",
+	"application/vnd.dcos.universe.repo+json;charset=utf-8;version=v3",
+}
+
+type universeRepository struct {
+	Packages []map[string]interface{} `json:"packages"`
+}
+
+// convertUniverseRepository converts a single file Universe v3 or v4
+// repository into the repo/packages/{Letter}/{name}/{index} layout under dest.
+// Each package is split into package.json, config.json, marathon.json,
+// resource.json and command.json, like the files of a v2 repository.
+func convertUniverseRepository(file string, dest string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	repo := universeRepository{}
+	if err := json.Unmarshal(data, &repo); err != nil {
+		return errors.New(fmt.Sprintf("Could not parse universe repository %s: %v", filepath.Base(file), err))
+	}
+
+	releases := make(map[string]int)
+	for _, pkg := range repo.Packages {
+		name, _ := pkg["name"].(string)
+		if name == "" {
+			log.Warnf("Skipping universe package without a name")
+			continue
+		}
+
+		index, ok := universeReleaseVersion(pkg)
+		if !ok {
+			// older repositories list releases in order
+			index = releases[name]
+		}
+		releases[name] = index + 1
+
+		files, err := universePackageFiles(pkg)
+		if err != nil {
+			log.Warnf("Skipping universe package %s %v: %v", name, pkg["version"], err)
+			continue
+		}
+
+		pkgDir := filepath.Join(dest, "repo", "packages", NewPackage(name).PackageVersionKey(strconv.Itoa(index)))
+		if err := os.MkdirAll(pkgDir, 0755); err != nil {
+			return err
+		}
+
+		for fileName, content := range files {
+			if err := ioutil.WriteFile(filepath.Join(pkgDir, fileName), content, 0644); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// universeSource converts a single file repository into a temporary
+// directory that can be synced like any other source.
+func universeSource(file string) (string, func(), error) {
+	temp, err := ioutil.TempDir(os.TempDir(), "mantl-install")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(temp) }
+
+	if err := convertUniverseRepository(file, temp); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	return temp, cleanup, nil
+}
+
+func universeReleaseVersion(pkg map[string]interface{}) (int, bool) {
+	switch v := pkg["releaseVersion"].(type) {
+	case float64:
+		return int(v), true
+	case string:
+		if i, err := strconv.Atoi(v); err == nil {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func universePackageFiles(pkg map[string]interface{}) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	meta := make(map[string]interface{})
+
+	for k, v := range pkg {
+		var err error
+		switch k {
+		case "marathon":
+			files["marathon.json"], err = universeMarathonTemplate(v)
+		case "config":
+			files["config.json"], err = json.Marshal(v)
+		case "resource":
+			files["resource.json"], err = json.Marshal(v)
+		case "command":
+			files["command.json"], err = json.Marshal(v)
+		default:
+			meta[k] = v
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	files["package.json"] = data
+
+	return files, nil
+}
+
+func universeMarathonTemplate(marathon interface{}) ([]byte, error) {
+	m, ok := marathon.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("marathon must be an object")
+	}
+
+	template, _ := m["v2AppMustacheTemplate"].(string)
+	if template == "" {
+		return nil, errors.New("marathon.v2AppMustacheTemplate is missing")
+	}
+
+	return base64.StdEncoding.DecodeString(template)
+}
+
+func isUniverseContentType(contentType string) bool {
+	return strings.Contains(contentType, "json")
+}
@@ -0,0 +1,160 @@
+package install
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var universeMarathon = `{"id": "{{kafka.framework-name}}", "container": {"docker": {"image": "{{resource.assets.container.docker.kafka}}"}}}`
+
+func universeRepositoryJson(t *testing.T) []byte {
+	data, err := json.Marshal(map[string]interface{}{
+		"packages": []interface{}{
+			map[string]interface{}{
+				"packagingVersion": "3.0",
+				"name":             "kafka",
+				"version":          "1.1.0",
+				"releaseVersion":   3,
+				"description":      "Apache Kafka",
+				"framework":        true,
+				"tags":             []string{"message", "broker"},
+				"marathon": map[string]interface{}{
+					"v2AppMustacheTemplate": base64.StdEncoding.EncodeToString([]byte(universeMarathon)),
+				},
+				"config": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"kafka": map[string]interface{}{
+							"type": "object",
+							"properties": map[string]interface{}{
+								"framework-name": map[string]interface{}{"type": "string", "default": "kafka"},
+							},
+						},
+					},
+				},
+				"resource": map[string]interface{}{
+					"assets": map[string]interface{}{
+						"container": map[string]interface{}{
+							"docker": map[string]interface{}{"kafka": "mesosphere/kafka:1.1.0"},
+						},
+					},
+				},
+			},
+			map[string]interface{}{
+				"packagingVersion": "4.0",
+				"name":             "kafka",
+				"version":          "1.0.0",
+				"releaseVersion":   2,
+				"marathon": map[string]interface{}{
+					"v2AppMustacheTemplate": base64.StdEncoding.EncodeToString([]byte(`{}`)),
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestConvertUniverseRepository(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "mantl-install-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "repo.json")
+	ioutil.WriteFile(file, universeRepositoryJson(t), 0644)
+
+	dest := filepath.Join(dir, "converted")
+	assert.Nil(t, convertUniverseRepository(file, dest))
+
+	pkgDir := filepath.Join(dest, "repo/packages/K/kafka/3")
+	marathonJson, err := ioutil.ReadFile(filepath.Join(pkgDir, "marathon.json"))
+	assert.Nil(t, err)
+	assert.Equal(t, universeMarathon, string(marathonJson))
+
+	meta := make(map[string]interface{})
+	packageJson, _ := ioutil.ReadFile(filepath.Join(pkgDir, "package.json"))
+	assert.Nil(t, json.Unmarshal(packageJson, &meta))
+	assert.Equal(t, "1.1.0", meta["version"])
+	assert.Nil(t, meta["marathon"])
+
+	for _, name := range []string{"config.json", "resource.json"} {
+		_, err = os.Stat(filepath.Join(pkgDir, name))
+		assert.Nil(t, err)
+	}
+
+	_, err = os.Stat(filepath.Join(dest, "repo/packages/K/kafka/2/marathon.json"))
+	assert.Nil(t, err)
+}
+
+func TestConvertUniverseRepositoryInvalid(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "mantl-install-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "repo.json")
+	ioutil.WriteFile(file, []byte(`{"packages": [`), 0644)
+	assert.NotNil(t, convertUniverseRepository(file, dir))
+
+	// packages that can't be converted are skipped
+	ioutil.WriteFile(file, []byte(`{"packages": [
+		{"name": "kafka", "version": "1.0.0", "marathon": {}},
+		{"name": "kafka", "version": "1.1.0", "marathon": {"v2AppMustacheTemplate": "e30="}}
+	]}`), 0644)
+	assert.Nil(t, convertUniverseRepository(file, dir))
+	_, err = os.Stat(filepath.Join(dir, "repo/packages/K/kafka/0"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, "repo/packages/K/kafka/1/marathon.json"))
+	assert.Nil(t, err)
+}
+
+func TestSyncUniverseRepository(t *testing.T) {
+	t.Parallel()
+	ts, _, inst := fakeConsul()
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "mantl-install-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "repo.json")
+	ioutil.WriteFile(file, universeRepositoryJson(t), 0644)
+
+	synced, err := inst.syncSource(&Source{Name: "universe", Path: file}, false, nil)
+	assert.Nil(t, err)
+	assert.True(t, synced)
+
+	pkg, err := inst.getPackageByName("kafka")
+	if assert.NotNil(t, pkg) {
+		assert.Equal(t, 2, len(pkg.Versions))
+		assert.Equal(t, "Apache Kafka", pkg.Description)
+	}
+
+	def, err := inst.GetPackageDefinition("kafka", "1.1.0", "", nil, nil)
+	if assert.Nil(t, err) {
+		rendered, err := def.MarathonAppJson()
+		assert.Nil(t, err)
+		assert.Equal(t, `{"id": "kafka", "container": {"docker": {"image": "mesosphere/kafka:1.1.0"}}}`, rendered)
+	}
+}
+
+func TestArchiveFormatUniverse(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, "json", archiveFormat("http://universe/repo", universeMediaTypes[0]))
+	assert.Equal(t, "json", archiveFormat("http://universe/repo-up-to-1.8.json", ""))
+}
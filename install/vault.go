@@ -0,0 +1,195 @@
+package install
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	vault "github.com/hashicorp/vault/api"
+)
+
+const vaultPrefix = "vault:"
+
+// ReadSecret returns value, or the Vault secret it refers to when it has the
+// form vault:<path>#<key>.
+func ReadSecret(client *vault.Client, value string) (string, error) {
+	if !strings.HasPrefix(value, vaultPrefix) {
+		return value, nil
+	}
+	return readVaultSecret(client, strings.TrimPrefix(value, vaultPrefix))
+}
+
+func parseVaultReference(ref string) (string, string, error) {
+	parts := strings.SplitN(ref, "#", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errors.New("Vault secret references must have the form vault:<path>#<key>")
+	}
+	return parts[0], parts[1], nil
+}
+
+func readVaultSecret(client *vault.Client, ref string) (string, error) {
+	path, key, err := parseVaultReference(ref)
+	if err != nil {
+		return "", err
+	}
+
+	if client == nil {
+		return "", errors.New(fmt.Sprintf("Vault is not configured, cannot read %s", path))
+	}
+
+	secret, err := client.Logical().Read(path)
+	if err != nil {
+		return "", err
+	}
+	if secret == nil {
+		return "", errors.New(fmt.Sprintf("%s does not exist", path))
+	}
+
+	value, ok := secret.Data[key].(string)
+	if !ok {
+		return "", errors.New(fmt.Sprintf("%s didn't contain %s", path, key))
+	}
+
+	return value, nil
+}
+
+// packageSecrets tracks the Vault references of a package definition and
+// the values they resolved to, so the values can be kept out of logs and
+// labels.
+type packageSecrets struct {
+	values map[string]string
+}
+
+func newPackageSecrets() *packageSecrets {
+	return &packageSecrets{values: make(map[string]string)}
+}
+
+func (s *packageSecrets) add(ref string, value string) {
+	if s != nil {
+		s.values[ref] = value
+	}
+}
+
+// vaultRequestCheck allows install requests to refer to the Vault paths
+// below one of the configured prefixes.
+func vaultRequestCheck(ref string, d packageDefinition) error {
+	p, _, err := parseVaultReference(ref)
+	if err != nil {
+		return err
+	}
+
+	if path.Clean(p) == p {
+		for _, prefix := range d.vaultRequestPaths {
+			prefix = strings.Trim(prefix, "/")
+			if prefix != "" && (p == prefix || strings.HasPrefix(p, prefix+"/")) {
+				return nil
+			}
+		}
+	}
+
+	return errors.New(fmt.Sprintf("%s is not a Vault path install requests may refer to", p))
+}
+
+// vaultResolver resolves vault:<path>#<key> config values. When secrets are
+// passed to Marathon, the reference is kept until the app is rendered.
+func vaultResolver(ref string, d packageDefinition) (string, error) {
+	if d.redactSecrets {
+		if _, _, err := parseVaultReference(ref); err != nil {
+			return "", err
+		}
+		return vaultPrefix + ref, nil
+	}
+
+	if d.marathonSecrets {
+		if _, _, err := parseVaultReference(ref); err != nil {
+			return "", err
+		}
+		d.secrets.add(ref, "")
+		return vaultPrefix + ref, nil
+	}
+
+	value, err := readVaultSecret(d.vault, ref)
+	if err != nil {
+		return "", err
+	}
+	d.secrets.add(ref, value)
+	return value, nil
+}
+
+// redacted returns a copy of the package definition that renders Vault
+// references instead of the values they resolved to, for anything that is
+// logged, stored in labels or returned by the API. Rendering the templates
+// again puts the references exactly where the values were.
+func (d packageDefinition) redacted() *packageDefinition {
+	d.redactSecrets = true
+	d.applied = &appliedRewrites{}
+	return &d
+}
+
+// withMarathonSecrets turns environment variables of the rendered app that
+// are Vault references into Marathon secrets. References used anywhere else
+// are replaced with their values.
+func (d packageDefinition) withMarathonSecrets(appJson string) (string, error) {
+	if d.secrets == nil || len(d.secrets.values) == 0 {
+		return appJson, nil
+	}
+
+	var app map[string]interface{}
+	if err := json.Unmarshal([]byte(appJson), &app); err != nil {
+		return "", err
+	}
+
+	if env, ok := app["env"].(map[string]interface{}); ok {
+		names := make([]string, 0, len(env))
+		for name := range env {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		secrets, _ := app["secrets"].(map[string]interface{})
+		if secrets == nil {
+			secrets = make(map[string]interface{})
+		}
+		for _, name := range names {
+			value, _ := env[name].(string)
+			ref := strings.TrimPrefix(value, vaultPrefix)
+			if _, ok := d.secrets.values[ref]; !ok || !strings.HasPrefix(value, vaultPrefix) {
+				continue
+			}
+			secretName := fmt.Sprintf("mantl-%s", strings.ToLower(name))
+			secrets[secretName] = map[string]interface{}{"source": ref}
+			env[name] = map[string]interface{}{"secret": secretName}
+		}
+		if len(secrets) > 0 {
+			app["secrets"] = secrets
+		}
+	}
+
+	blob, err := json.Marshal(app)
+	if err != nil {
+		return "", err
+	}
+
+	rendered := string(blob)
+	if d.redactSecrets {
+		return rendered, nil
+	}
+	for ref := range d.secrets.values {
+		if !strings.Contains(rendered, vaultPrefix+ref) {
+			continue
+		}
+		value, err := readVaultSecret(d.vault, ref)
+		if err != nil {
+			return "", errors.New(fmt.Sprintf("Could not resolve %s%s: %v", vaultPrefix, ref, err))
+		}
+		d.secrets.values[ref] = value
+
+		escaped, _ := json.Marshal(value)
+		rendered = strings.Replace(rendered, vaultPrefix+ref, string(escaped[1:len(escaped)-1]), -1)
+	}
+
+	return rendered, nil
+}
@@ -0,0 +1,189 @@
+package install
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/CiscoCloud/mantl-api/marathon"
+	vault "github.com/hashicorp/vault/api"
+	"github.com/stretchr/testify/assert"
+)
+
+var vaultConfigJson = `
+{
+	"type": "object",
+	"properties": {
+		"kafka": {
+			"type": "object",
+			"properties": {
+				"password": {"type": "string", "default": ""},
+				"user": {"type": "string", "default": "kafka"}
+			}
+		}
+	}
+}
+`
+
+var vaultMarathonJson = `
+{
+	"id": "/kafka",
+	"cmd": "run --password {{kafka.password}}",
+	"env": {
+		"KAFKA_USER": "{{kafka.user}}",
+		"KAFKA_PASSWORD": "{{kafka.password}}"
+	}
+}
+`
+
+func fakeVault(t *testing.T) (*httptest.Server, *vault.Client) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/secret/kafka" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"data": {"password": "s3cr\"et"}}`))
+	}))
+
+	config := vault.DefaultConfig()
+	config.Address = ts.URL
+	client, err := vault.NewClient(config)
+	assert.NoError(t, err)
+	client.SetToken("token")
+
+	return ts, client
+}
+
+func vaultPackageDefinition(client *vault.Client, marathonSecrets bool) *packageDefinition {
+	return &packageDefinition{
+		configJson:        []byte(vaultConfigJson),
+		optionsJson:       []byte(`{}`),
+		marathonJson:      []byte(vaultMarathonJson),
+		uninstallJson:     []byte(`{"password": "{{kafka.password}}"}`),
+		userConfig:        map[string]interface{}{"kafka": map[string]interface{}{"password": "vault:secret/kafka#password"}},
+		vault:             client,
+		vaultRequestPaths: []string{"secret/kafka"},
+		marathonSecrets:   marathonSecrets,
+		secrets:           newPackageSecrets(),
+		valueTransformers: valueTransformers,
+		valueResolvers:    valueResolvers,
+	}
+}
+
+func TestVaultResolver(t *testing.T) {
+	t.Parallel()
+	ts, client := fakeVault(t)
+	defer ts.Close()
+
+	pkgDef := vaultPackageDefinition(client, false)
+	appJson, err := pkgDef.MarathonAppJson()
+	assert.NoError(t, err)
+
+	app := &marathon.App{}
+	assert.NoError(t, json.Unmarshal([]byte(appJson), app))
+	assert.Equal(t, "s3cr&quot;et", app.Env["KAFKA_PASSWORD"].Value)
+	assert.Equal(t, "run --password s3cr&quot;et", app.Cmd)
+
+	// labels keep the reference
+	assert.NoError(t, addMantlLabels(app, pkgDef))
+	uninstall, err := pkgDef.redacted().UninstallJson()
+	assert.NoError(t, err)
+	assert.Equal(t, `{"password": "vault:secret/kafka#password"}`, uninstall)
+	assert.Equal(t, "eyJwYXNzd29yZCI6ICJ2YXVsdDpzZWNyZXQva2Fma2EjcGFzc3dvcmQifQ==", app.Labels[packageUninstallKey])
+}
+
+func TestVaultResolverMarathonSecrets(t *testing.T) {
+	t.Parallel()
+	ts, client := fakeVault(t)
+	defer ts.Close()
+
+	pkgDef := vaultPackageDefinition(client, true)
+	appJson, err := pkgDef.MarathonAppJson()
+	assert.NoError(t, err)
+
+	app := &marathon.App{}
+	assert.NoError(t, json.Unmarshal([]byte(appJson), app))
+	assert.Equal(t, marathon.EnvVar{Secret: "mantl-kafka_password"}, app.Env["KAFKA_PASSWORD"])
+	assert.Equal(t, marathon.EnvVar{Value: "kafka"}, app.Env["KAFKA_USER"])
+	assert.Equal(t, map[string]marathon.Secret{"mantl-kafka_password": {Source: "secret/kafka#password"}}, app.Secrets)
+
+	// other uses can't refer to a secret and get the value
+	assert.Equal(t, `run --password s3cr"et`, app.Cmd)
+}
+
+func TestRedactedDeployment(t *testing.T) {
+	t.Parallel()
+	ts, client := fakeVault(t)
+	defer ts.Close()
+
+	// a plain config value that happens to equal the secret stays as it is
+	pkgDef := vaultPackageDefinition(client, false)
+	pkgDef.userConfig = map[string]interface{}{"kafka": map[string]interface{}{"password": "vault:secret/kafka#password", "user": `s3cr"et`}}
+	deployment, err := pkgDef.deployment()
+	assert.NoError(t, err)
+	deployment.setID("/kafka-1")
+
+	redacted, err := pkgDef.redactedDeployment(deployment)
+	assert.NoError(t, err)
+	assert.Equal(t, "/kafka-1", redacted.ID())
+	assert.Equal(t, "vault:secret/kafka#password", redacted.App.Env["KAFKA_PASSWORD"].Value)
+	assert.Equal(t, "s3cr&quot;et", redacted.App.Env["KAFKA_USER"].Value)
+	assert.Equal(t, "run --password vault:secret/kafka#password", redacted.App.Cmd)
+	assert.Equal(t, deployment.App.Labels, redacted.App.Labels)
+
+	// the deployment itself keeps the values
+	assert.Equal(t, "s3cr&quot;et", deployment.App.Env["KAFKA_PASSWORD"].Value)
+
+	pkgDef = vaultPackageDefinition(client, true)
+	deployment, err = pkgDef.deployment()
+	assert.NoError(t, err)
+	redacted, err = pkgDef.redactedDeployment(deployment)
+	assert.NoError(t, err)
+	assert.Equal(t, marathon.EnvVar{Secret: "mantl-kafka_password"}, redacted.App.Env["KAFKA_PASSWORD"])
+	assert.Equal(t, deployment.App.Secrets, redacted.App.Secrets)
+	assert.Equal(t, "run --password vault:secret/kafka#password", redacted.App.Cmd)
+}
+
+func TestVaultResolverErrors(t *testing.T) {
+	t.Parallel()
+	ts, client := fakeVault(t)
+	defer ts.Close()
+
+	pkgDef := vaultPackageDefinition(nil, false)
+	_, err := pkgDef.MarathonAppJson()
+	assert.EqualError(t, err, "Could not resolve vault:secret/kafka#password: Vault is not configured, cannot read secret/kafka")
+
+	pkgDef = vaultPackageDefinition(client, false)
+	pkgDef.userConfig = map[string]interface{}{"kafka": map[string]interface{}{"password": "vault:secret/missing#password"}}
+	_, err = pkgDef.MarathonAppJson()
+	assert.Error(t, err)
+
+	pkgDef.userConfig = map[string]interface{}{"kafka": map[string]interface{}{"password": "vault:secret/kafka"}}
+	_, err = pkgDef.MarathonAppJson()
+	assert.EqualError(t, err, "Could not resolve vault:secret/kafka: Vault secret references must have the form vault:<path>#<key>")
+}
+
+func TestVaultRequestPaths(t *testing.T) {
+	t.Parallel()
+	ts, client := fakeVault(t)
+	defer ts.Close()
+
+	for _, ref := range []string{"vault:secret/mantl-api#token", "vault:secret/kafkaesque#password", "vault:secret/kafka/../mantl-api#token"} {
+		pkgDef := vaultPackageDefinition(client, false)
+		pkgDef.userConfig = map[string]interface{}{"kafka": map[string]interface{}{"password": ref}}
+		_, err := pkgDef.deployment()
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "is not a Vault path install requests may refer to")
+		}
+	}
+
+	// package config is not limited
+	pkgDef := vaultPackageDefinition(client, false)
+	pkgDef.vaultRequestPaths = nil
+	pkgDef.userConfig = nil
+	pkgDef.optionsJson = []byte(`{"kafka": {"password": "vault:secret/kafka#password"}}`)
+	appJson, err := pkgDef.MarathonAppJson()
+	assert.NoError(t, err)
+	assert.Contains(t, appJson, `"KAFKA_PASSWORD": "s3cr&quot;et"`)
+}
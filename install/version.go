@@ -0,0 +1,274 @@
+package install
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	LatestVersion          = "latest"
+	LatestSupportedVersion = "latest-supported"
+)
+
+type semver struct {
+	parts []int
+	pre   string
+}
+
+// parseSemver parses versions like 1.2, v1.2.3 or 0.2.0-1. Package versions
+// often have more or fewer than three parts, so any number is accepted.
+func parseSemver(version string) (*semver, bool) {
+	version = strings.TrimPrefix(strings.TrimSpace(version), "v")
+	if version == "" {
+		return nil, false
+	}
+
+	v := &semver{}
+	core := version
+	if i := strings.IndexAny(version, "-+"); i >= 0 {
+		core = version[:i]
+		v.pre = strings.TrimPrefix(version[i:], "-")
+		if strings.HasPrefix(v.pre, "+") {
+			// build metadata doesn't affect ordering
+			v.pre = ""
+		} else if j := strings.Index(v.pre, "+"); j >= 0 {
+			v.pre = v.pre[:j]
+		}
+	}
+
+	for _, part := range strings.Split(core, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, false
+		}
+		v.parts = append(v.parts, n)
+	}
+
+	return v, true
+}
+
+func (v *semver) part(i int) int {
+	if i < len(v.parts) {
+		return v.parts[i]
+	}
+	return 0
+}
+
+func (v *semver) compare(o *semver) int {
+	n := len(v.parts)
+	if len(o.parts) > n {
+		n = len(o.parts)
+	}
+
+	for i := 0; i < n; i++ {
+		if a, b := v.part(i), o.part(i); a != b {
+			if a < b {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	// a pre-release sorts before the release itself
+	switch {
+	case v.pre == o.pre:
+		return 0
+	case v.pre == "":
+		return 1
+	case o.pre == "":
+		return -1
+	}
+	return comparePreRelease(v.pre, o.pre)
+}
+
+func comparePreRelease(a string, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aErr := strconv.Atoi(as[i])
+		bn, bErr := strconv.Atoi(bs[i])
+		switch {
+		case aErr == nil && bErr == nil:
+			if an != bn {
+				return compareInts(an, bn)
+			}
+		case aErr == nil:
+			return -1
+		case bErr == nil:
+			return 1
+		case as[i] != bs[i]:
+			return strings.Compare(as[i], bs[i])
+		}
+	}
+	return compareInts(len(as), len(bs))
+}
+
+func compareInts(a int, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// compareVersions orders versions semantically. Versions that can't be
+// parsed sort before those that can and are otherwise considered equal.
+func compareVersions(a string, b string) int {
+	av, aOk := parseSemver(a)
+	bv, bOk := parseSemver(b)
+	switch {
+	case aOk && bOk:
+		return av.compare(bv)
+	case aOk:
+		return 1
+	case bOk:
+		return -1
+	}
+	return 0
+}
+
+// compareIndexes orders release indexes numerically, falling back to a
+// string comparison for indexes that aren't numbers.
+func compareIndexes(a string, b string) int {
+	an, aErr := strconv.Atoi(a)
+	bn, bErr := strconv.Atoi(b)
+	if aErr == nil && bErr == nil {
+		return compareInts(an, bn)
+	}
+	return strings.Compare(a, b)
+}
+
+type indexesByOrder []string
+
+func (p indexesByOrder) Len() int           { return len(p) }
+func (p indexesByOrder) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p indexesByOrder) Less(i, j int) bool { return compareIndexes(p[i], p[j]) < 0 }
+
+func sortIndexes(indexes []string) {
+	sort.Sort(indexesByOrder(indexes))
+}
+
+type versionPredicate func(v *semver) bool
+
+// versionConstraint is a set of alternatives separated by ||, each of which
+// is a list of comparisons that must all hold, e.g. ">=0.9 <1.0 || ~1.2".
+type versionConstraint [][]versionPredicate
+
+func (c versionConstraint) matches(version string) bool {
+	v, ok := parseSemver(version)
+	if !ok {
+		return false
+	}
+
+	for _, all := range c {
+		matched := true
+		for _, predicate := range all {
+			if !predicate(v) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseVersionConstraint(constraint string) (versionConstraint, error) {
+	c := versionConstraint{}
+	for _, alternative := range strings.Split(constraint, "||") {
+		var all []versionPredicate
+		terms := strings.Fields(strings.Replace(alternative, ",", " ", -1))
+		for i := 0; i < len(terms); i++ {
+			term := terms[i]
+			// allow a space between the operator and the version
+			if strings.Trim(term, "<>=!~^") == "" && i+1 < len(terms) {
+				i++
+				term += terms[i]
+			}
+
+			predicates, err := parseVersionTerm(term)
+			if err != nil {
+				return nil, err
+			}
+			all = append(all, predicates...)
+		}
+
+		if len(all) == 0 {
+			return nil, errors.New(fmt.Sprintf("Invalid version constraint %q", constraint))
+		}
+		c = append(c, all)
+	}
+	return c, nil
+}
+
+func parseVersionTerm(term string) ([]versionPredicate, error) {
+	op := term[:len(term)-len(strings.TrimLeft(term, "<>=!~^"))]
+	version := strings.TrimPrefix(term, op)
+
+	bound, ok := parseSemver(strings.TrimSuffix(strings.TrimSuffix(version, ".x"), ".*"))
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Invalid version %q in constraint", version))
+	}
+
+	cmp := func(test func(int) bool) versionPredicate {
+		return func(v *semver) bool { return test(v.compare(bound)) }
+	}
+
+	switch op {
+	case ">=":
+		return []versionPredicate{cmp(func(c int) bool { return c >= 0 })}, nil
+	case ">":
+		return []versionPredicate{cmp(func(c int) bool { return c > 0 })}, nil
+	case "<=":
+		return []versionPredicate{cmp(func(c int) bool { return c <= 0 })}, nil
+	case "<":
+		return []versionPredicate{cmp(func(c int) bool { return c < 0 })}, nil
+	case "!=":
+		return []versionPredicate{cmp(func(c int) bool { return c != 0 })}, nil
+	case "~":
+		// ~1.2 and ~1.2.3 allow patch updates, ~1 allows minor updates
+		i := len(bound.parts) - 1
+		if i > 1 {
+			i = 1
+		}
+		return rangePredicates(bound, nextVersion(bound, i)), nil
+	case "^":
+		// ^1.2.3 allows updates that don't change the leftmost non-zero part
+		i := 0
+		for i < len(bound.parts)-1 && bound.parts[i] == 0 {
+			i++
+		}
+		return rangePredicates(bound, nextVersion(bound, i)), nil
+	case "", "=", "==":
+		// 1.2 matches any 1.2.x version
+		return rangePredicates(bound, nextVersion(bound, len(bound.parts)-1)), nil
+	}
+
+	return nil, errors.New(fmt.Sprintf("Invalid operator %q in version constraint", op))
+}
+
+// nextVersion increments part i of v and drops the parts after it.
+func nextVersion(v *semver, i int) *semver {
+	next := &semver{parts: make([]int, i+1)}
+	copy(next.parts, v.parts)
+	next.parts[i]++
+	return next
+}
+
+func rangePredicates(lower *semver, upper *semver) []versionPredicate {
+	return []versionPredicate{
+		func(v *semver) bool { return v.compare(lower) >= 0 },
+		// exclude pre-releases of the upper bound
+		func(v *semver) bool {
+			stripped := &semver{parts: v.parts}
+			return stripped.compare(upper) < 0
+		},
+	}
+}
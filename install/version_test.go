@@ -0,0 +1,119 @@
+package install
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompareVersions(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, 1, compareVersions("1.10.0", "1.9.0"))
+	assert.Equal(t, -1, compareVersions("0.9.4.0", "0.9.10.0"))
+	assert.Equal(t, 0, compareVersions("1.2", "1.2.0"))
+	assert.Equal(t, -1, compareVersions("1.0.0-rc1", "1.0.0"))
+	assert.Equal(t, -1, compareVersions("1.0.0-rc.2", "1.0.0-rc.10"))
+	assert.Equal(t, 1, compareVersions("v2.0", "1.9"))
+	assert.Equal(t, 1, compareVersions("1.0", "stable"))
+	assert.Equal(t, 0, compareVersions("stable", "beta"))
+}
+
+func TestPackageVersionOrderingUsesIndexAsTiebreaker(t *testing.T) {
+	t.Parallel()
+	versions := []*PackageVersion{
+		{Version: "1.0", Index: "9"},
+		{Version: "1.0", Index: "10"},
+		{Version: "1.1", Index: "2"},
+		{Version: "latest", Index: "11"},
+	}
+
+	sort.Sort(packageVersionByMostRecent(versions))
+
+	idxs := make([]string, len(versions))
+	for i, v := range versions {
+		idxs[i] = v.Index
+	}
+	assert.Equal(t, []string{"2", "10", "9", "11"}, idxs)
+}
+
+func TestSortIndexes(t *testing.T) {
+	t.Parallel()
+	idxs := []string{"10", "9", "1"}
+	sortIndexes(idxs)
+	assert.Equal(t, []string{"1", "9", "10"}, idxs)
+}
+
+func TestVersionConstraints(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		constraint string
+		version    string
+		matches    bool
+	}{
+		{"~1.2", "1.2.9", true},
+		{"~1.2", "1.3.0", false},
+		{"~1.2.3", "1.2.2", false},
+		{"~1", "1.9", true},
+		{"^0.2.3", "0.2.9", true},
+		{"^0.2.3", "0.3.0", false},
+		{"^1.2", "1.9.0", true},
+		{">=0.9 <1.0", "0.9.4.0", true},
+		{">=0.9 <1.0", "1.0.0", false},
+		{">=0.9, <1.0", "0.8", false},
+		{">= 0.9", "0.9", true},
+		{"1.2", "1.2.5", true},
+		{"1.2.x", "1.3", false},
+		{"!=1.0", "1.0.0", false},
+		{"<1.0 || >=2.0", "2.1", true},
+		{"<1.0 || >=2.0", "1.5", false},
+		{"~1.2", "1.3.0-rc1", false},
+	}
+
+	for _, c := range cases {
+		constraint, err := parseVersionConstraint(c.constraint)
+		if assert.Nil(t, err, c.constraint) {
+			assert.Equal(t, c.matches, constraint.matches(c.version), "%s matches %s", c.constraint, c.version)
+		}
+	}
+}
+
+func TestInvalidVersionConstraints(t *testing.T) {
+	t.Parallel()
+	for _, constraint := range []string{">=", "~abc", "=>1.0", "1.0 ||"} {
+		_, err := parseVersionConstraint(constraint)
+		assert.NotNil(t, err, constraint)
+	}
+}
+
+func TestResolvePackageVersion(t *testing.T) {
+	t.Parallel()
+	pkg := buildPackage([]*PackageVersion{
+		{Version: "0.9.4.0", Index: "0", Supported: true},
+		{Version: "0.9.10.0", Index: "10", Supported: true},
+		{Version: "0.9.9.0", Index: "9", Supported: false},
+		{Version: "1.0.0", Index: "11", Supported: false},
+	}, "")
+
+	cases := map[string]string{
+		"":                 "0.9.10.0",
+		"latest":           "1.0.0",
+		"latest-supported": "0.9.10.0",
+		"0.9.9.0":          "0.9.9.0",
+		">=0.9 <1.0":       "0.9.10.0",
+		"~1.0":             "1.0.0",
+		"<0.9.9":           "0.9.4.0",
+	}
+
+	for request, expected := range cases {
+		pkgVer, err := pkg.ResolvePackageVersion(request)
+		if assert.Nil(t, err, request) {
+			assert.Equal(t, expected, pkgVer.Version, request)
+		}
+	}
+
+	_, err := pkg.ResolvePackageVersion("~2.0")
+	assert.NotNil(t, err)
+	_, err = pkg.ResolvePackageVersion("bogus")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,142 @@
+package leader
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	consul "github.com/hashicorp/consul/api"
+)
+
+const LeaderKey = "mantl-install/leader"
+
+const (
+	sessionName  = "mantl-api-leader"
+	sessionTTL   = "15s"
+	retryBackoff = 5 * time.Second
+)
+
+type Leader struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+}
+
+type Election struct {
+	client  *consul.Client
+	key     string
+	self    *Leader
+	leading bool
+	l       sync.RWMutex
+}
+
+func NewElection(client *consul.Client, key string, self *Leader) *Election {
+	return &Election{client: client, key: key, self: self}
+}
+
+func (e *Election) Self() *Leader {
+	return e.self
+}
+
+func (e *Election) IsLeader() bool {
+	e.l.RLock()
+	defer e.l.RUnlock()
+	return e.leading
+}
+
+// Leader returns the instance currently holding the leader lock, or nil if
+// there is no leader.
+func (e *Election) Leader() (*Leader, error) {
+	kp, _, err := e.client.KV().Get(e.key, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if kp == nil || kp.Session == "" {
+		return nil, nil
+	}
+
+	leader := &Leader{}
+	err = json.Unmarshal(kp.Value, leader)
+	if err != nil {
+		return nil, err
+	}
+
+	return leader, nil
+}
+
+// Run campaigns for leadership until stop is closed. lead is called each time
+// leadership is acquired and must return once its stop channel is closed,
+// which happens when leadership is lost or the election is stopped.
+func (e *Election) Run(stop <-chan struct{}, lead func(stop <-chan struct{})) {
+	value, err := json.Marshal(e.self)
+	if err != nil {
+		log.Errorf("Could not marshal leader identity: %v", err)
+		return
+	}
+
+	for {
+		lock, err := e.client.LockOpts(&consul.LockOptions{
+			Key:         e.key,
+			Value:       value,
+			SessionName: sessionName,
+			SessionTTL:  sessionTTL,
+		})
+		if err != nil {
+			log.Errorf("Could not create leader lock: %v", err)
+			return
+		}
+
+		lost, err := lock.Lock(stop)
+		if err != nil {
+			log.Warnf("Could not acquire leader lock (retrying in %v): %v", retryBackoff, err)
+			select {
+			case <-stop:
+				return
+			case <-time.After(retryBackoff):
+				continue
+			}
+		}
+
+		if lost == nil {
+			// stopped while waiting for the lock
+			return
+		}
+
+		log.Infof("%s acquired leadership", e.self.ID)
+		e.setLeading(true)
+
+		leaderStop := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			lead(leaderStop)
+		}()
+
+		stopped := false
+		select {
+		case <-lost:
+			log.Warnf("%s lost leadership", e.self.ID)
+		case <-stop:
+			stopped = true
+		}
+
+		close(leaderStop)
+		<-done
+		e.setLeading(false)
+
+		if err := lock.Unlock(); err != nil && err != consul.ErrLockNotHeld {
+			log.Warnf("Could not release leader lock: %v", err)
+		}
+
+		if stopped {
+			return
+		}
+	}
+}
+
+func (e *Election) setLeading(leading bool) {
+	e.l.Lock()
+	defer e.l.Unlock()
+	e.leading = leading
+}
@@ -0,0 +1,71 @@
+package leader
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func fakeElection(handler func(w http.ResponseWriter, r *http.Request)) (*httptest.Server, *Election) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Consul-Index", "1")
+		w.Header().Set("X-Consul-LastContact", "0")
+		w.Header().Set("X-Consul-KnownLeader", "true")
+		handler(w, r)
+	}))
+
+	config := consul.DefaultConfig()
+	config.Address = strings.TrimPrefix(ts.URL, "http://")
+	client, _ := consul.NewClient(config)
+
+	return ts, NewElection(client, LeaderKey, &Leader{ID: "self", Address: "http://self:4001"})
+}
+
+func TestLeader(t *testing.T) {
+	t.Parallel()
+	var path string
+	ts, election := fakeElection(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		// base64 of {"id":"other","address":"http://other:4001"}
+		fmt.Fprint(w, `[{"Key": "mantl-install/leader", "Session": "abc", "Value": "eyJpZCI6Im90aGVyIiwiYWRkcmVzcyI6Imh0dHA6Ly9vdGhlcjo0MDAxIn0="}]`)
+	})
+	defer ts.Close()
+
+	leader, err := election.Leader()
+	assert.Nil(t, err)
+	assert.Equal(t, "/v1/kv/"+LeaderKey, path)
+	if assert.NotNil(t, leader) {
+		assert.Equal(t, "other", leader.ID)
+		assert.Equal(t, "http://other:4001", leader.Address)
+	}
+	assert.False(t, election.IsLeader())
+}
+
+func TestLeaderNoSession(t *testing.T) {
+	t.Parallel()
+	ts, election := fakeElection(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"Key": "mantl-install/leader", "Session": "", "Value": "e30="}]`)
+	})
+	defer ts.Close()
+
+	leader, err := election.Leader()
+	assert.Nil(t, err)
+	assert.Nil(t, leader)
+}
+
+func TestLeaderNoKey(t *testing.T) {
+	t.Parallel()
+	ts, election := fakeElection(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(404)
+	})
+	defer ts.Close()
+
+	leader, err := election.Leader()
+	assert.Nil(t, err)
+	assert.Nil(t, leader)
+}
@@ -2,14 +2,23 @@ package main
 
 import (
 	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/CiscoCloud/mantl-api/api"
 	"github.com/CiscoCloud/mantl-api/install"
+	"github.com/CiscoCloud/mantl-api/leader"
 	"github.com/CiscoCloud/mantl-api/marathon"
 	"github.com/CiscoCloud/mantl-api/mesos"
 	"github.com/CiscoCloud/mantl-api/utils/http"
@@ -40,16 +49,21 @@ func main() {
 		},
 	}
 
+	rootCmd.PersistentFlags().String("advertise", "", "Address other instances redirect requests to when this instance is the leader (defaults to the hostname and listen port)")
 	rootCmd.PersistentFlags().String("config-file", "", "The path to a (optional) configuration file")
 	rootCmd.PersistentFlags().String("consul-acl-token", "", "Consul ACL token for accessing mantl-install/apps path")
 	rootCmd.PersistentFlags().Bool("consul-no-verify-ssl", false, "Disable Consul SSL verification")
-	rootCmd.PersistentFlags().Int("consul-refresh-interval", 10, "The number of seconds after which to check consul for package requests")
+	rootCmd.PersistentFlags().Int("consul-request-attempts", 5, "The number of times a package request from consul is attempted before it is moved to mantl-install/failed")
+	rootCmd.PersistentFlags().Int("consul-refresh-interval", 10, "The maximum number of seconds a consul query for package requests blocks before it is retried")
 	rootCmd.PersistentFlags().String("consul", "http://localhost:8500", "Consul API address")
+	rootCmd.PersistentFlags().String("desired-state-file", "", "Path to a file describing the desired package installs (defaults to the mantl-install/desired path in consul)")
 	rootCmd.PersistentFlags().Bool("force-sync", false, "Force a synchronization of respository all sources at startup")
+	rootCmd.PersistentFlags().Bool("leader-election", true, "Elect a leader through consul so that only one instance processes package requests and synchronizes sources")
 	rootCmd.PersistentFlags().String("listen", ":4001", "listen for connections on this address")
 	rootCmd.PersistentFlags().String("log-format", "text", "specify output (text or json)")
 	rootCmd.PersistentFlags().String("log-level", "info", "one of debug, info, warn, error, or fatal")
 	rootCmd.PersistentFlags().String("marathon", "", "Marathon API address")
+	rootCmd.PersistentFlags().Bool("marathon-events", true, "Follow the Marathon event bus to track package deployments")
 	rootCmd.PersistentFlags().Bool("marathon-no-verify-ssl", false, "Disable Marathon SSL verification")
 	rootCmd.PersistentFlags().String("marathon-password", "", "Marathon API password")
 	rootCmd.PersistentFlags().String("marathon-user", "", "Marathon API user")
@@ -58,7 +72,15 @@ func main() {
 	rootCmd.PersistentFlags().String("mesos-principal", "", "Mesos principal for framework authentication")
 	rootCmd.PersistentFlags().String("mesos-secret", "", "Deprecated. Use mesos-secret-path instead")
 	rootCmd.PersistentFlags().String("mesos-secret-path", "/etc/sysconfig/mantl-api", "Path to a file on host sytem that contains the mesos secret for framework authentication")
+	rootCmd.PersistentFlags().Int("reconcile-interval", 0, "The number of seconds between desired state reconciliations (0 disables the reconciler)")
+	rootCmd.PersistentFlags().Bool("reconcile-prune", false, "Uninstall packages that are not in the desired state")
+	rootCmd.PersistentFlags().Bool("reconcile-report-only", false, "Report planned reconcile actions without applying them")
+	rootCmd.PersistentFlags().Int("source-refresh-interval", 0, "The default number of seconds between checks of repository sources for changes (0 disables refreshing)")
+	rootCmd.PersistentFlags().Bool("strict-templates", false, "Fail package installs when a template variable can't be resolved")
+	rootCmd.PersistentFlags().Int("sync-lock-wait", 300, "The number of seconds a source sync waits for a concurrent sync of the same source (0 fails immediately)")
 	rootCmd.PersistentFlags().String("vault-cubbyhole-token", "", "token for retrieving token from vault")
+	rootCmd.PersistentFlags().String("vault-request-paths", "", "Comma-delimited list of vault path prefixes that install requests may refer to")
+	rootCmd.PersistentFlags().Bool("vault-marathon-secrets", false, "Pass package config values that refer to vault to marathon as secrets instead of resolving them")
 	rootCmd.PersistentFlags().String("vault-token", "", "token for retrieving secrets from vault")
 	rootCmd.PersistentFlags().String("zookeeper", "", "Comma-delimited list of zookeeper servers")
 
@@ -78,11 +100,60 @@ func main() {
 		Short: "Synchronize universe repositories",
 		Long:  "Forces a synchronization of all configured sources",
 		Run: func(cmd *cobra.Command, args []string) {
-			syncRepo(nil, true)
+			initVault()
+			if err := syncRepo(nil, true); err != nil {
+				log.Fatal(err)
+			}
 		},
 	}
+	restoreCommand := &cobra.Command{
+		Use:   "restore <index>",
+		Short: "Restore the previous catalog of a repository",
+		Long:  "Makes the previously synchronized catalog generation of the repository with the given index active again",
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) != 1 {
+				log.Fatal("A repository index is required")
+			}
+			idx, err := strconv.Atoi(args[0])
+			if err != nil {
+				log.Fatalf("Invalid repository index %s: %v", args[0], err)
+			}
+			restoreRepo(idx)
+		},
+	}
+	syncCommand.AddCommand(restoreCommand)
 	rootCmd.AddCommand(syncCommand)
 
+	reconcileCommand := &cobra.Command{
+		Use:   "reconcile",
+		Short: "Converge installed packages to the desired state",
+		Long:  "Compares the desired state with installed packages and reports the installs, upgrades and uninstalls needed to converge. With --apply, the changes are made, whether or not this instance is the leader",
+		Run: func(cmd *cobra.Command, args []string) {
+			apply, _ := cmd.Flags().GetBool("apply")
+			reconcile(apply)
+		},
+	}
+	reconcileCommand.Flags().Bool("apply", false, "Apply the planned reconcile actions instead of only reporting them")
+	rootCmd.AddCommand(reconcileCommand)
+
+	bundleCommand := &cobra.Command{
+		Use:   "bundle",
+		Short: "Prepare packages for clusters without internet access",
+	}
+	exportCommand := &cobra.Command{
+		Use:   "export <directory>",
+		Short: "Export the catalog and the images and artifacts it needs",
+		Long:  "Renders every supported package version with its default config and writes a manifest of the Docker images and artifact uris it refers to, along with a repository archive that can be synced as a filesystem source",
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) != 1 {
+				log.Fatal("An output directory is required")
+			}
+			exportBundle(args[0])
+		},
+	}
+	bundleCommand.AddCommand(exportCommand)
+	rootCmd.AddCommand(bundleCommand)
+
 	versionCommand := &cobra.Command{
 		Use:   "version",
 		Short: fmt.Sprintf("Print the version number of %s", Name),
@@ -101,6 +172,107 @@ func start() {
 
 	initVault()
 
+	inst, mesosClient := installClient(client)
+	inst.RequestAttempts = viper.GetInt("consul-request-attempts")
+
+	shutdown := make(chan struct{})
+
+	// work that must only happen on one instance at a time
+	lead := func(stop <-chan struct{}) {
+		// sync sources to consul. the catalog of a previous sync stays
+		// active when this fails, and sources with a refresh interval are
+		// retried below.
+		if err := syncRepo(inst, viper.GetBool("force-sync")); err != nil {
+			log.Errorf("Could not synchronize sources: %v", err)
+		}
+
+		var leaderWg sync.WaitGroup
+		defer leaderWg.Wait()
+
+		if sources, err := configuredSources(); err != nil {
+			log.Errorf("Not refreshing sources: %v", err)
+		} else {
+			leaderWg.Add(1)
+			go func() {
+				defer leaderWg.Done()
+				inst.RefreshSources(sources, stop)
+			}()
+		}
+
+		if inst.Events != nil {
+			deployments := inst.Events.Subscribe(marathon.EventDeploymentSuccess, marathon.EventDeploymentFailed)
+			leaderWg.Add(2)
+			go func() {
+				defer leaderWg.Done()
+				inst.TrackDeployments(deployments, stop)
+			}()
+			go func() {
+				defer leaderWg.Done()
+				inst.Events.Run(stop)
+			}()
+		}
+
+		if interval := viper.GetInt("reconcile-interval"); interval > 0 {
+			log.Infof("Reconciling desired state every %d seconds. Package requests in %s are ignored.", interval, install.AppsRoot)
+			newReconciler(inst, viper.GetBool("reconcile-report-only")).Run(time.Duration(interval)*time.Second, stop)
+		} else {
+			inst.Watch(time.Duration(viper.GetInt("consul-refresh-interval"))*time.Second, stop)
+		}
+	}
+
+	var election *leader.Election
+	wg.Add(1)
+	if viper.GetBool("leader-election") {
+		election = leader.NewElection(client, leader.LeaderKey, &leader.Leader{
+			ID:      install.InstanceID(),
+			Address: advertiseAddress(),
+		})
+		go func() {
+			defer wg.Done()
+			election.Run(shutdown, lead)
+		}()
+	} else {
+		go func() {
+			defer wg.Done()
+			lead(shutdown)
+		}()
+	}
+
+	go api.NewApi(Name, viper.GetString("listen"), inst, mesosClient, election).Start()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	sig := <-signals
+	log.Infof("Received %v, shutting down", sig)
+
+	close(shutdown)
+	wg.Wait()
+}
+
+func advertiseAddress() string {
+	address := viper.GetString("advertise")
+	if address == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			log.Warnf("Could not determine hostname: %v", err)
+			return ""
+		}
+
+		_, port, err := net.SplitHostPort(viper.GetString("listen"))
+		if err != nil {
+			log.Warnf("Could not determine listen port: %v", err)
+			return ""
+		}
+		address = net.JoinHostPort(hostname, port)
+	}
+
+	if !strings.HasPrefix(address, "http") {
+		address = "http://" + address
+	}
+	return strings.TrimSuffix(address, "/")
+}
+
+func installClient(client *consul.Client) (*install.Install, *mesos.Mesos) {
 	marathonUrl := viper.GetString("marathon")
 	if marathonUrl == "" {
 		marathonHosts := NewDiscovery(client, "marathon", "").discoveredHosts
@@ -154,16 +326,58 @@ func start() {
 	if err != nil {
 		log.Fatalf("Could not create install client: %v", err)
 	}
+	inst.StrictTemplates = viper.GetBool("strict-templates")
+	inst.Vault = vaultClient
+	inst.VaultMarathonSecrets = viper.GetBool("vault-marathon-secrets")
+	for _, prefix := range strings.Split(viper.GetString("vault-request-paths"), ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			inst.VaultRequestPaths = append(inst.VaultRequestPaths, prefix)
+		}
+	}
+	inst.Policies = configuredPolicies()
+	inst.Rewrites = configuredRewrites()
+	if viper.GetBool("marathon-events") {
+		inst.Events = marathon.NewEventStream(
+			marathonClient,
+			marathon.EventDeploymentSuccess,
+			marathon.EventDeploymentFailed,
+		)
+	}
 
-	// sync sources to consul
-	syncRepo(inst, viper.GetBool("force-sync"))
+	return inst, mesosClient
+}
 
-	wg.Add(1)
-	go inst.Watch(time.Duration(viper.GetInt("consul-refresh-interval")))
-	go api.NewApi(Name, viper.GetString("listen"), inst, mesosClient, wg).Start()
-	wg.Wait()
+func newReconciler(inst *install.Install, reportOnly bool) *install.Reconciler {
+	return install.NewReconciler(
+		inst,
+		viper.GetString("desired-state-file"),
+		viper.GetBool("reconcile-prune"),
+		reportOnly,
+	)
+}
+
+func reconcile(apply bool) {
+	client := consulClient()
+	initVault()
+	inst, _ := installClient(client)
+
+	actions, err := newReconciler(inst, !apply || viper.GetBool("reconcile-report-only")).Reconcile()
+	if actions != nil {
+		blob, jsonErr := json.MarshalIndent(actions, "", "  ")
+		if jsonErr != nil {
+			log.Fatalf("Could not encode reconcile actions: %v", jsonErr)
+		}
+		fmt.Println(string(blob))
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
 }
 
+// vaultClient is set by initVault when a Vault token is configured
+var vaultClient *vault.Client
+
 func initVault() {
 	// set up vault client
 	var client *vault.Client
@@ -196,6 +410,7 @@ func initVault() {
 	// read secrets from vault
 	if token := viper.GetString("vault-token"); token != "" {
 		client.SetToken(token)
+		vaultClient = client
 
 		secret, err := client.Logical().Read("secret/mantl-api")
 		if err != nil {
@@ -216,6 +431,12 @@ func initVault() {
 	}
 }
 
+// readSecret returns value, or the secret it refers to when it has the form
+// vault:<path>#<key>.
+func readSecret(value string) (string, error) {
+	return install.ReadSecret(vaultClient, value)
+}
+
 func consulClient() *consul.Client {
 	consulConfig := consul.DefaultConfig()
 	scheme, address, _, err := http.ParseUrl(viper.GetString("consul"))
@@ -259,23 +480,43 @@ func testConsul(client *consul.Client) error {
 	return err
 }
 
-func syncRepo(inst *install.Install, force bool) {
+// syncRepo synchronizes the configured sources. With leader election it
+// runs whenever an instance becomes the leader, so errors are returned
+// rather than ending the process.
+func syncRepo(inst *install.Install, force bool) error {
 	var err error
 	if inst == nil {
 		client := consulClient()
 		inst, err = install.NewInstall(client, nil, nil, nil)
 		if err != nil {
-			log.Fatalf("Could not create install client: %v", err)
+			return errors.New(fmt.Sprintf("Could not create install client: %v", err))
 		}
 	}
 
+	sources, err := configuredSources()
+	if err != nil {
+		return err
+	}
+
+	inst.SyncLockWait = time.Duration(viper.GetInt("sync-lock-wait")) * time.Second
+	return inst.SyncSources(sources, force)
+}
+
+// configuredSources returns the sources from the configuration file, or the
+// default source when none are configured. A source whose token can't be
+// read is an error rather than being skipped, so that a private catalog is
+// never replaced by the default.
+func configuredSources() ([]*install.Source, error) {
+	refreshInterval := time.Duration(viper.GetInt("source-refresh-interval")) * time.Second
+
 	defaultSources := []*install.Source{
 		&install.Source{
-			Name:       "mantl",
-			Path:       "https://github.com/CiscoCloud/mantl-universe.git",
-			SourceType: install.Git,
-			Branch:     "version-0.7",
-			Index:      0,
+			Name:            "mantl",
+			Path:            "https://github.com/CiscoCloud/mantl-universe.git",
+			SourceType:      install.Git,
+			Branch:          "version-0.7",
+			Index:           0,
+			RefreshInterval: refreshInterval,
 		},
 	}
 
@@ -285,7 +526,7 @@ func syncRepo(inst *install.Install, force bool) {
 
 	if len(configuredSources) > 0 {
 		for name, val := range configuredSources {
-			source := &install.Source{Name: name, SourceType: install.FileSystem}
+			source := &install.Source{Name: name, SourceType: install.FileSystem, RefreshInterval: refreshInterval}
 			sourceConfig := val.(map[string]interface{})
 
 			if path, ok := sourceConfig["path"].(string); ok {
@@ -299,6 +540,8 @@ func syncRepo(inst *install.Install, force bool) {
 			if sourceType, ok := sourceConfig["type"].(string); ok {
 				if strings.EqualFold(sourceType, "git") {
 					source.SourceType = install.Git
+				} else if strings.EqualFold(sourceType, "http") {
+					source.SourceType = install.HTTP
 				}
 			}
 
@@ -306,6 +549,42 @@ func syncRepo(inst *install.Install, force bool) {
 				source.Branch = branch
 			}
 
+			if sha256, ok := sourceConfig["sha256"].(string); ok {
+				source.SHA256 = sha256
+			}
+
+			if ref, ok := sourceConfig["ref"].(string); ok {
+				source.Ref = ref
+			}
+
+			if subdirectory, ok := sourceConfig["subdirectory"].(string); ok {
+				source.Subdirectory = subdirectory
+			}
+
+			if sshKey, ok := sourceConfig["ssh-key"].(string); ok {
+				source.SSHKey = sshKey
+			}
+
+			if token, ok := sourceConfig["token"].(string); ok {
+				secret, err := readSecret(token)
+				if err != nil {
+					return nil, errors.New(fmt.Sprintf("Could not read token for %s source: %v", name, err))
+				}
+				source.Token = secret
+			}
+
+			if timeout, ok := sourceConfig["timeout"].(int64); ok {
+				source.Timeout = time.Duration(timeout) * time.Second
+			}
+
+			if maxSize, ok := sourceConfig["max-size"].(int64); ok {
+				source.MaxSize = maxSize << 20
+			}
+
+			if interval, ok := sourceConfig["refresh-interval"].(int64); ok {
+				source.RefreshInterval = time.Duration(interval) * time.Second
+			}
+
 			if source.IsValid() {
 				sources = append(sources, source)
 			} else {
@@ -318,11 +597,82 @@ func syncRepo(inst *install.Install, force bool) {
 		sources = defaultSources
 	}
 
-	if err := inst.SyncSources(sources, force); err != nil {
+	return sources, nil
+}
+
+func configuredPolicies() []*install.PolicyRule {
+	policies, err := install.ParsePolicies(viper.GetStringMap("policies"))
+	if err != nil {
+		log.Fatalf("Invalid policy configuration: %v", err)
+	}
+	return policies
+}
+
+func configuredRewrites() install.Rewrites {
+	rewrites := install.Rewrites{}
+
+	blob, err := json.Marshal(viper.Get("rewrites"))
+	if err == nil {
+		err = json.Unmarshal(blob, &rewrites)
+	}
+	if err != nil {
+		log.Warnf("Invalid rewrites configuration: %v", err)
+		return install.Rewrites{}
+	}
+
+	return rewrites
+}
+
+func restoreRepo(idx int) {
+	client := consulClient()
+	inst, err := install.NewInstall(client, nil, nil, nil)
+	if err != nil {
+		log.Fatalf("Could not create install client: %v", err)
+	}
+
+	if err := inst.RestoreRepository(idx); err != nil {
 		log.Fatal(err)
 	}
 }
 
+func exportBundle(dir string) {
+	client := consulClient()
+	inst, err := install.NewInstall(client, nil, nil, nil)
+	if err != nil {
+		log.Fatalf("Could not create install client: %v", err)
+	}
+	// keep vault references instead of reading secrets
+	inst.VaultMarathonSecrets = true
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Fatalf("Could not create %s: %v", dir, err)
+	}
+
+	archivePath := filepath.Join(dir, "repository.tar.gz")
+	archive, err := os.Create(archivePath)
+	if err != nil {
+		log.Fatalf("Could not create %s: %v", archivePath, err)
+	}
+	defer archive.Close()
+
+	manifest, err := inst.ExportBundle(archive)
+	if err != nil {
+		log.Fatalf("Could not export bundle: %v", err)
+	}
+
+	blob, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		log.Fatalf("Could not encode bundle manifest: %v", err)
+	}
+
+	manifestPath := filepath.Join(dir, "manifest.json")
+	if err := ioutil.WriteFile(manifestPath, blob, 0644); err != nil {
+		log.Fatalf("Could not write %s: %v", manifestPath, err)
+	}
+
+	log.Infof("Exported %d package versions with %d images and %d uris to %s", len(manifest.Packages), len(manifest.Images), len(manifest.URIs), dir)
+}
+
 func readConfigFile() {
 	// read configuration file if specified
 	configFile := viper.GetString("config-file")
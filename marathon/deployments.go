@@ -0,0 +1,37 @@
+package marathon
+
+import (
+	"fmt"
+)
+
+// Deployment is a change to apps or pods that Marathon is rolling out.
+type Deployment struct {
+	ID             string              `json:"id"`
+	Version        string              `json:"version"`
+	AffectedApps   []string            `json:"affectedApps"`
+	AffectedPods   []string            `json:"affectedPods,omitempty"`
+	CurrentStep    int                 `json:"currentStep"`
+	TotalSteps     int                 `json:"totalSteps"`
+	CurrentActions []*DeploymentAction `json:"currentActions"`
+}
+
+type DeploymentAction struct {
+	Action string `json:"action"`
+	App    string `json:"app,omitempty"`
+	Pod    string `json:"pod,omitempty"`
+}
+
+func (m Marathon) Deployments() ([]*Deployment, error) {
+	deployments := []*Deployment{}
+	if err := m.get("/v2/deployments", "Failed retrieving deployments from marathon", &deployments); err != nil {
+		return nil, err
+	}
+	return deployments, nil
+}
+
+// CancelDeployment rolls back a deployment by starting a new one, unless
+// force is set, in which case Marathon just stops it where it is and no
+// new deployment is returned.
+func (m Marathon) CancelDeployment(deploymentId string, force bool) (*DeploymentResult, error) {
+	return m.deploy("DELETE", "/v2/deployments/"+deploymentId+forceQuery(force), nil, fmt.Sprintf("Failed canceling deployment %s in marathon", deploymentId))
+}
@@ -0,0 +1,61 @@
+package marathon
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeployments(t *testing.T) {
+	t.Parallel()
+	ts, marathon := fakeMarathon(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"id": "97c136bf", "version": "2015-09-30T09:09:17.614Z", "affectedApps": ["/example"], "currentStep": 1, "totalSteps": 2, "currentActions": [{"action": "ScaleApplication", "app": "/example"}]}]`)
+	})
+	defer ts.Close()
+
+	deployments, err := marathon.Deployments()
+	assert.Nil(t, err)
+	assert.Len(t, deployments, 1)
+	assert.Equal(t, "97c136bf", deployments[0].ID)
+	assert.Equal(t, []string{"/example"}, deployments[0].AffectedApps)
+	assert.Equal(t, 2, deployments[0].TotalSteps)
+	assert.Equal(t, "ScaleApplication", deployments[0].CurrentActions[0].Action)
+}
+
+func TestCancelDeployment(t *testing.T) {
+	t.Parallel()
+	var requests []string
+	ts, marathon := fakeMarathon(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.RequestURI())
+		if r.URL.Query().Get("force") == "true" {
+			w.WriteHeader(202)
+			return
+		}
+		fmt.Fprint(w, `{"version":"2015-10-07T12:56:01.940Z","deploymentId":"0b1467fc"}`)
+	})
+	defer ts.Close()
+
+	result, err := marathon.CancelDeployment("97c136bf", false)
+	assert.Nil(t, err)
+	assert.Equal(t, "0b1467fc", result.DeploymentID)
+
+	result, err = marathon.CancelDeployment("0b1467fc", true)
+	assert.Nil(t, err)
+	assert.Equal(t, "", result.DeploymentID)
+
+	assert.Equal(t, []string{"DELETE /v2/deployments/97c136bf", "DELETE /v2/deployments/0b1467fc?force=true"}, requests)
+}
+
+func TestCancelDeploymentNotFound(t *testing.T) {
+	t.Parallel()
+	ts, marathon := fakeMarathon(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(404)
+		fmt.Fprint(w, `{"message": "DeploymentPlan 97c136bf does not exist"}`)
+	})
+	defer ts.Close()
+
+	_, err := marathon.CancelDeployment("97c136bf", false)
+	assert.True(t, IsNotFound(err))
+}
@@ -0,0 +1,67 @@
+package marathon
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	mhttp "github.com/CiscoCloud/mantl-api/utils/http"
+)
+
+// Error is returned when Marathon answers a request with an unexpected
+// status code. Message is Marathon's explanation, or the status text when
+// it didn't give one.
+type Error struct {
+	Operation  string
+	StatusCode int
+	Message    string
+	Details    []ErrorDetail
+}
+
+// ErrorDetail is a validation error of a field of a Marathon definition.
+type ErrorDetail struct {
+	Path   string   `json:"path"`
+	Errors []string `json:"errors"`
+}
+
+func (e *Error) Error() string {
+	message := e.Message
+	for _, detail := range e.Details {
+		message += fmt.Sprintf("; %s: %s", detail.Path, strings.Join(detail.Errors, ", "))
+	}
+	return fmt.Sprintf("%s: %d %s", e.Operation, e.StatusCode, message)
+}
+
+// IsNotFound reports whether err is a Marathon 404.
+func IsNotFound(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.StatusCode == http.StatusNotFound
+}
+
+// checkResponse returns an *Error unless the response has one of the
+// expected status codes.
+func checkResponse(httpReq *mhttp.HttpRequest, operation string, expected ...int) error {
+	for _, code := range expected {
+		if httpReq.Response.StatusCode == code {
+			return nil
+		}
+	}
+
+	e := &Error{Operation: operation, StatusCode: httpReq.Response.StatusCode}
+
+	body := struct {
+		Message string        `json:"message"`
+		Details []ErrorDetail `json:"details"`
+	}{}
+	if err := json.Unmarshal(httpReq.ResponseBody, &body); err == nil && body.Message != "" {
+		e.Message = body.Message
+		e.Details = body.Details
+	} else if text := strings.TrimSpace(httpReq.ResponseText); text != "" && !strings.HasPrefix(text, "{") {
+		e.Message = text
+	} else {
+		e.Message = http.StatusText(e.StatusCode)
+	}
+
+	return e
+}
@@ -0,0 +1,333 @@
+package marathon
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	EventDeploymentSuccess   = "deployment_success"
+	EventDeploymentFailed    = "deployment_failed"
+	EventStatusUpdate        = "status_update_event"
+	EventHealthStatusChanged = "health_status_changed_event"
+)
+
+const (
+	eventsMinBackoff = 1 * time.Second
+	eventsMaxBackoff = 1 * time.Minute
+
+	// events a subscriber hasn't received yet; more are dropped
+	subscriptionBuffer = 100
+)
+
+// Event is an event from the Marathon event bus. Data is the raw event, and
+// the field matching Type is decoded from it.
+type Event struct {
+	Type      string
+	Timestamp string
+	Data      json.RawMessage
+
+	Deployment          *DeploymentEvent
+	StatusUpdate        *StatusUpdateEvent
+	HealthStatusChanged *HealthStatusChangedEvent
+}
+
+// DeploymentEvent is sent when a deployment succeeded or failed.
+type DeploymentEvent struct {
+	ID     string          `json:"id"`
+	Plan   *DeploymentPlan `json:"plan"`
+	Reason string          `json:"reason,omitempty"`
+}
+
+type DeploymentPlan struct {
+	ID       string            `json:"id"`
+	Version  string            `json:"version"`
+	Original *Group            `json:"original"`
+	Target   *Group            `json:"target"`
+	Steps    []*DeploymentStep `json:"steps"`
+}
+
+type DeploymentStep struct {
+	Actions []*DeploymentAction `json:"actions"`
+}
+
+// StatusUpdateEvent is sent when the state of a task changes, e.g. to
+// TASK_RUNNING or TASK_FAILED.
+type StatusUpdateEvent struct {
+	AppID      string `json:"appId"`
+	TaskID     string `json:"taskId"`
+	TaskStatus string `json:"taskStatus"`
+	Message    string `json:"message"`
+	Host       string `json:"host"`
+	Ports      []int  `json:"ports"`
+	SlaveID    string `json:"slaveId"`
+	Version    string `json:"version"`
+}
+
+type HealthStatusChangedEvent struct {
+	AppID      string `json:"appId"`
+	TaskID     string `json:"taskId"`
+	InstanceID string `json:"instanceId,omitempty"`
+	Version    string `json:"version"`
+	Alive      bool   `json:"alive"`
+}
+
+// AffectedApps returns the ids of the apps that the steps of a deployment
+// change.
+func (p *DeploymentPlan) AffectedApps() []string {
+	ids := []string{}
+	seen := make(map[string]bool)
+	for _, step := range p.Steps {
+		for _, action := range step.Actions {
+			if action.App != "" && !seen[action.App] {
+				seen[action.App] = true
+				ids = append(ids, action.App)
+			}
+		}
+	}
+	return ids
+}
+
+// EventStream reads the server-sent events of Marathon's /v2/events and
+// dispatches them to its subscriptions.
+type EventStream struct {
+	marathon   *Marathon
+	eventTypes []string
+
+	subscriptions map[*Subscription]bool
+	l             sync.Mutex
+}
+
+// Subscription receives the events of the types it subscribed to on
+// Events, which is closed when it is unsubscribed.
+type Subscription struct {
+	Events <-chan *Event
+
+	events     chan *Event
+	eventTypes map[string]bool
+	stream     *EventStream
+}
+
+// NewEventStream creates a stream that asks Marathon for events of the
+// given types only, or for every event when none are given.
+func NewEventStream(marathon *Marathon, eventTypes ...string) *EventStream {
+	return &EventStream{
+		marathon:      marathon,
+		eventTypes:    eventTypes,
+		subscriptions: make(map[*Subscription]bool),
+	}
+}
+
+// Subscribe returns a subscription to the events of the given types, or to
+// every event of the stream when none are given. A subscription that falls
+// behind misses events rather than holding up the stream.
+func (s *EventStream) Subscribe(eventTypes ...string) *Subscription {
+	events := make(chan *Event, subscriptionBuffer)
+	sub := &Subscription{
+		Events:     events,
+		events:     events,
+		eventTypes: make(map[string]bool),
+		stream:     s,
+	}
+	for _, eventType := range eventTypes {
+		sub.eventTypes[eventType] = true
+	}
+
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.subscriptions[sub] = true
+	return sub
+}
+
+func (sub *Subscription) Unsubscribe() {
+	s := sub.stream
+	s.l.Lock()
+	defer s.l.Unlock()
+	if s.subscriptions[sub] {
+		delete(s.subscriptions, sub)
+		close(sub.events)
+	}
+}
+
+func (s *EventStream) dispatch(event *Event) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	for sub := range s.subscriptions {
+		if len(sub.eventTypes) > 0 && !sub.eventTypes[event.Type] {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			log.Warnf("Dropped marathon %s event for a subscriber that is falling behind", event.Type)
+		}
+	}
+}
+
+// Run reads events until stop is closed, and reconnects with an increasing
+// backoff whenever the connection to Marathon is lost.
+func (s *EventStream) Run(stop <-chan struct{}) {
+	backoff := eventsMinBackoff
+
+	for {
+		connected, err := s.read(stop)
+		select {
+		case <-stop:
+			log.Debugf("Stopped reading marathon events")
+			return
+		default:
+		}
+
+		if connected {
+			backoff = eventsMinBackoff
+		}
+		log.Warnf("Lost marathon event stream (reconnecting in %v): %v", backoff, err)
+		select {
+		case <-stop:
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > eventsMaxBackoff {
+			backoff = eventsMaxBackoff
+		}
+	}
+}
+
+// read connects to the event stream and dispatches events until the
+// connection is lost or stop is closed.
+func (s *EventStream) read(stop <-chan struct{}) (bool, error) {
+	httpReq, err := s.marathon.httpClient.Stream(s.path())
+	if err != nil {
+		return false, err
+	}
+	if err := checkResponse(httpReq, "Failed subscribing to marathon events", 200); err != nil {
+		return false, err
+	}
+
+	body := httpReq.Response.Body
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		// closing the body interrupts a blocked read
+		select {
+		case <-stop:
+		case <-done:
+		}
+		body.Close()
+	}()
+
+	log.Infof("Subscribed to marathon events")
+	return true, readEvents(bufio.NewReader(body), s.dispatch)
+}
+
+func (s *EventStream) path() string {
+	if len(s.eventTypes) == 0 {
+		return "/v2/events"
+	}
+	query := url.Values{}
+	for _, eventType := range s.eventTypes {
+		query.Add("event_type", eventType)
+	}
+	return "/v2/events?" + query.Encode()
+}
+
+// readEvents parses server-sent events and calls fn with each complete
+// Marathon event until r fails.
+func readEvents(r *bufio.Reader, fn func(*Event)) error {
+	eventType := ""
+	data := []string{}
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				return errors.New("stream closed by marathon")
+			}
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		if line == "" {
+			if len(data) > 0 {
+				if event := parseEvent(eventType, strings.Join(data, "\n")); event != nil {
+					fn(event)
+				}
+			}
+			eventType = ""
+			data = data[:0]
+			continue
+		}
+
+		if strings.HasPrefix(line, ":") {
+			// comment, sent to keep the connection alive
+			continue
+		}
+
+		field, value := line, ""
+		if i := strings.Index(line, ":"); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch field {
+		case "event":
+			eventType = value
+		case "data":
+			data = append(data, value)
+		}
+	}
+}
+
+// parseEvent decodes the data of an event. Events with data that isn't
+// json are dropped, but events that don't match the typed model are still
+// passed on with their raw data.
+func parseEvent(eventType string, data string) *Event {
+	header := struct {
+		EventType string `json:"eventType"`
+		Timestamp string `json:"timestamp"`
+	}{}
+	if err := json.Unmarshal([]byte(data), &header); err != nil {
+		log.Warnf("Could not parse marathon %s event: %v", eventType, err)
+		return nil
+	}
+
+	event := &Event{
+		Type:      header.EventType,
+		Timestamp: header.Timestamp,
+		Data:      json.RawMessage(data),
+	}
+	if eventType != "" {
+		event.Type = eventType
+	}
+
+	var v interface{}
+	switch event.Type {
+	case EventDeploymentSuccess, EventDeploymentFailed:
+		event.Deployment = &DeploymentEvent{}
+		v = event.Deployment
+	case EventStatusUpdate:
+		event.StatusUpdate = &StatusUpdateEvent{}
+		v = event.StatusUpdate
+	case EventHealthStatusChanged:
+		event.HealthStatusChanged = &HealthStatusChangedEvent{}
+		v = event.HealthStatusChanged
+	default:
+		return event
+	}
+
+	if err := json.Unmarshal(event.Data, v); err != nil {
+		log.Warnf("Could not decode marathon %s event: %v", event.Type, err)
+		event.Deployment = nil
+		event.StatusUpdate = nil
+		event.HealthStatusChanged = nil
+	}
+	return event
+}
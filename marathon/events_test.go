@@ -0,0 +1,142 @@
+package marathon
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var deploymentSuccessEvent = `{"eventType":"deployment_success","timestamp":"2016-03-01T10:00:00.000Z","id":"867ed450","plan":{"id":"867ed450","version":"2016-03-01T09:59:00.000Z","target":{"id":"/","apps":[{"id":"/kafka","labels":{"MANTL_PACKAGE_NAME":"kafka"}}]},"steps":[{"actions":[{"action":"StartApplication","app":"/kafka"}]},{"actions":[{"action":"ScaleApplication","app":"/kafka"}]}]}}`
+
+func TestReadEvents(t *testing.T) {
+	t.Parallel()
+	stream := ": keepalive\r\n" +
+		"event: deployment_success\r\n" +
+		"data: " + deploymentSuccessEvent + "\r\n" +
+		"\r\n" +
+		"event: status_update_event\n" +
+		`data: {"eventType":"status_update_event","appId":"/kafka","taskId":"kafka.1",` + "\n" +
+		`data: "taskStatus":"TASK_RUNNING","host":"worker-01","ports":[31000]}` + "\n" +
+		"\n" +
+		"event: health_status_changed_event\n" +
+		`data: {"eventType":"health_status_changed_event","appId":"/kafka","taskId":"kafka.1","alive":true}` + "\n" +
+		"\n" +
+		"event: api_post_event\n" +
+		`data: {"eventType":"api_post_event","uri":"/v2/apps/kafka"}` + "\n" +
+		"\n" +
+		"data: not json\n" +
+		"\n"
+
+	events := []*Event{}
+	err := readEvents(bufio.NewReader(strings.NewReader(stream)), func(event *Event) {
+		events = append(events, event)
+	})
+	assert.EqualError(t, err, "stream closed by marathon")
+	assert.Len(t, events, 4)
+
+	assert.Equal(t, EventDeploymentSuccess, events[0].Type)
+	assert.Equal(t, "2016-03-01T10:00:00.000Z", events[0].Timestamp)
+	assert.Equal(t, "867ed450", events[0].Deployment.ID)
+	assert.Equal(t, []string{"/kafka"}, events[0].Deployment.Plan.AffectedApps())
+	assert.Equal(t, "kafka", events[0].Deployment.Plan.Target.Apps[0].Labels["MANTL_PACKAGE_NAME"])
+
+	assert.Equal(t, "TASK_RUNNING", events[1].StatusUpdate.TaskStatus)
+	assert.Equal(t, []int{31000}, events[1].StatusUpdate.Ports)
+
+	assert.True(t, events[2].HealthStatusChanged.Alive)
+
+	assert.Equal(t, "api_post_event", events[3].Type)
+	assert.JSONEq(t, `{"eventType":"api_post_event","uri":"/v2/apps/kafka"}`, string(events[3].Data))
+}
+
+func TestEventStreamPath(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, "/v2/events", NewEventStream(nil).path())
+	assert.Equal(t, "/v2/events?event_type=deployment_success&event_type=deployment_failed", NewEventStream(nil, EventDeploymentSuccess, EventDeploymentFailed).path())
+}
+
+func TestEventStreamSubscriptions(t *testing.T) {
+	t.Parallel()
+	var l sync.Mutex
+	connections := 0
+	ts, marathon := fakeMarathon(func(w http.ResponseWriter, r *http.Request) {
+		l.Lock()
+		connections++
+		connection := connections
+		l.Unlock()
+
+		assert.Equal(t, "/v2/events", r.URL.Path)
+		assert.Equal(t, "text/event-stream", r.Header.Get("Accept"))
+		w.Header().Set("Content-Type", "text/event-stream")
+		if connection == 1 {
+			// the stream is picked up again after marathon closes it
+			fmt.Fprintf(w, "event: deployment_success\ndata: %s\n\n", deploymentSuccessEvent)
+			return
+		}
+		fmt.Fprint(w, "event: status_update_event\ndata: {\"appId\":\"/kafka\",\"taskStatus\":\"TASK_FAILED\"}\n\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+	defer ts.Close()
+
+	stream := NewEventStream(marathon)
+	deployments := stream.Subscribe(EventDeploymentSuccess, EventDeploymentFailed)
+	all := stream.Subscribe()
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		stream.Run(stop)
+	}()
+
+	event := receiveEvent(t, deployments.Events)
+	assert.Equal(t, EventDeploymentSuccess, event.Type)
+
+	event = receiveEvent(t, all.Events)
+	assert.Equal(t, EventDeploymentSuccess, event.Type)
+	event = receiveEvent(t, all.Events)
+	assert.Equal(t, EventStatusUpdate, event.Type)
+	assert.Equal(t, "TASK_FAILED", event.StatusUpdate.TaskStatus)
+
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("event stream did not stop")
+	}
+
+	assert.Len(t, deployments.Events, 0)
+	deployments.Unsubscribe()
+	_, ok := <-deployments.Events
+	assert.False(t, ok)
+}
+
+func TestEventStreamError(t *testing.T) {
+	t.Parallel()
+	ts, marathon := fakeMarathon(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(401)
+		fmt.Fprint(w, `{"message": "Invalid username or password."}`)
+	})
+	defer ts.Close()
+
+	connected, err := NewEventStream(marathon).read(make(chan struct{}))
+	assert.False(t, connected)
+	assert.EqualError(t, err, "Failed subscribing to marathon events: 401 Invalid username or password.")
+}
+
+func receiveEvent(t *testing.T, events <-chan *Event) *Event {
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received")
+	}
+	return nil
+}
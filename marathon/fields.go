@@ -0,0 +1,174 @@
+package marathon
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// unknownFields are the fields of a Marathon definition that the typed
+// model doesn't have, along with the unknown fields of its typed objects
+// and arrays of objects, so that they survive a round trip.
+type unknownFields struct {
+	fields map[string]interface{}
+	nested map[string]*unknownFields
+	items  map[string][]*unknownFields
+}
+
+var unmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// collectUnknownFields returns the fields of data that t doesn't model, or
+// nil when there are none.
+func collectUnknownFields(t reflect.Type, data []byte) (*unknownFields, error) {
+	var raw map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, err
+	}
+	return unknownFieldsOf(t, raw), nil
+}
+
+func unknownFieldsOf(t reflect.Type, raw map[string]interface{}) *unknownFields {
+	u := &unknownFields{}
+	empty := true
+
+	for key, value := range raw {
+		field, ok := jsonField(t, key)
+		if !ok {
+			if u.fields == nil {
+				u.fields = make(map[string]interface{})
+			}
+			u.fields[key] = value
+			empty = false
+			continue
+		}
+
+		ft := indirectType(field.Type)
+		switch {
+		case isModel(ft):
+			if m, ok := value.(map[string]interface{}); ok {
+				if nested := unknownFieldsOf(ft, m); nested != nil {
+					if u.nested == nil {
+						u.nested = make(map[string]*unknownFields)
+					}
+					u.nested[key] = nested
+					empty = false
+				}
+			}
+		case ft.Kind() == reflect.Slice && isModel(indirectType(ft.Elem())):
+			list, ok := value.([]interface{})
+			if !ok {
+				continue
+			}
+			items := make([]*unknownFields, len(list))
+			found := false
+			for i, item := range list {
+				if m, ok := item.(map[string]interface{}); ok {
+					items[i] = unknownFieldsOf(indirectType(ft.Elem()), m)
+					found = found || items[i] != nil
+				}
+			}
+			if found {
+				if u.items == nil {
+					u.items = make(map[string][]*unknownFields)
+				}
+				u.items[key] = items
+				empty = false
+			}
+		}
+	}
+
+	if empty {
+		return nil
+	}
+	return u
+}
+
+// marshalWithUnknownFields adds the unknown fields back to the json of the
+// typed model. Typed fields always win, and the unknown fields of a typed
+// object are dropped when the object was removed.
+func marshalWithUnknownFields(v interface{}, u *unknownFields) ([]byte, error) {
+	blob, err := json.Marshal(v)
+	if err != nil || u == nil {
+		return blob, err
+	}
+
+	var out map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(blob))
+	decoder.UseNumber()
+	if err := decoder.Decode(&out); err != nil {
+		return nil, err
+	}
+
+	u.merge(out)
+	return json.Marshal(out)
+}
+
+func (u *unknownFields) merge(out map[string]interface{}) {
+	if u == nil {
+		return
+	}
+
+	for key, value := range u.fields {
+		if _, ok := out[key]; !ok {
+			out[key] = value
+		}
+	}
+
+	for key, nested := range u.nested {
+		if m, ok := out[key].(map[string]interface{}); ok {
+			nested.merge(m)
+		}
+	}
+
+	for key, items := range u.items {
+		// elements can only be matched up when none were added or removed
+		list, ok := out[key].([]interface{})
+		if !ok || len(list) != len(items) {
+			continue
+		}
+		for i, item := range list {
+			if m, ok := item.(map[string]interface{}); ok {
+				items[i].merge(m)
+			}
+		}
+	}
+}
+
+// jsonField finds the field of struct t that encoding/json decodes key into.
+func jsonField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			// unexported
+			continue
+		}
+
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if strings.EqualFold(name, key) {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func indirectType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+// isModel reports whether t is a struct whose unknown fields are tracked.
+// Types with their own json decoding keep what they need themselves.
+func isModel(t reflect.Type) bool {
+	return t.Kind() == reflect.Struct && !reflect.PtrTo(t).Implements(unmarshalerType)
+}
@@ -2,10 +2,11 @@ package marathon
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
+	"reflect"
+	"strings"
+
 	"github.com/CiscoCloud/mantl-api/utils/http"
-	log "github.com/Sirupsen/logrus"
 )
 
 type Marathon struct {
@@ -34,9 +35,28 @@ type Docker struct {
 }
 
 type Volume struct {
-	ContainerPath string `json:"containerPath,omitempty"`
-	HostPath      string `json:"hostPath,omitempty"`
-	Mode          string `json:"mode,omitempty"`
+	ContainerPath string            `json:"containerPath,omitempty"`
+	HostPath      string            `json:"hostPath,omitempty"`
+	Mode          string            `json:"mode,omitempty"`
+	External      *ExternalVolume   `json:"external,omitempty"`
+	Persistent    *PersistentVolume `json:"persistent,omitempty"`
+}
+
+// ExternalVolume is a volume provided by a Docker volume driver, like
+// rexray.
+type ExternalVolume struct {
+	Name     string            `json:"name,omitempty"`
+	Provider string            `json:"provider,omitempty"`
+	Options  map[string]string `json:"options,omitempty"`
+	Size     int               `json:"size,omitempty"`
+}
+
+// PersistentVolume is a local persistent volume of a stateful app.
+type PersistentVolume struct {
+	Type        string     `json:"type,omitempty"`
+	Size        int        `json:"size,omitempty"`
+	MaxSize     int        `json:"maxSize,omitempty"`
+	Constraints [][]string `json:"constraints,omitempty"`
 }
 
 type Container struct {
@@ -60,41 +80,244 @@ type HealthCheckCommand struct {
 	Value string `json:"value,omitempty"`
 }
 
+type ReadinessCheck struct {
+	Name                    string `json:"name,omitempty"`
+	Protocol                string `json:"protocol,omitempty"`
+	Path                    string `json:"path,omitempty"`
+	PortName                string `json:"portName,omitempty"`
+	IntervalSeconds         int    `json:"intervalSeconds,omitempty"`
+	TimeoutSeconds          int    `json:"timeoutSeconds,omitempty"`
+	HTTPStatusCodesForReady []int  `json:"httpStatusCodesForReady,omitempty"`
+	PreserveLastResponse    bool   `json:"preserveLastResponse,omitempty"`
+}
+
+// PortDefinition is a host port of an app. Port 0 asks for a random port.
+type PortDefinition struct {
+	Port     int               `json:"port"`
+	Protocol string            `json:"protocol,omitempty"`
+	Name     string            `json:"name,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+}
+
+// IPAddress requests an IP address per task from a network.
+type IPAddress struct {
+	Groups      []string          `json:"groups,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	NetworkName string            `json:"networkName,omitempty"`
+	Discovery   *Discovery        `json:"discovery,omitempty"`
+}
+
+type Discovery struct {
+	Ports []DiscoveryPort `json:"ports,omitempty"`
+}
+
+type DiscoveryPort struct {
+	Number   int    `json:"number,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Protocol string `json:"protocol,omitempty"`
+}
+
+// Residency keeps the tasks of an app with persistent volumes on their
+// agents.
+type Residency struct {
+	RelaunchEscalationTimeoutSeconds int    `json:"relaunchEscalationTimeoutSeconds,omitempty"`
+	TaskLostBehavior                 string `json:"taskLostBehavior,omitempty"`
+}
+
+// Fetch is an artifact that the Mesos fetcher downloads into the sandbox.
+type Fetch struct {
+	URI        string `json:"uri"`
+	Executable bool   `json:"executable,omitempty"`
+	Extract    bool   `json:"extract,omitempty"`
+	Cache      bool   `json:"cache,omitempty"`
+	OutputFile string `json:"outputFile,omitempty"`
+}
+
 type UpgradeStrategy struct {
 	MinimumHealthCapacity float64 `json:"minimumHealthCapacity,omitempty"`
 	MaximumOverCapacity   float64 `json:"maximumOverCapacity,omitempty"`
 }
 
+// App is a Marathon app. Fields that aren't modeled are kept as they are
+// when an app is unmarshalled and marshalled again, including unknown
+// fields of the modeled objects, like the container.
 type App struct {
-	Args            []string          `json:"args,omitempty"`
-	BackoffFactor   float64           `json:"backoffFactor,omitempty"`
-	BackoffSeconds  int               `json:"backoffSeconds,omitempty"`
-	Cmd             string            `json:"cmd,omitempty"`
-	Constraints     [][]string        `json:"constraints,omitempty"`
-	Container       *Container        `json:"container,omitempty"`
-	CPUs            float64           `json:"cpus,omitempty"`
-	Dependencies    []string          `json:"dependencies,omitempty"`
-	Disk            float64           `json:"disk,omitempty"`
-	Env             map[string]string `json:"env,omitempty"`
-	Executor        string            `json:"executor,omitempty"`
-	Labels          map[string]string `json:"labels,omitempty"`
-	HealthChecks    []HealthCheck     `json:"healthChecks,omitempty"`
-	ID              string            `json:"id,omitempty"`
-	Instances       int               `json:"instances,omitempty"`
-	Mem             float64           `json:"mem,omitempty"`
-	Ports           []int             `json:"ports,omitempty"`
-	RequirePorts    bool              `json:"requirePorts,omitempty"`
-	StoreUrls       []string          `json:"storeUrls,omitempty"`
-	UpgradeStrategy UpgradeStrategy   `json:"upgradeStrategy,omitempty"`
-	Uris            []string          `json:"uris,omitempty"`
-	User            string            `json:"user,omitempty"`
-	Version         string            `json:"version,omitempty"`
+	Args                       []string          `json:"args,omitempty"`
+	BackoffFactor              float64           `json:"backoffFactor,omitempty"`
+	BackoffSeconds             int               `json:"backoffSeconds,omitempty"`
+	Cmd                        string            `json:"cmd,omitempty"`
+	Constraints                [][]string        `json:"constraints,omitempty"`
+	Container                  *Container        `json:"container,omitempty"`
+	CPUs                       float64           `json:"cpus,omitempty"`
+	Dependencies               []string          `json:"dependencies,omitempty"`
+	Disk                       float64           `json:"disk,omitempty"`
+	Env                        map[string]EnvVar `json:"env,omitempty"`
+	Executor                   string            `json:"executor,omitempty"`
+	Fetch                      []Fetch           `json:"fetch,omitempty"`
+	Labels                     map[string]string `json:"labels,omitempty"`
+	HealthChecks               []HealthCheck     `json:"healthChecks,omitempty"`
+	ID                         string            `json:"id,omitempty"`
+	Instances                  int               `json:"instances,omitempty"`
+	IPAddress                  *IPAddress        `json:"ipAddress,omitempty"`
+	Mem                        float64           `json:"mem,omitempty"`
+	PortDefinitions            []PortDefinition  `json:"portDefinitions,omitempty"`
+	Ports                      []int             `json:"ports,omitempty"`
+	ReadinessChecks            []ReadinessCheck  `json:"readinessChecks,omitempty"`
+	RequirePorts               bool              `json:"requirePorts,omitempty"`
+	Residency                  *Residency        `json:"residency,omitempty"`
+	Secrets                    map[string]Secret `json:"secrets,omitempty"`
+	StoreUrls                  []string          `json:"storeUrls,omitempty"`
+	TaskKillGracePeriodSeconds int               `json:"taskKillGracePeriodSeconds,omitempty"`
+	UpgradeStrategy            UpgradeStrategy   `json:"upgradeStrategy,omitempty"`
+	Uris                       []string          `json:"uris,omitempty"`
+	User                       string            `json:"user,omitempty"`
+	Version                    string            `json:"version,omitempty"`
+
+	unknown *unknownFields
+}
+
+// appFields has the fields of App without its json methods
+type appFields App
+
+func (a App) MarshalJSON() ([]byte, error) {
+	return marshalWithUnknownFields(appFields(a), a.unknown)
+}
+
+func (a *App) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, (*appFields)(a)); err != nil {
+		return err
+	}
+
+	unknown, err := collectUnknownFields(reflect.TypeOf(appFields{}), data)
+	if err != nil {
+		return err
+	}
+	a.unknown = unknown
+	return nil
+}
+
+// EnvVar is the value of an environment variable, or a reference to one of
+// the app's secrets.
+type EnvVar struct {
+	Value  string
+	Secret string
+}
+
+func (e EnvVar) MarshalJSON() ([]byte, error) {
+	if e.Secret != "" {
+		return json.Marshal(map[string]string{"secret": e.Secret})
+	}
+	return json.Marshal(e.Value)
+}
+
+func (e *EnvVar) UnmarshalJSON(data []byte) error {
+	ref := struct {
+		Secret string `json:"secret"`
+	}{}
+	if err := json.Unmarshal(data, &ref); err == nil {
+		e.Secret = ref.Secret
+		return nil
+	}
+	return json.Unmarshal(data, &e.Value)
+}
+
+type Secret struct {
+	Source string `json:"source"`
+}
+
+// Group is a Marathon group of apps and nested groups. The ids of its apps
+// and groups may be relative to the group. Like apps, groups keep the fields
+// that aren't modeled.
+type Group struct {
+	ID           string   `json:"id,omitempty"`
+	Apps         []*App   `json:"apps,omitempty"`
+	Groups       []*Group `json:"groups,omitempty"`
+	Dependencies []string `json:"dependencies,omitempty"`
+	Version      string   `json:"version,omitempty"`
+
+	unknown *unknownFields
+}
+
+type groupFields Group
+
+func (g Group) MarshalJSON() ([]byte, error) {
+	return marshalWithUnknownFields(groupFields(g), g.unknown)
+}
+
+func (g *Group) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, (*groupFields)(g)); err != nil {
+		return err
+	}
+
+	unknown, err := collectUnknownFields(reflect.TypeOf(groupFields{}), data)
+	if err != nil {
+		return err
+	}
+	g.unknown = unknown
+	return nil
+}
+
+// AllApps returns the apps of the group and of its nested groups.
+func (g *Group) AllApps() []*App {
+	apps := append([]*App{}, g.Apps...)
+	for _, group := range g.Groups {
+		apps = append(apps, group.AllApps()...)
+	}
+	return apps
+}
+
+// Pod is a Marathon pod. Only its id and labels are typed, every other field
+// of the pod definition is kept in Spec as it is.
+type Pod struct {
+	ID     string
+	Labels map[string]string
+	Spec   map[string]interface{}
+}
+
+func (p Pod) MarshalJSON() ([]byte, error) {
+	pod := make(map[string]interface{})
+	for k, v := range p.Spec {
+		pod[k] = v
+	}
+	pod["id"] = p.ID
+	if len(p.Labels) > 0 {
+		pod["labels"] = p.Labels
+	}
+	return json.Marshal(pod)
+}
+
+func (p *Pod) UnmarshalJSON(data []byte) error {
+	fields := struct {
+		ID     string            `json:"id"`
+		Labels map[string]string `json:"labels"`
+	}{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	spec := make(map[string]interface{})
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return err
+	}
+	delete(spec, "id")
+	delete(spec, "labels")
+
+	p.ID = fields.ID
+	p.Labels = fields.Labels
+	p.Spec = spec
+	return nil
 }
 
 type AppResponse struct {
 	Apps []*App `json:"apps"`
 }
 
+// DeploymentResult identifies the deployment that a change started.
+type DeploymentResult struct {
+	DeploymentID string `json:"deploymentId"`
+	Version      string `json:"version"`
+}
+
 func NewMarathon(url string, username string, password string, noVerifySsl bool) (*Marathon, error) {
 	httpClient, err := http.NewHttpClient(url, username, password, noVerifySsl)
 
@@ -114,50 +337,270 @@ func (m Marathon) ToApp(appJson string) (*App, error) {
 }
 
 func (m Marathon) Apps() ([]*App, error) {
-	httpReq, err := m.httpClient.Get("/v2/apps/")
-
-	if err != nil || (httpReq.Response.StatusCode != 200) {
+	apps := &AppResponse{}
+	if err := m.get("/v2/apps/", "Failed retrieving apps from marathon", apps); err != nil {
 		return nil, err
 	}
+	return apps.Apps, nil
+}
 
-	body := httpReq.ResponseBody
-	apps := &AppResponse{}
-	err = json.Unmarshal(body, apps)
-	return apps.Apps, err
+func (m Marathon) App(appId string) (*App, error) {
+	response := struct {
+		App *App `json:"app"`
+	}{}
+	if err := m.get("/v2/apps"+absoluteID(appId), fmt.Sprintf("Failed retrieving %s from marathon", appId), &response); err != nil {
+		return nil, err
+	}
+	return response.App, nil
 }
 
 func (m Marathon) CreateApp(app *App) (string, error) {
-	jsonBlob, err := json.Marshal(app)
+	httpReq, err := m.send("POST", "/v2/apps/", app)
 	if err != nil {
 		return "", err
 	}
 
-	log.Debugf("app json: %s", string(jsonBlob))
+	if err := checkResponse(httpReq, fmt.Sprintf("Failed creating %s in marathon", app.ID), 200, 201); err != nil {
+		return "", err
+	}
 
-	httpReq, err := m.httpClient.Post("/v2/apps/", jsonBlob)
+	return httpReq.ResponseText, nil
+}
 
+func (m Marathon) DestroyApp(appId string) (string, error) {
+	httpReq, err := m.httpClient.Delete("/v2/apps" + absoluteID(appId))
 	if err != nil {
 		return "", err
 	}
 
-	switch httpReq.Response.StatusCode {
-	case 409:
-		return "", errors.New("409 Conflict - application already exists")
-	default:
-		return httpReq.ResponseText, nil
+	responseText := httpReq.ResponseText
+	if err := checkResponse(httpReq, fmt.Sprintf("Failed deleting %s from marathon", appId), 200); err != nil {
+		return responseText, err
 	}
+
+	return responseText, nil
 }
 
-func (m Marathon) DestroyApp(appId string) (string, error) {
-	httpReq, err := m.httpClient.Delete("/v2/apps" + appId)
+func (m Marathon) UpdateApp(app *App) (string, error) {
+	httpReq, err := m.send("PUT", "/v2/apps"+absoluteID(app.ID), app)
 	if err != nil {
 		return "", err
 	}
 
 	responseText := httpReq.ResponseText
-	if httpReq.Response.StatusCode != 200 {
-		return responseText, errors.New(fmt.Sprintf("Failed deleting %s from marathon: %s", appId, responseText))
+	if err := checkResponse(httpReq, fmt.Sprintf("Failed updating %s in marathon", app.ID), 200, 201); err != nil {
+		return responseText, err
 	}
 
 	return responseText, nil
 }
+
+// ScaleApp changes the number of instances of an app. Force overrides a
+// deployment of the app that is in progress.
+func (m Marathon) ScaleApp(appId string, instances int, force bool) (*DeploymentResult, error) {
+	scale := map[string]int{"instances": instances}
+	return m.deploy("PUT", "/v2/apps"+absoluteID(appId)+forceQuery(force), scale, fmt.Sprintf("Failed scaling %s in marathon", appId))
+}
+
+// RestartApp replaces every task of an app according to its upgrade
+// strategy.
+func (m Marathon) RestartApp(appId string, force bool) (*DeploymentResult, error) {
+	return m.deploy("POST", "/v2/apps"+absoluteID(appId)+"/restart"+forceQuery(force), nil, fmt.Sprintf("Failed restarting %s in marathon", appId))
+}
+
+// AppVersions lists the versions of an app, most recent first.
+func (m Marathon) AppVersions(appId string) ([]string, error) {
+	response := struct {
+		Versions []string `json:"versions"`
+	}{}
+	if err := m.get("/v2/apps"+absoluteID(appId)+"/versions", fmt.Sprintf("Failed retrieving versions of %s from marathon", appId), &response); err != nil {
+		return nil, err
+	}
+	return response.Versions, nil
+}
+
+// AppVersion returns the definition of an app at one of its versions.
+func (m Marathon) AppVersion(appId string, version string) (*App, error) {
+	app := &App{}
+	if err := m.get("/v2/apps"+absoluteID(appId)+"/versions/"+version, fmt.Sprintf("Failed retrieving version %s of %s from marathon", version, appId), app); err != nil {
+		return nil, err
+	}
+	return app, nil
+}
+
+func (m Marathon) ToGroup(groupJson string) (*Group, error) {
+	group := &Group{}
+	err := json.Unmarshal([]byte(groupJson), group)
+	return group, err
+}
+
+func (m Marathon) ToPod(podJson string) (*Pod, error) {
+	pod := &Pod{}
+	err := json.Unmarshal([]byte(podJson), pod)
+	return pod, err
+}
+
+func (m Marathon) CreateGroup(group *Group) (string, error) {
+	httpReq, err := m.send("POST", "/v2/groups", group)
+	if err != nil {
+		return "", err
+	}
+
+	if err := checkResponse(httpReq, fmt.Sprintf("Failed creating %s in marathon", group.ID), 200, 201); err != nil {
+		return "", err
+	}
+
+	return httpReq.ResponseText, nil
+}
+
+func (m Marathon) UpdateGroup(group *Group) (string, error) {
+	httpReq, err := m.send("PUT", "/v2/groups"+absoluteID(group.ID), group)
+	if err != nil {
+		return "", err
+	}
+
+	responseText := httpReq.ResponseText
+	if err := checkResponse(httpReq, fmt.Sprintf("Failed updating %s in marathon", group.ID), 200, 201); err != nil {
+		return responseText, err
+	}
+
+	return responseText, nil
+}
+
+func (m Marathon) DestroyGroup(groupId string) (string, error) {
+	httpReq, err := m.httpClient.Delete("/v2/groups" + absoluteID(groupId))
+	if err != nil {
+		return "", err
+	}
+
+	responseText := httpReq.ResponseText
+	if err := checkResponse(httpReq, fmt.Sprintf("Failed deleting %s from marathon", groupId), 200); err != nil {
+		return responseText, err
+	}
+
+	return responseText, nil
+}
+
+// Pods returns every pod, or none when Marathon doesn't support pods.
+func (m Marathon) Pods() ([]*Pod, error) {
+	pods := []*Pod{}
+	err := m.get("/v2/pods", "Failed retrieving pods from marathon", &pods)
+	if IsNotFound(err) {
+		// marathon before 1.4
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pods, nil
+}
+
+func (m Marathon) CreatePod(pod *Pod) (string, error) {
+	httpReq, err := m.send("POST", "/v2/pods", pod)
+	if err != nil {
+		return "", err
+	}
+
+	if err := checkResponse(httpReq, fmt.Sprintf("Failed creating %s in marathon", pod.ID), 200, 201); err != nil {
+		return "", err
+	}
+
+	return httpReq.ResponseText, nil
+}
+
+func (m Marathon) UpdatePod(pod *Pod) (string, error) {
+	httpReq, err := m.send("PUT", "/v2/pods"+absoluteID(pod.ID), pod)
+	if err != nil {
+		return "", err
+	}
+
+	responseText := httpReq.ResponseText
+	if err := checkResponse(httpReq, fmt.Sprintf("Failed updating %s in marathon", pod.ID), 200, 201); err != nil {
+		return responseText, err
+	}
+
+	return responseText, nil
+}
+
+func (m Marathon) DestroyPod(podId string) (string, error) {
+	httpReq, err := m.httpClient.Delete("/v2/pods" + absoluteID(podId))
+	if err != nil {
+		return "", err
+	}
+
+	responseText := httpReq.ResponseText
+	if err := checkResponse(httpReq, fmt.Sprintf("Failed deleting %s from marathon", podId), 200, 202); err != nil {
+		return responseText, err
+	}
+
+	return responseText, nil
+}
+
+// get decodes the response to a GET request into v.
+func (m Marathon) get(path string, operation string, v interface{}) error {
+	httpReq, err := m.httpClient.Get(path)
+	if err != nil {
+		return err
+	}
+
+	if err := checkResponse(httpReq, operation, 200); err != nil {
+		return err
+	}
+
+	return json.Unmarshal(httpReq.ResponseBody, v)
+}
+
+// deploy sends a request that starts a deployment.
+func (m Marathon) deploy(method string, path string, v interface{}, operation string) (*DeploymentResult, error) {
+	httpReq, err := m.send(method, path, v)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkResponse(httpReq, operation, 200, 201, 202); err != nil {
+		return nil, err
+	}
+
+	result := &DeploymentResult{}
+	if len(httpReq.ResponseBody) > 0 {
+		if err := json.Unmarshal(httpReq.ResponseBody, result); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// send sends v as json, or no body when v is nil. The body isn't logged
+// because it can hold resolved secrets; callers log a redacted copy.
+func (m Marathon) send(method string, path string, v interface{}) (*http.HttpRequest, error) {
+	var jsonBlob []byte
+	if v != nil {
+		var err error
+		jsonBlob, err = json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch method {
+	case "PUT":
+		return m.httpClient.Put(path, jsonBlob)
+	case "DELETE":
+		return m.httpClient.Delete(path)
+	}
+	return m.httpClient.Post(path, jsonBlob)
+}
+
+func forceQuery(force bool) string {
+	if force {
+		return "?force=true"
+	}
+	return ""
+}
+
+func absoluteID(id string) string {
+	if strings.HasPrefix(id, "/") {
+		return id
+	}
+	return "/" + id
+}
@@ -1,8 +1,10 @@
 package marathon
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -177,6 +179,22 @@ func TestToApp(t *testing.T) {
 	assert.Equal(t, "/example", app.ID)
 }
 
+func TestEnvSecrets(t *testing.T) {
+	t.Parallel()
+	ts, marathon := fakeMarathon(successHandler)
+	defer ts.Close()
+
+	app, err := marathon.ToApp(`{"env": {"USER": "kafka", "PASSWORD": {"secret": "password"}}, "secrets": {"password": {"source": "secret/kafka#password"}}}`)
+	assert.Nil(t, err)
+	assert.Equal(t, EnvVar{Value: "kafka"}, app.Env["USER"])
+	assert.Equal(t, EnvVar{Secret: "password"}, app.Env["PASSWORD"])
+	assert.Equal(t, "secret/kafka#password", app.Secrets["password"].Source)
+
+	blob, err := json.Marshal(app.Env)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"PASSWORD":{"secret":"password"},"USER":"kafka"}`, string(blob))
+}
+
 func TestApps(t *testing.T) {
 	t.Parallel()
 	ts, marathon := fakeMarathon(appsResponseHandler)
@@ -222,7 +240,10 @@ func TestCreateAppConflict(t *testing.T) {
 	_, err := marathon.CreateApp(app)
 
 	assert.NotNil(t, err)
-	assert.Equal(t, "409 Conflict - application already exists", err.Error())
+	merr, ok := err.(*Error)
+	assert.True(t, ok)
+	assert.Equal(t, 409, merr.StatusCode)
+	assert.Equal(t, "Failed creating /example in marathon: 409 Conflict", err.Error())
 }
 
 func TestDestroyApp(t *testing.T) {
@@ -249,6 +270,39 @@ func TestDestroyAppError(t *testing.T) {
 	assert.True(t, len(response) > 0)
 }
 
+func TestUpdateApp(t *testing.T) {
+	t.Parallel()
+	var method, path string
+	ts, marathon := fakeMarathon(func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		path = r.URL.Path
+		fmt.Fprint(w, `{"version":"2015-10-07T12:56:01.940Z","deploymentId":"5ed4c0c5-9ff8-4a6f-a0cd-f57f59a34b43"}`)
+	})
+	defer ts.Close()
+
+	app, _ := marathon.ToApp(marathonAppJson)
+	response, err := marathon.UpdateApp(app)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "PUT", method)
+	assert.Equal(t, "/v2/apps/example", path)
+	assert.Contains(t, response, "deploymentId")
+}
+
+func TestUpdateAppError(t *testing.T) {
+	t.Parallel()
+	ts, marathon := fakeMarathon(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+	})
+	defer ts.Close()
+
+	app, _ := marathon.ToApp(marathonAppJson)
+	_, err := marathon.UpdateApp(app)
+
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "Failed updating /example in marathon")
+}
+
 func fakeMarathon(handler func(w http.ResponseWriter, r *http.Request)) (*httptest.Server, *Marathon) {
 	ts := httptest.NewServer(http.HandlerFunc(handler))
 	marathon, _ := NewMarathon(ts.URL, "", "", false)
@@ -265,3 +319,270 @@ func appResponseHandler(w http.ResponseWriter, r *http.Request) {
 func appsResponseHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, marathonAppsJson)
 }
+
+func TestPodRoundTrip(t *testing.T) {
+	t.Parallel()
+	ts, marathon := fakeMarathon(emptyJsonHandler)
+	defer ts.Close()
+
+	pod, err := marathon.ToPod(`{"id": "/web", "labels": {"owner": "mantl"}, "containers": [{"name": "nginx", "resources": {"cpus": 0.5, "mem": 64}}], "scaling": {"kind": "fixed", "instances": 2}}`)
+	assert.Nil(t, err)
+	assert.Equal(t, "/web", pod.ID)
+	assert.Equal(t, map[string]string{"owner": "mantl"}, pod.Labels)
+	assert.NotContains(t, pod.Spec, "id")
+
+	pod.Labels["MANTL_PACKAGE_NAME"] = "web"
+	blob, err := json.Marshal(pod)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"id": "/web", "labels": {"owner": "mantl", "MANTL_PACKAGE_NAME": "web"}, "containers": [{"name": "nginx", "resources": {"cpus": 0.5, "mem": 64}}], "scaling": {"kind": "fixed", "instances": 2}}`, string(blob))
+}
+
+func TestGroupAllApps(t *testing.T) {
+	t.Parallel()
+	ts, marathon := fakeMarathon(emptyJsonHandler)
+	defer ts.Close()
+
+	group, err := marathon.ToGroup(`{"id": "/stack", "apps": [{"id": "api"}], "groups": [{"id": "db", "apps": [{"id": "primary"}, {"id": "replica"}]}]}`)
+	assert.Nil(t, err)
+
+	ids := []string{}
+	for _, app := range group.AllApps() {
+		ids = append(ids, app.ID)
+	}
+	assert.Equal(t, []string{"api", "primary", "replica"}, ids)
+}
+
+func TestGroupRequests(t *testing.T) {
+	t.Parallel()
+	var requests []string
+	ts, marathon := fakeMarathon(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		fmt.Fprint(w, `{"version":"2015-10-07T12:56:01.940Z","deploymentId":"5ed4c0c5-9ff8-4a6f-a0cd-f57f59a34b43"}`)
+	})
+	defer ts.Close()
+
+	group := &Group{ID: "stack", Apps: []*App{{ID: "api"}}}
+	_, err := marathon.CreateGroup(group)
+	assert.Nil(t, err)
+	_, err = marathon.UpdateGroup(group)
+	assert.Nil(t, err)
+	_, err = marathon.DestroyGroup("/stack")
+	assert.Nil(t, err)
+
+	pod := &Pod{ID: "/web"}
+	_, err = marathon.CreatePod(pod)
+	assert.Nil(t, err)
+	_, err = marathon.UpdatePod(pod)
+	assert.Nil(t, err)
+	_, err = marathon.DestroyPod("/web")
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{
+		"POST /v2/groups", "PUT /v2/groups/stack", "DELETE /v2/groups/stack",
+		"POST /v2/pods", "PUT /v2/pods/web", "DELETE /v2/pods/web",
+	}, requests)
+}
+
+func TestPodsNotSupported(t *testing.T) {
+	t.Parallel()
+	ts, marathon := fakeMarathon(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(404)
+	})
+	defer ts.Close()
+
+	pods, err := marathon.Pods()
+	assert.Nil(t, err)
+	assert.Empty(t, pods)
+}
+
+func TestAppUnknownFields(t *testing.T) {
+	t.Parallel()
+	ts, marathon := fakeMarathon(emptyJsonHandler)
+	defer ts.Close()
+
+	app, err := marathon.ToApp(`{
+		"id": "/kafka",
+		"cpus": 1,
+		"killSelection": "OLDEST_FIRST",
+		"unreachableStrategy": {"inactiveAfterSeconds": 300, "expungeAfterSeconds": 600},
+		"container": {
+			"type": "DOCKER",
+			"docker": {"image": "kafka:0.9", "pullConfig": {"secret": "registry"}},
+			"volumes": [{"containerPath": "data", "mode": "RW", "external": {"name": "kafka-data", "provider": "dvdi", "options": {"dvdi/driver": "rexray"}}}]
+		},
+		"healthChecks": [{"protocol": "MESOS_HTTP", "path": "/health", "delaySeconds": 15}],
+		"portDefinitions": [{"port": 0, "name": "broker"}],
+		"readinessChecks": [{"name": "ready", "path": "/ready", "portName": "broker", "httpStatusCodesForReady": [200]}],
+		"ipAddress": {"networkName": "dcos"},
+		"residency": {"taskLostBehavior": "WAIT_FOREVER"},
+		"fetch": [{"uri": "https://example.com/kafka.tgz", "extract": true}],
+		"taskKillGracePeriodSeconds": 30
+	}`)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	assert.Equal(t, "kafka-data", app.Container.Volumes[0].External.Name)
+	assert.Equal(t, "broker", app.PortDefinitions[0].Name)
+	assert.Equal(t, []int{200}, app.ReadinessChecks[0].HTTPStatusCodesForReady)
+	assert.Equal(t, "dcos", app.IPAddress.NetworkName)
+	assert.Equal(t, "WAIT_FOREVER", app.Residency.TaskLostBehavior)
+	assert.True(t, app.Fetch[0].Extract)
+	assert.Equal(t, 30, app.TaskKillGracePeriodSeconds)
+
+	// typed changes win over the original values
+	app.Container.Docker.Image = "registry.example.com/kafka:0.9"
+	app.Labels = map[string]string{"MANTL_PACKAGE_NAME": "kafka"}
+
+	blob, err := json.Marshal(app)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{
+		"id": "/kafka",
+		"cpus": 1,
+		"labels": {"MANTL_PACKAGE_NAME": "kafka"},
+		"killSelection": "OLDEST_FIRST",
+		"unreachableStrategy": {"inactiveAfterSeconds": 300, "expungeAfterSeconds": 600},
+		"container": {
+			"type": "DOCKER",
+			"docker": {"image": "registry.example.com/kafka:0.9", "pullConfig": {"secret": "registry"}},
+			"volumes": [{"containerPath": "data", "mode": "RW", "external": {"name": "kafka-data", "provider": "dvdi", "options": {"dvdi/driver": "rexray"}}}]
+		},
+		"healthChecks": [{"protocol": "MESOS_HTTP", "path": "/health", "delaySeconds": 15}],
+		"portDefinitions": [{"port": 0, "name": "broker"}],
+		"readinessChecks": [{"name": "ready", "path": "/ready", "portName": "broker", "httpStatusCodesForReady": [200]}],
+		"ipAddress": {"networkName": "dcos"},
+		"residency": {"taskLostBehavior": "WAIT_FOREVER"},
+		"fetch": [{"uri": "https://example.com/kafka.tgz", "extract": true}],
+		"taskKillGracePeriodSeconds": 30,
+		"upgradeStrategy": {}
+	}`, string(blob))
+
+	// unknown fields of removed objects are dropped
+	app.Container = nil
+	app.HealthChecks = append(app.HealthChecks, HealthCheck{Protocol: "TCP"})
+	blob, err = json.Marshal(app)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(blob), "pullConfig")
+	assert.NotContains(t, string(blob), "delaySeconds")
+	assert.Contains(t, string(blob), "killSelection")
+}
+
+func TestGroupUnknownFields(t *testing.T) {
+	t.Parallel()
+	ts, marathon := fakeMarathon(emptyJsonHandler)
+	defer ts.Close()
+
+	group, err := marathon.ToGroup(`{"id": "/stack", "enforceRole": true, "apps": [{"id": "api", "killSelection": "OLDEST_FIRST"}]}`)
+	assert.Nil(t, err)
+
+	blob, err := json.Marshal(group)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"id": "/stack", "enforceRole": true, "apps": [{"id": "api", "killSelection": "OLDEST_FIRST", "upgradeStrategy": {}}]}`, string(blob))
+}
+
+func TestApp(t *testing.T) {
+	t.Parallel()
+	ts, marathon := fakeMarathon(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v2/apps/example", r.URL.Path)
+		fmt.Fprintf(w, `{"app": %s}`, marathonAppJson)
+	})
+	defer ts.Close()
+
+	app, err := marathon.App("example")
+	assert.Nil(t, err)
+	assert.Equal(t, "/example", app.ID)
+}
+
+func TestAppNotFound(t *testing.T) {
+	t.Parallel()
+	ts, marathon := fakeMarathon(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(404)
+		fmt.Fprint(w, `{"message": "App '/missing' does not exist"}`)
+	})
+	defer ts.Close()
+
+	app, err := marathon.App("/missing")
+	assert.Nil(t, app)
+	assert.True(t, IsNotFound(err))
+	assert.Equal(t, "Failed retrieving /missing from marathon: 404 App '/missing' does not exist", err.Error())
+}
+
+func TestAppsError(t *testing.T) {
+	t.Parallel()
+	ts, marathon := fakeMarathon(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(503)
+		fmt.Fprint(w, "Marathon is leaderless")
+	})
+	defer ts.Close()
+
+	apps, err := marathon.Apps()
+	assert.Nil(t, apps)
+	merr, ok := err.(*Error)
+	assert.True(t, ok)
+	assert.Equal(t, 503, merr.StatusCode)
+	assert.Equal(t, "Marathon is leaderless", merr.Message)
+}
+
+func TestUpdateAppValidationError(t *testing.T) {
+	t.Parallel()
+	ts, marathon := fakeMarathon(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(422)
+		fmt.Fprint(w, `{"message": "Object is not valid", "details": [{"path": "/instances", "errors": ["must be positive"]}]}`)
+	})
+	defer ts.Close()
+
+	app, _ := marathon.ToApp(marathonAppJson)
+	_, err := marathon.UpdateApp(app)
+
+	merr, ok := err.(*Error)
+	assert.True(t, ok)
+	assert.Equal(t, []ErrorDetail{{Path: "/instances", Errors: []string{"must be positive"}}}, merr.Details)
+	assert.Equal(t, "Failed updating /example in marathon: 422 Object is not valid; /instances: must be positive", err.Error())
+}
+
+func TestScaleAndRestartApp(t *testing.T) {
+	t.Parallel()
+	var requests []string
+	ts, marathon := fakeMarathon(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests = append(requests, r.Method+" "+r.URL.RequestURI()+" "+string(body))
+		fmt.Fprint(w, `{"version":"2015-10-07T12:56:01.940Z","deploymentId":"5ed4c0c5-9ff8-4a6f-a0cd-f57f59a34b43"}`)
+	})
+	defer ts.Close()
+
+	result, err := marathon.ScaleApp("example", 3, false)
+	assert.Nil(t, err)
+	assert.Equal(t, "5ed4c0c5-9ff8-4a6f-a0cd-f57f59a34b43", result.DeploymentID)
+	assert.Equal(t, "2015-10-07T12:56:01.940Z", result.Version)
+
+	_, err = marathon.RestartApp("/example", true)
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{
+		`PUT /v2/apps/example {"instances":3}`,
+		"POST /v2/apps/example/restart?force=true ",
+	}, requests)
+}
+
+func TestAppVersions(t *testing.T) {
+	t.Parallel()
+	ts, marathon := fakeMarathon(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/apps/example/versions":
+			fmt.Fprint(w, `{"versions": ["2016-03-02T10:00:00.000Z", "2016-03-01T10:00:00.000Z"]}`)
+		case "/v2/apps/example/versions/2016-03-01T10:00:00.000Z":
+			fmt.Fprint(w, marathonAppJson)
+		default:
+			w.WriteHeader(404)
+		}
+	})
+	defer ts.Close()
+
+	versions, err := marathon.AppVersions("/example")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"2016-03-02T10:00:00.000Z", "2016-03-01T10:00:00.000Z"}, versions)
+
+	app, err := marathon.AppVersion("/example", versions[1])
+	assert.Nil(t, err)
+	assert.Equal(t, "/example", app.ID)
+}
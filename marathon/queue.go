@@ -0,0 +1,24 @@
+package marathon
+
+// QueueItem is an app with tasks that are waiting to be launched.
+type QueueItem struct {
+	App   *App       `json:"app"`
+	Count int        `json:"count"`
+	Delay QueueDelay `json:"delay"`
+	Since string     `json:"since,omitempty"`
+}
+
+type QueueDelay struct {
+	TimeLeftSeconds int  `json:"timeLeftSeconds"`
+	Overdue         bool `json:"overdue"`
+}
+
+func (m Marathon) Queue() ([]*QueueItem, error) {
+	queue := struct {
+		Queue []*QueueItem `json:"queue"`
+	}{}
+	if err := m.get("/v2/queue", "Failed retrieving the queue from marathon", &queue); err != nil {
+		return nil, err
+	}
+	return queue.Queue, nil
+}
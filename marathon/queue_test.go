@@ -0,0 +1,25 @@
+package marathon
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueue(t *testing.T) {
+	t.Parallel()
+	ts, marathon := fakeMarathon(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v2/queue", r.URL.Path)
+		fmt.Fprintf(w, `{"queue": [{"count": 2, "delay": {"timeLeftSeconds": 30, "overdue": false}, "since": "2016-03-01T10:00:00.000Z", "app": %s}]}`, marathonAppJson)
+	})
+	defer ts.Close()
+
+	queue, err := marathon.Queue()
+	assert.Nil(t, err)
+	assert.Len(t, queue, 1)
+	assert.Equal(t, 2, queue[0].Count)
+	assert.Equal(t, 30, queue[0].Delay.TimeLeftSeconds)
+	assert.Equal(t, "/example", queue[0].App.ID)
+}
@@ -0,0 +1,77 @@
+package marathon
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+type Task struct {
+	ID                 string               `json:"id"`
+	AppID              string               `json:"appId"`
+	Host               string               `json:"host"`
+	Ports              []int                `json:"ports"`
+	SlaveID            string               `json:"slaveId"`
+	State              string               `json:"state,omitempty"`
+	StagedAt           string               `json:"stagedAt"`
+	StartedAt          string               `json:"startedAt"`
+	Version            string               `json:"version"`
+	HealthCheckResults []*HealthCheckResult `json:"healthCheckResults,omitempty"`
+}
+
+type HealthCheckResult struct {
+	Alive               bool   `json:"alive"`
+	ConsecutiveFailures int    `json:"consecutiveFailures"`
+	FirstSuccess        string `json:"firstSuccess"`
+	LastFailure         string `json:"lastFailure"`
+	LastSuccess         string `json:"lastSuccess"`
+	TaskID              string `json:"taskId"`
+}
+
+type tasksResponse struct {
+	Tasks []*Task `json:"tasks"`
+}
+
+func (m Marathon) Tasks() ([]*Task, error) {
+	tasks := &tasksResponse{}
+	if err := m.get("/v2/tasks", "Failed retrieving tasks from marathon", tasks); err != nil {
+		return nil, err
+	}
+	return tasks.Tasks, nil
+}
+
+func (m Marathon) AppTasks(appId string) ([]*Task, error) {
+	tasks := &tasksResponse{}
+	if err := m.get("/v2/apps"+absoluteID(appId)+"/tasks", fmt.Sprintf("Failed retrieving tasks of %s from marathon", appId), tasks); err != nil {
+		return nil, err
+	}
+	return tasks.Tasks, nil
+}
+
+// KillTasks kills tasks of any app. With scale, the instances of their
+// apps are reduced instead of the tasks being replaced. Only scaling
+// starts a deployment; otherwise the result is empty.
+func (m Marathon) KillTasks(taskIds []string, scale bool) (*DeploymentResult, error) {
+	ids := map[string][]string{"ids": taskIds}
+	return m.deploy("POST", "/v2/tasks/delete"+scaleQuery(url.Values{}, scale), ids, "Failed killing tasks in marathon")
+}
+
+// KillAppTasks kills the tasks of an app, or only those on host when it
+// isn't empty.
+func (m Marathon) KillAppTasks(appId string, host string, scale bool) (*DeploymentResult, error) {
+	query := url.Values{}
+	if host != "" {
+		query.Set("host", host)
+	}
+	return m.deploy("DELETE", "/v2/apps"+absoluteID(appId)+"/tasks"+scaleQuery(query, scale), nil, fmt.Sprintf("Failed killing tasks of %s in marathon", appId))
+}
+
+func scaleQuery(query url.Values, scale bool) string {
+	if scale {
+		query.Set("scale", strconv.FormatBool(scale))
+	}
+	if len(query) == 0 {
+		return ""
+	}
+	return "?" + query.Encode()
+}
@@ -0,0 +1,63 @@
+package marathon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var marathonTasksJson = `{"tasks": [{"id": "example.1", "appId": "/example", "host": "worker-01", "ports": [31000], "slaveId": "s1", "stagedAt": "2016-03-01T10:00:00.000Z", "startedAt": "2016-03-01T10:00:05.000Z", "version": "2016-03-01T09:59:00.000Z", "healthCheckResults": [{"alive": true, "taskId": "example.1"}]}]}`
+
+func TestTasks(t *testing.T) {
+	t.Parallel()
+	var paths []string
+	ts, marathon := fakeMarathon(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		fmt.Fprint(w, marathonTasksJson)
+	})
+	defer ts.Close()
+
+	tasks, err := marathon.Tasks()
+	assert.Nil(t, err)
+	assert.Len(t, tasks, 1)
+	assert.Equal(t, "/example", tasks[0].AppID)
+	assert.Equal(t, []int{31000}, tasks[0].Ports)
+	assert.True(t, tasks[0].HealthCheckResults[0].Alive)
+
+	tasks, err = marathon.AppTasks("example")
+	assert.Nil(t, err)
+	assert.Equal(t, "worker-01", tasks[0].Host)
+
+	assert.Equal(t, []string{"/v2/tasks", "/v2/apps/example/tasks"}, paths)
+}
+
+func TestKillTasks(t *testing.T) {
+	t.Parallel()
+	var requests []string
+	ts, marathon := fakeMarathon(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests = append(requests, r.Method+" "+r.URL.RequestURI()+" "+string(body))
+		if r.URL.Query().Get("scale") == "true" {
+			fmt.Fprint(w, `{"version":"2015-10-07T12:56:01.940Z","deploymentId":"5ed4c0c5"}`)
+			return
+		}
+		fmt.Fprint(w, marathonTasksJson)
+	})
+	defer ts.Close()
+
+	result, err := marathon.KillTasks([]string{"example.1"}, true)
+	assert.Nil(t, err)
+	assert.Equal(t, "5ed4c0c5", result.DeploymentID)
+
+	result, err = marathon.KillAppTasks("/example", "worker-01", false)
+	assert.Nil(t, err)
+	assert.Equal(t, "", result.DeploymentID)
+
+	assert.Equal(t, []string{
+		`POST /v2/tasks/delete?scale=true {"ids":["example.1"]}`,
+		"DELETE /v2/apps/example/tasks?host=worker-01 ",
+	}, requests)
+}
@@ -37,6 +37,7 @@ type State struct {
 	Frameworks             []*Framework `json:"frameworks"`
 	UnregisteredFrameworks []string     `json:"unregistered_frameworks"`
 	Flags                  Flags        `json:"flags"`
+	Slaves                 []*Slave     `json:"slaves"`
 }
 
 type Flags struct {
@@ -44,6 +45,51 @@ type Flags struct {
 	AuthenticateSlaves string `json:"authenticate_slaves"`
 }
 
+type Slave struct {
+	ID         string                 `json:"id"`
+	Hostname   string                 `json:"hostname"`
+	Active     bool                   `json:"active"`
+	Attributes map[string]interface{} `json:"attributes"`
+	Resources  Resources              `json:"resources"`
+}
+
+type Resources struct {
+	CPUs  float64 `json:"cpus"`
+	Mem   float64 `json:"mem"`
+	Disk  float64 `json:"disk"`
+	Ports string  `json:"ports"`
+}
+
+// PortRanges parses ranges like [4000-5000, 31000-32000].
+func (r Resources) PortRanges() [][2]int {
+	var ranges [][2]int
+	for _, rng := range strings.Split(strings.Trim(r.Ports, "[] "), ",") {
+		bounds := strings.SplitN(strings.TrimSpace(rng), "-", 2)
+		if len(bounds) != 2 {
+			continue
+		}
+		begin, err1 := strconv.Atoi(bounds[0])
+		end, err2 := strconv.Atoi(bounds[1])
+		if err1 == nil && err2 == nil && begin <= end {
+			ranges = append(ranges, [2]int{begin, end})
+		}
+	}
+	return ranges
+}
+
+// Attribute returns the value of an attribute, or the hostname for the
+// hostname field that Marathon constraints use.
+func (s Slave) Attribute(name string) (string, bool) {
+	if name == "hostname" {
+		return s.Hostname, true
+	}
+	v, ok := s.Attributes[name]
+	if !ok {
+		return "", false
+	}
+	return fmt.Sprintf("%v", v), true
+}
+
 type Task struct {
 	FrameworkID string `json:"framework_id"`
 	ID          string `json:"id"`
@@ -86,6 +132,23 @@ func (m Mesos) CompletedFrameworks() ([]*Framework, error) {
 	return state.CompletedFrameworks, nil
 }
 
+// Slaves returns the active agents of the cluster.
+func (m Mesos) Slaves() ([]*Slave, error) {
+	state, err := m.state()
+	if err != nil {
+		return nil, err
+	}
+
+	var active []*Slave
+	for _, slave := range state.Slaves {
+		if slave.Active {
+			active = append(active, slave)
+		}
+	}
+
+	return active, nil
+}
+
 func (m Mesos) Shutdown(frameworkId string) error {
 	log.Debugf("Shutting down framework: %s", frameworkId)
 	data := fmt.Sprintf("frameworkId=%s", frameworkId)
@@ -264,6 +264,25 @@ func TestFrameworks(t *testing.T) {
 	assert.Equal(t, []string{"chronos", "marathon"}, fwNames)
 }
 
+func TestSlaves(t *testing.T) {
+	t.Parallel()
+	ts, mesos := fakeMesos(mesosStateHandler)
+	defer ts.Close()
+
+	slaves, err := mesos.Slaves()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(slaves))
+	assert.Equal(t, 748.0, slaves[0].Resources.Mem)
+	assert.Equal(t, [][2]int{{4000, 5000}, {31000, 32000}}, slaves[0].Resources.PortRanges())
+
+	nodeID, ok := slaves[0].Attribute("node_id")
+	assert.True(t, ok)
+	assert.Equal(t, "default", nodeID)
+
+	hostname, _ := slaves[0].Attribute("hostname")
+	assert.Equal(t, "default", hostname)
+}
+
 func TestShutdown(t *testing.T) {
 	t.Parallel()
 	ts, mesos := fakeMesos(func(w http.ResponseWriter, r *http.Request) {})
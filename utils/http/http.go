@@ -62,29 +62,45 @@ func (c HttpClient) Post(url string, data []byte) (*HttpRequest, error) {
 	return c.doRequest("POST", url, data)
 }
 
-func (c HttpClient) doRequest(method string, path string, data []byte) (*HttpRequest, error) {
-	url := c.url(path)
-	client := c.getClient()
+func (c HttpClient) Put(url string, data []byte) (*HttpRequest, error) {
+	return c.doRequest("PUT", url, data)
+}
 
-	var buf io.Reader
-	if len(data) > 0 {
-		buf = bytes.NewBuffer(data)
+// Stream sends a GET request for a stream of server-sent events. Unless
+// the request fails, the response body is left open for the caller to read
+// and close. Unsuccessful responses are read like any other response.
+func (c HttpClient) Stream(path string) (*HttpRequest, error) {
+	request, err := c.newRequest("GET", path, nil)
+	if err != nil {
+		return nil, err
 	}
+	request.Header.Set("Accept", "text/event-stream")
 
-	log.Debugf("%s %s", method, url)
-	request, err := h.NewRequest(method, url, buf)
-	request.Header.Add("Content-Type", "application/json")
-	request.Header.Add("Accept", "application/json")
+	httpReq := &HttpRequest{
+		Request:      request,
+		ResponseBody: []byte{},
+	}
 
-	if c.Username != "" && c.Password != "" {
-		request.SetBasicAuth(c.Username, c.Password)
+	response, err := c.getClient().Do(request)
+	httpReq.Response = response
+	if err != nil {
+		return httpReq, err
 	}
 
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		defer response.Body.Close()
+		responseBody, err := responseBody(response)
+		httpReq.ResponseBody = responseBody
+		httpReq.ResponseText = string(responseBody)
+		return httpReq, err
+	}
+
+	return httpReq, nil
+}
+
+func (c HttpClient) doRequest(method string, path string, data []byte) (*HttpRequest, error) {
+	request, err := c.newRequest(method, path, data)
 	if err != nil {
-		log.WithFields(log.Fields{
-			"method": method,
-			"url":    url,
-		}).Error(err)
 		return nil, err
 	}
 
@@ -93,7 +109,7 @@ func (c HttpClient) doRequest(method string, path string, data []byte) (*HttpReq
 		ResponseBody: []byte{},
 	}
 
-	response, err := client.Do(request)
+	response, err := c.getClient().Do(request)
 	httpReq.Response = response
 
 	if err != nil {
@@ -109,6 +125,34 @@ func (c HttpClient) doRequest(method string, path string, data []byte) (*HttpReq
 	return httpReq, err
 }
 
+func (c HttpClient) newRequest(method string, path string, data []byte) (*h.Request, error) {
+	url := c.url(path)
+
+	var buf io.Reader
+	if len(data) > 0 {
+		buf = bytes.NewBuffer(data)
+	}
+
+	log.Debugf("%s %s", method, url)
+	request, err := h.NewRequest(method, url, buf)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"method": method,
+			"url":    url,
+		}).Error(err)
+		return nil, err
+	}
+
+	request.Header.Add("Content-Type", "application/json")
+	request.Header.Add("Accept", "application/json")
+
+	if c.Username != "" && c.Password != "" {
+		request.SetBasicAuth(c.Username, c.Password)
+	}
+
+	return request, nil
+}
+
 func (c HttpClient) getClient() *h.Client {
 	client := &h.Client{}
 	client.Transport = &h.Transport{
@@ -122,11 +166,18 @@ func (c HttpClient) getClient() *h.Client {
 }
 
 func (c HttpClient) url(path string) string {
+	// paths may carry a query string
+	query := ""
+	if i := strings.Index(path, "?"); i >= 0 {
+		path, query = path[:i], path[i+1:]
+	}
+
 	urlPath := joinPaths(c.Path, path)
 	u := url.URL{
-		Scheme: c.Protocol,
-		Host:   c.Location,
-		Path:   urlPath,
+		Scheme:   c.Protocol,
+		Host:     c.Location,
+		Path:     urlPath,
+		RawQuery: query,
 	}
 
 	return u.String()
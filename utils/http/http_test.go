@@ -41,3 +41,10 @@ func TestJoinPath(t *testing.T) {
 		assert.Equal(t, testCase[0], joinedPath)
 	}
 }
+
+func TestUrlQuery(t *testing.T) {
+	client, err := NewHttpClient("http://localhost:8080/marathon", "", "", false)
+	assert.Nil(t, err)
+	assert.Equal(t, "http://localhost:8080/marathon/v2/apps/kafka/restart?force=true", client.url("/v2/apps/kafka/restart?force=true"))
+	assert.Equal(t, "http://localhost:8080/marathon/v2/apps/", client.url("/v2/apps/"))
+}